@@ -101,6 +101,18 @@ func CtxE(ctx context.Context) BTE {
 		cause:  ctx.Err(),
 	}
 }
+
+//Like CtxE, but for a query, where a deadline is the query's timeout
+func QueryCtxE(ctx context.Context) BTE {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &bTE{
+			code:   QueryTimeout,
+			reason: "query deadline exceeded",
+			cause:  ctx.Err(),
+		}
+	}
+	return CtxE(ctx)
+}
 func Chan(e BTE) chan BTE {
 	rv := make(chan BTE, 1)
 	rv <- e //buffered
@@ -109,11 +121,11 @@ func Chan(e BTE) chan BTE {
 
 //Context errors cascade quite a bit and tend to cause duplicate errors
 //in the return channel. Try not to leak goroutiens by]
-//blocking on them
+//blocking on them. Only queries use this, so a deadline is a QueryTimeout
 func ChkContextError(ctx context.Context, rve chan BTE) bool {
 	if ctx.Err() != nil {
 		select {
-		case rve <- CtxE(ctx):
+		case rve <- QueryCtxE(ctx):
 		default:
 		}
 		return true
@@ -201,6 +213,33 @@ const AnnotationVersionMismatch = 423
 // Fault injection is disabled (you need $BTRDB_ENABLE_FAULT_INJECTON=YES)
 const FaultInjectionDisabled = 424
 
+// The storage backend did not respond in time
+const StorageTimeout = 425
+
+// A point's time is outside the range that can be stored
+const InvalidTime = 426
+
+// A compare and swap of the stream version found a different version
+const StreamVersionMismatch = 427
+
+// A superblock read from storage failed its checksum
+const SuperblockCorrupt = 428
+
+// A block read from storage is malformed
+const BlockCorrupt = 429
+
+// A stream entry in a collection's metadata is malformed
+const StreamEntryCorrupt = 430
+
+// A query's context reached its deadline
+const QueryTimeout = 431
+
+// The server is shutting down and no longer accepts writes
+const ShuttingDown = 432
+
+// The node is a read replica and does not accept writes
+const ReadOnly = 433
+
 // Used for assert statements
 const InvariantFailure = 500
 
@@ -91,7 +91,7 @@ func main() {
 	//		go cpinterface.ServeCPNP(q, "tcp", cfg.CapnpAddress()+":"+strconv.FormatInt(int64(cfg.CapnpPort()), 10))
 	//	}
 	grpcHandle := grpcinterface.ServeGRPC(q, "0.0.0.0:4410")
-	go httpinterface.Run()
+	go httpinterface.Run(q, cfg)
 	// if Configuration.Debug.Heapprofile {
 	// 	go func() {
 	// 		idx := 0
@@ -0,0 +1,110 @@
+package btrdb
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+//A range of a stream that changed between two generations, with its points
+//at both
+type DiffRange struct {
+	Start int64
+	End   int64
+	//The points in [Start, End) at the first and second generation
+	Before []qtree.Record
+	After  []qtree.Record
+}
+
+//Reads every point of [start, end). A nil tree is the stream before its
+//first generation, which is empty
+func readRange(ctx context.Context, tr *qtree.QTree, start int64, end int64) ([]qtree.Record, bte.BTE) {
+	if tr == nil {
+		return nil, nil
+	}
+	var rv []qtree.Record
+	recordc, errc := tr.ReadStandardValuesCI(ctx, start, end)
+	for r := range recordc {
+		rv = append(rv, r)
+	}
+	//The tree closes its channel after an error too
+	select {
+	case err := <-errc:
+		return nil, err
+	default:
+	}
+	return rv, nil
+}
+
+//QueryDiff returns the ranges of the stream that changed between gen1 and
+//gen2, as QueryChangedRanges does, each with its points at both generations.
+//Both trees are opened once, so the diff is consistent whatever is written
+//meanwhile. The points of a range are held in memory, so use a resolution
+//that keeps ranges small. The resolved gen2 is returned
+func (q *Quasar) QueryDiff(ctx context.Context, id uuid.UUID, gen1 uint64, gen2 uint64, resolution uint8) (chan DiffRange, chan bte.BTE, uint64) {
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	//As in QueryChangedRanges, 0 and 1 mean before the first generation
+	var before *qtree.QTree
+	if gen1 > 1 {
+		var err bte.BTE
+		before, err = q.newReadTree(ctx, id, gen1)
+		if err != nil {
+			return nil, bte.Chan(err), 0
+		}
+	}
+	nctx, cancel := context.WithCancel(ctx)
+	rangec, rangeerrc, endgen := q.QueryChangedRanges(nctx, id, gen1, gen2, resolution)
+	if rangec == nil {
+		cancel()
+		return nil, rangeerrc, 0
+	}
+	after, err := q.newReadTree(ctx, id, endgen)
+	if err != nil {
+		cancel()
+		return nil, bte.Chan(err), 0
+	}
+	rv := make(chan DiffRange, 10)
+	rve := make(chan bte.BTE, 10)
+	go func() {
+		defer cancel()
+		for {
+			select {
+			case err := <-rangeerrc:
+				rve <- err
+				return
+			case cr, ok := <-rangec:
+				if !ok {
+					select {
+					case err := <-rangeerrc:
+						rve <- err
+						return
+					default:
+					}
+					close(rv)
+					return
+				}
+				d := DiffRange{Start: cr.Start, End: cr.End}
+				var err bte.BTE
+				if d.Before, err = readRange(nctx, before, cr.Start, cr.End); err != nil {
+					rve <- err
+					return
+				}
+				if d.After, err = readRange(nctx, after, cr.Start, cr.End); err != nil {
+					rve <- err
+					return
+				}
+				select {
+				case rv <- d:
+				case <-ctx.Done():
+					rve <- bte.CtxE(ctx)
+					return
+				}
+			}
+		}
+	}()
+	return rv, rve, endgen
+}
@@ -0,0 +1,55 @@
+package btrdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+//The default number of streams remembered as existing
+const DefaultStreamExistsCache = 65536
+
+//A bounded LRU set of streams known to exist. Only positive results are
+//cached, so a stream that is created after a failed check is seen at once
+type existCache struct {
+	mu  sync.Mutex
+	max int
+	ll  *list.List
+	m   map[[16]byte]*list.Element
+}
+
+//A cache of size zero remembers nothing
+func newExistCache(max int) *existCache {
+	return &existCache{
+		max: max,
+		ll:  list.New(),
+		m:   make(map[[16]byte]*list.Element),
+	}
+}
+
+func (c *existCache) contains(mk [16]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[mk]
+	if ok {
+		c.ll.MoveToFront(e)
+	}
+	return ok
+}
+
+func (c *existCache) add(mk [16]byte) {
+	if c.max <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.m[mk]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.m[mk] = c.ll.PushFront(mk)
+	if c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.m, oldest.Value.([16]byte))
+	}
+}
@@ -0,0 +1,104 @@
+package btrdb
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+//The number of points ImportStream commits at a time
+const ImportBatchSize = 100000
+
+//ExportStream returns every point of the stream in time order, reading the
+//leaves in one walk of the tree. The generation is resolved once, so the
+//export is consistent even if the stream is written to meanwhile. The
+//returned generation is the one exported: if an export is interrupted it
+//can be resumed from the last point received with ExportStreamFrom
+func (q *Quasar) ExportStream(ctx context.Context, id uuid.UUID, gen uint64) (chan qtree.Record, chan bte.BTE, uint64) {
+	return q.ExportStreamFrom(ctx, id, gen, MinimumTime)
+}
+
+//ExportStreamFrom is ExportStream for the points after the given time
+func (q *Quasar) ExportStreamFrom(ctx context.Context, id uuid.UUID, gen uint64, after int64) (chan qtree.Record, chan bte.BTE, uint64) {
+	if after >= MaximumTime-1 {
+		return nil, bte.Chan(bte.Err(bte.InvalidTimeRange, "nothing to export after the maximum time")), 0
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	recordc, errc := tr.ReadStandardValuesCI(ctx, after+1, MaximumTime)
+	return recordc, errc, tr.Generation()
+}
+
+//ImportStream inserts the points received until recordc is closed, bypassing
+//the coalescence buffer. Points are committed ImportBatchSize at a time, each
+//batch under the tree lock after any buffered points are committed, so
+//inserts can carry on between batches. Returns the number of points
+//committed, which on error is how many need not be imported again
+func (q *Quasar) ImportStream(ctx context.Context, id uuid.UUID, recordc chan qtree.Record) (int, bte.BTE) {
+	if err := q.CheckWritable(id); err != nil {
+		return 0, err
+	}
+	imported := 0
+	batch := make([]qtree.Record, 0, ImportBatchSize)
+	for {
+		done := false
+		select {
+		case r, ok := <-recordc:
+			if !ok {
+				done = true
+			} else {
+				batch = append(batch, r)
+			}
+		case <-ctx.Done():
+			return imported, bte.CtxE(ctx)
+		}
+		if len(batch) == ImportBatchSize || (done && len(batch) > 0) {
+			if err := q.importBatch(ctx, id, batch); err != nil {
+				return imported, err
+			}
+			imported += len(batch)
+			batch = batch[:0]
+		}
+		if done {
+			return imported, nil
+		}
+	}
+}
+
+func (q *Quasar) importBatch(ctx context.Context, id uuid.UUID, batch []qtree.Record) bte.BTE {
+	batch, err := q.checkInsertTimes(batch)
+	if err != nil {
+		return err
+	}
+	ot, mtx, err := q.getTree(id)
+	if err != nil {
+		return err
+	}
+	if err := lockCtx(ctx, mtx); err != nil {
+		return err
+	}
+	defer mtx.Unlock()
+	//Keep the buffered points, which were inserted earlier, ahead of the batch
+	if len(ot.store) != 0 {
+		if err := ot.commit(context.Background(), q); err != nil {
+			return err
+		}
+		ot.cancel()
+	}
+	tr, err := qtree.NewWriteQTree(q.bs, id)
+	if err != nil {
+		return err
+	}
+	if err := tr.InsertValues(batch); err != nil {
+		tr.Abort()
+		return err
+	}
+	return tr.Commit()
+}
@@ -39,8 +39,8 @@ var ErrBadPW = &Status{
 	Msg:  "Bad point width",
 }
 
-const MinimumTime = -(16 << 56)
-const MaximumTime = (48 << 56)
+const MinimumTime = btrdb.MinimumTime
+const MaximumTime = btrdb.MaximumTime
 const MaxInsertSize = 25000
 const RawBatchSize = 5000
 const StatBatchSize = 5000
@@ -356,7 +356,7 @@ func (a *apiProvider) Create(ctx context.Context, p *CreateParams) (*CreateRespo
 	for _, t := range p.Tags {
 		tgs[string(t.Key)] = string(t.Value)
 	}
-	err := a.b.StorageProvider().CreateStream(p.Uuid, p.Collection, tgs, p.Annotation)
+	err := a.b.CreateStream(p.Uuid, p.Collection, tgs, p.Annotation)
 	if err != nil {
 		bt := bte.MaybeWrap(err)
 		return &CreateResponse{Stat: &Status{
@@ -386,7 +386,7 @@ func (a *apiProvider) Insert(ctx context.Context, p *InsertParams) (*InsertRespo
 		qtr[idx].Time = pv.Time
 		qtr[idx].Val = pv.Value
 	}
-	err := a.b.InsertValues(p.Uuid, qtr)
+	err := a.b.InsertValues(ctx, p.Uuid, qtr)
 	if err != nil {
 		return &InsertResponse{Stat: &Status{
 			Code: uint32(err.Code()),
@@ -411,7 +411,7 @@ func (a *apiProvider) ListStreams(ctx context.Context, p *ListStreamsParams) (*L
 		tgs[string(t.Key)] = string(t.Value)
 	}
 
-	strms, err := a.b.StorageProvider().ListStreams(string(p.Collection), p.Partial, tgs)
+	strms, err := a.b.StorageProvider().ListStreams(string(p.Collection), p.Partial, tgs, false)
 	if err != nil {
 		return &ListStreamsResponse{Stat: &Status{
 			Code: uint32(err.Code()),
@@ -0,0 +1,185 @@
+package httpinterface
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
+	"github.com/pborman/uuid"
+)
+
+//Checks the request carries the configured admin bearer token, writing an
+//error and returning false if not
+func checkAdmin(cfg configprovider.Configuration, w http.ResponseWriter, r *http.Request) bool {
+	token := cfg.HttpAdminToken()
+	if token == "" {
+		doErrorStatus(w, r, http.StatusForbidden, bte.Err(bte.WrongArgs, "admin endpoints are disabled"))
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) != 1 {
+		lg.Warningf("rejected unauthorized admin request for %s from %s", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		doErrorStatus(w, r, http.StatusUnauthorized, bte.Err(bte.WrongArgs, "unauthorized"))
+		return false
+	}
+	return true
+}
+
+//Commits the buffered points of every stream without shutting down
+func request_post_FLUSHALL(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be POST"))
+		return
+	}
+	flushed, err := q.FlushAll()
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	lg.Warningf("admin flush committed %d streams", flushed)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Flushed int `json:"flushed"`
+	}{flushed})
+}
+
+//Implemented by storage providers whose read cache can be resized
+type readCacheResizer interface {
+	ResizeReadCache(sizeMB uint64)
+}
+
+//Resizes the storage read cache to the size parameter, in MB
+func request_post_READCACHE(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be POST"))
+		return
+	}
+	size, err := strconv.ParseUint(r.URL.Query().Get("size"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "size must be a number of MB"))
+		return
+	}
+	rc, ok := q.StorageProvider().(readCacheResizer)
+	if !ok {
+		doError(w, r, bte.Err(bte.NotImplemented, "the storage provider has no resizable read cache"))
+		return
+	}
+	rc.ResizeReadCache(size)
+	lg.Warningf("admin resized read cache to %d MB", size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		SizeMB uint64 `json:"sizeMB"`
+	}{size})
+}
+
+//Lists the number of uncommitted points buffered for each open stream
+func request_get_PENDING(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	stats := q.PendingStats()
+	rv := make(map[string]int, len(stats))
+	total := 0
+	for id, n := range stats {
+		rv[uuid.UUID(id[:]).String()] = n
+		total += n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Total   int            `json:"total"`
+		Streams map[string]int `json:"streams"`
+	}{total, rv})
+}
+
+//Implemented by storage providers that can report the storage used by a stream
+type streamStorageStatser interface {
+	StreamStorageStats(uuid []byte) (int64, int64, bte.BTE)
+	ApproxStreamStorageStats(uuid []byte) (int64, int64, bte.BTE)
+}
+
+//Reports the objects and bytes stored for the stream given by the uuid
+//parameter. The exact count lists the whole data pool, so approximate=true
+//gives a faster lower bound from the objects of the current version
+func request_get_STREAMSTORAGE(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	id := uuid.Parse(r.URL.Query().Get("uuid"))
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	approx := r.URL.Query().Get("approximate") == "true"
+	ss, ok := q.StorageProvider().(streamStorageStatser)
+	if !ok {
+		doError(w, r, bte.Err(bte.NotImplemented, "the storage provider cannot report stream storage"))
+		return
+	}
+	var objects, bytes int64
+	var err bte.BTE
+	if approx {
+		objects, bytes, err = ss.ApproxStreamStorageStats(id)
+	} else {
+		objects, bytes, err = ss.StreamStorageStats(id)
+	}
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Objects     int64 `json:"objects"`
+		Bytes       int64 `json:"bytes"`
+		Approximate bool  `json:"approximate"`
+	}{objects, bytes, approx})
+}
+
+//Writes the superblocks of the stream given by the uuid parameter as JSON,
+//from generation startgen to endgen, which default to the first and latest.
+//This is for debugging, so it is only served if enabled in the config
+func request_get_SUPERBLOCKS(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id := uuid.Parse(r.Form.Get("uuid"))
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	var startgen uint64
+	var err error
+	if s := r.Form.Get("startgen"); s != "" {
+		startgen, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed startgen"))
+			return
+		}
+	}
+	endgen := btrdb.LatestGeneration
+	if s := r.Form.Get("endgen"); s != "" && s != "0" {
+		endgen, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed endgen"))
+			return
+		}
+	}
+	sbs, berr := q.DumpSuperblocks(id, startgen, endgen)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	type sbinfo struct {
+		Generation uint64 `json:"generation"`
+		Root       uint64 `json:"root"`
+		Walltime   int64  `json:"walltime"`
+		Error      string `json:"error,omitempty"`
+	}
+	rv := make([]sbinfo, len(sbs))
+	for i, sb := range sbs {
+		rv[i] = sbinfo{Generation: sb.Generation, Root: sb.Root, Walltime: sb.Walltime}
+		if sb.Err != nil {
+			rv[i].Error = sb.Err.Error()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rv)
+}
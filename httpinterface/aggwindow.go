@@ -0,0 +1,80 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//Returns windows aggregated over every stream in a collection with the given
+//tags as newline delimited JSON. Parameters are collection, tag (repeated, as
+//key=value), start, end, unit, width (in unit) and depth
+func request_get_AGGWINDOW(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	collection := r.Form.Get("collection")
+	if collection == "" {
+		doError(w, r, bte.Err(bte.WrongArgs, "collection is required"))
+		return
+	}
+	tags := make(map[string]string)
+	for _, t := range r.Form["tag"] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			doError(w, r, bte.Err(bte.WrongArgs, "tags must be given as key=value"))
+			return
+		}
+		tags[kv[0]] = kv[1]
+	}
+	rawst, err := strconv.ParseInt(r.Form.Get("start"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed start time"))
+		return
+	}
+	rawet, err := strconv.ParseInt(r.Form.Get("end"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed end time"))
+		return
+	}
+	st, et, berr := parseTimeRange(rawst, rawet, r.Form.Get("unit"))
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	width, err := strconv.ParseInt(r.Form.Get("width"), 10, 64)
+	if err != nil || width <= 0 {
+		doError(w, r, bte.Err(bte.WrongArgs, "width must be a positive integer"))
+		return
+	}
+	mul, _ := unitMultiplier(r.Form.Get("unit"))
+	var depth uint64
+	if ds := r.Form.Get("depth"); ds != "" {
+		depth, err = strconv.ParseUint(ds, 10, 8)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed depth"))
+			return
+		}
+	}
+	recs, errs := q.QueryCollectionWindow(r.Context(), collection, tags, st, et, uint64(width*mul), uint8(depth))
+	if recs == nil {
+		doError(w, r, <-errs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for rec := range recs {
+		row := stat_row{Time: rec.Time, Count: rec.Count, Min: rec.Min, Mean: rec.Mean, Max: rec.Max}
+		if enc.Encode(&row) != nil {
+			//The client has gone away
+			return
+		}
+	}
+	select {
+	case err := <-errs:
+		enc.Encode(newJSONError(err))
+	default:
+	}
+}
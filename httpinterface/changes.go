@@ -0,0 +1,80 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+type changed_range_row struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type changes_end_row struct {
+	Generation uint64 `json:"generation"`
+}
+
+//Streams the ranges changed between two generations as newline delimited
+//JSON, followed by the generation the ranges were resolved against. If the
+//query fails part way a trailing error object is written instead, so a
+//response without the generation row is incomplete. Parameters are uuid,
+//startgen, endgen and resolution
+func request_get_CHANGES(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id := uuid.Parse(r.Form.Get("uuid"))
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	var startgen uint64
+	var err error
+	if s := r.Form.Get("startgen"); s != "" {
+		startgen, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed startgen"))
+			return
+		}
+	}
+	endgen := btrdb.LatestGeneration
+	if s := r.Form.Get("endgen"); s != "" && s != "0" {
+		endgen, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed endgen"))
+			return
+		}
+	}
+	//Same bounds as the grpc interface
+	resolution, err := strconv.ParseUint(r.Form.Get("resolution"), 10, 8)
+	if err != nil || resolution > 64 {
+		doError(w, r, bte.Err(bte.InvalidPointWidth, "Invalid resolution parameter"))
+		return
+	}
+	cval, cerr, gen := q.QueryChangedRanges(r.Context(), id, startgen, endgen, uint8(resolution))
+	if cval == nil {
+		doError(w, r, <-cerr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case err := <-cerr:
+			enc.Encode(newJSONError(err))
+			return
+		case cr, ok := <-cval:
+			if !ok {
+				enc.Encode(&changes_end_row{Generation: gen})
+				return
+			}
+			if enc.Encode(&changed_range_row{Start: cr.Start, End: cr.End}) != nil {
+				//The client has gone away
+				return
+			}
+		}
+	}
+}
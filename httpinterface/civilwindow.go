@@ -0,0 +1,76 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+type stat_row struct {
+	Time  int64   `json:"time"`
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	Max   float64 `json:"max"`
+}
+
+//Returns one stat record per calendar day or hour in an IANA time zone as
+//newline delimited JSON. Parameters are uuid, start, end, unit, tz, window
+//(day or hour) and ver or asof
+func request_get_CIVILWINDOW(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id := uuid.Parse(r.Form.Get("uuid"))
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	rawst, err := strconv.ParseInt(r.Form.Get("start"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed start time"))
+		return
+	}
+	rawet, err := strconv.ParseInt(r.Form.Get("end"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed end time"))
+		return
+	}
+	st, et, berr := parseTimeRange(rawst, rawet, r.Form.Get("unit"))
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	loc, err := time.LoadLocation(r.Form.Get("tz"))
+	if err != nil {
+		doError(w, r, bte.ErrW(bte.WrongArgs, "unknown time zone", err))
+		return
+	}
+	ver, berr := parseVersion(q, id, r.Form)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	recs, errs, _ := q.QueryCivilWindow(r.Context(), id, st, et, ver, loc, r.Form.Get("window"))
+	if recs == nil {
+		doError(w, r, <-errs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for rec := range recs {
+		row := stat_row{Time: rec.Time, Count: rec.Count, Min: rec.Min, Mean: rec.Mean, Max: rec.Max}
+		if enc.Encode(&row) != nil {
+			//The client has gone away
+			return
+		}
+	}
+	select {
+	case err := <-errs:
+		enc.Encode(newJSONError(err))
+	default:
+	}
+}
@@ -0,0 +1,46 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//The most collections returned by one listing if number is not given
+const defaultCollectionsNumber = 1000
+
+type collections_listing struct {
+	Collections []string `json:"collections"`
+	//Pass as start to continue the listing, empty once it is finished
+	Next string `json:"next"`
+}
+
+//Handles GET /v4.0/collectionsmatching?pattern=...&start=...&number=..., see
+//ListCollectionsMatching. A listing may return fewer than number collections
+//before it is finished, so clients page with next until it is empty
+func request_get_COLLECTIONSMATCHING(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be GET"))
+		return
+	}
+	r.ParseForm()
+	number := int64(defaultCollectionsNumber)
+	if ns := r.Form.Get("number"); ns != "" {
+		var err error
+		number, err = strconv.ParseInt(ns, 10, 64)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed number"))
+			return
+		}
+	}
+	cols, next, err := q.StorageProvider().ListCollectionsMatching(r.Form.Get("pattern"), r.Form.Get("start"), number)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collections_listing{Collections: cols, Next: next})
+}
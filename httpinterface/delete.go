@@ -0,0 +1,62 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+//Handles POST /streams/{uuid}/delete, deleting [starttime, endtime) in
+//unitoftime from the stream. Returns the generation of the deletion so the
+//client can confirm it landed
+func request_post_DELETE(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be POST"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/streams/"), "/")
+	if len(parts) != 2 || parts[1] != "delete" {
+		doError(w, r, bte.Err(bte.WrongArgs, "expected /streams/{uuid}/delete"))
+		return
+	}
+	id := uuid.Parse(parts[0])
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	r.ParseForm()
+	rawst, err := strconv.ParseInt(r.Form.Get("starttime"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed start time"))
+		return
+	}
+	rawet, err := strconv.ParseInt(r.Form.Get("endtime"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed end time"))
+		return
+	}
+	st, et, berr := parseTimeRange(rawst, rawet, r.Form.Get("unitoftime"))
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	if info, _ := q.StorageProvider().GetStreamInfo(id); info == nil {
+		doError(w, r, bte.Err(bte.NoSuchStream, "stream not found"))
+		return
+	}
+	gen, berr := q.DeleteRangeGeneration(id, st, et)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	lg.Warningf("deleted [%d, %d) from %s over HTTP, generation %d", st, et, id.String(), gen)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Generation uint64 `json:"generation"`
+	}{gen})
+}
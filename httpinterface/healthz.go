@@ -0,0 +1,19 @@
+package httpinterface
+
+import (
+	"net/http"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+)
+
+//Reports whether the storage provider can be reached, for use as a liveness
+//or readiness probe
+func request_get_HEALTHZ(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	err := q.StorageProvider().Healthy()
+	if err != nil {
+		lg.Warningf("health check failed: %v", err)
+		doErrorStatus(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
 	gw "github.com/SoftwareDefinedBuildings/btrdb/grpcinterface"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
 	assetfs "github.com/elazarl/go-bindata-assetfs"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
 	"google.golang.org/grpc"
@@ -38,7 +41,7 @@ func InitiateShutdown() chan struct{} {
 	close(rv)
 	return rv
 }
-func Run() error {
+func Run(q *btrdb.Quasar, cfg configprovider.Configuration) error {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -47,6 +50,90 @@ func Run() error {
 	mux.HandleFunc("/v4.0/swagger.json", func(w http.ResponseWriter, req *http.Request) {
 		io.Copy(w, strings.NewReader(SwaggerJSON))
 	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		request_get_HEALTHZ(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/nearest", func(w http.ResponseWriter, req *http.Request) {
+		request_get_NEAREST(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/collectionnearest", func(w http.ResponseWriter, req *http.Request) {
+		request_get_COLLECTIONNEAREST(q, w, req)
+	})
+	mux.HandleFunc("/streams/", func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasSuffix(req.URL.Path, "/delete") {
+			if !cfg.HttpAllowDelete() {
+				doErrorStatus(w, req, http.StatusForbidden, bte.Err(bte.WrongArgs, "deletion is disabled"))
+				return
+			}
+			if !checkAdmin(cfg, w, req) {
+				return
+			}
+			request_post_DELETE(q, w, req)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, "/insert") {
+			if !cfg.HttpAllowInsert() {
+				doErrorStatus(w, req, http.StatusForbidden, bte.Err(bte.WrongArgs, "insertion is disabled"))
+				return
+			}
+			if !checkAdmin(cfg, w, req) {
+				return
+			}
+			request_post_INSERT(q, w, req)
+			return
+		}
+		request_get_STREAMINFO(q, w, req)
+	})
+	mux.HandleFunc("/collections/", func(w http.ResponseWriter, req *http.Request) {
+		request_get_LISTSTREAMS(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/collectionsmatching", func(w http.ResponseWriter, req *http.Request) {
+		request_get_COLLECTIONSMATCHING(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/civilwindow", func(w http.ResponseWriter, req *http.Request) {
+		request_get_CIVILWINDOW(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/changes", func(w http.ResponseWriter, req *http.Request) {
+		request_get_CHANGES(q, w, req)
+	})
+	mux.HandleFunc("/v4.0/aggwindow", func(w http.ResponseWriter, req *http.Request) {
+		request_get_AGGWINDOW(q, w, req)
+	})
+	mux.HandleFunc("/admin/flushall", func(w http.ResponseWriter, req *http.Request) {
+		if !checkAdmin(cfg, w, req) {
+			return
+		}
+		request_post_FLUSHALL(q, w, req)
+	})
+	mux.HandleFunc("/admin/pending", func(w http.ResponseWriter, req *http.Request) {
+		if !checkAdmin(cfg, w, req) {
+			return
+		}
+		request_get_PENDING(q, w, req)
+	})
+	mux.HandleFunc("/admin/readcache", func(w http.ResponseWriter, req *http.Request) {
+		if !checkAdmin(cfg, w, req) {
+			return
+		}
+		request_post_READCACHE(q, w, req)
+	})
+	mux.HandleFunc("/admin/streamstorage", func(w http.ResponseWriter, req *http.Request) {
+		if !checkAdmin(cfg, w, req) {
+			return
+		}
+		request_get_STREAMSTORAGE(q, w, req)
+	})
+	if cfg.HttpDebugEndpoints() {
+		mux.HandleFunc("/debug/superblocks", func(w http.ResponseWriter, req *http.Request) {
+			if !checkAdmin(cfg, w, req) {
+				return
+			}
+			request_get_SUPERBLOCKS(q, w, req)
+		})
+	}
+	mux.HandleFunc("/v4.0/multiraw", func(w http.ResponseWriter, req *http.Request) {
+		request_post_MULTIRAW(q, w, req)
+	})
 
 	gwmux := runtime.NewServeMux()
 	opts := []grpc.DialOption{grpc.WithInsecure()}
@@ -0,0 +1,113 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+//The number of points parsed before they are inserted, which bounds the
+//memory a request uses
+const insertBatchSize = 10000
+
+type insert_row struct {
+	Time  *int64   `json:"time"`
+	Value *float64 `json:"value"`
+}
+
+//Handles POST /streams/{uuid}/insert. The body is newline delimited JSON
+//objects with a time (in the unitoftime parameter) and a value. Points are
+//inserted as they are parsed, insertBatchSize at a time, then committed so
+//the generation containing them can be returned. If a line is malformed or
+//an insert fails, the batches before it have already been inserted. Like
+//delete, it must be enabled with HttpAllowInsert and needs the admin token
+func request_post_INSERT(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be POST"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/streams/"), "/")
+	if len(parts) != 2 || parts[1] != "insert" {
+		doError(w, r, bte.Err(bte.WrongArgs, "expected /streams/{uuid}/insert"))
+		return
+	}
+	id := uuid.Parse(parts[0])
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	unit := r.URL.Query().Get("unitoftime")
+	if _, ok := unitMultiplier(unit); !ok {
+		doError(w, r, bte.Err(bte.WrongArgs, "unit of time must be one of ns, us, ms or s"))
+		return
+	}
+	if err := q.CheckWritable(id); err != nil {
+		doError(w, r, err)
+		return
+	}
+	dec := json.NewDecoder(r.Body)
+	batch := make([]qtree.Record, 0, insertBatchSize)
+	inserted := 0
+	flush := func() bte.BTE {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := q.InsertValues(r.Context(), id, batch); err != nil {
+			return err
+		}
+		inserted += len(batch)
+		batch = make([]qtree.Record, 0, insertBatchSize)
+		return nil
+	}
+	for {
+		var row insert_row
+		err := dec.Decode(&row)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			doError(w, r, bte.ErrF(bte.WrongArgs, "malformed point after %d points: %v", inserted+len(batch), err))
+			return
+		}
+		if row.Time == nil || row.Value == nil {
+			doError(w, r, bte.ErrF(bte.WrongArgs, "point %d needs a time and a value", inserted+len(batch)))
+			return
+		}
+		t, berr := parseTime(*row.Time, unit)
+		if berr != nil {
+			doError(w, r, berr)
+			return
+		}
+		batch = append(batch, qtree.Record{Time: t, Val: *row.Value})
+		if len(batch) == insertBatchSize {
+			if err := flush(); err != nil {
+				doError(w, r, err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		doError(w, r, err)
+		return
+	}
+	if err := q.Flush(id); err != nil {
+		doError(w, r, err)
+		return
+	}
+	gen, err := q.QueryGeneration(id)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Inserted   int    `json:"inserted"`
+		Generation uint64 `json:"generation"`
+	}{inserted, gen})
+}
@@ -0,0 +1,82 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+type stream_listing struct {
+	UUID       string            `json:"uuid"`
+	Collection string            `json:"collection"`
+	Tags       map[string]string `json:"tags"`
+	//Only present if annotations were requested
+	Annotation        []byte  `json:"annotation,omitempty"`
+	AnnotationVersion *uint64 `json:"annotationVersion,omitempty"`
+}
+
+//Handles GET /collections/{collection}/streams. Tags to match are given as
+//tag.<key>=<value> parameters, and partial has the same meaning as in
+//ListStreams. If annotations is true, each stream's annotation (base64
+//encoded) and its version are included
+func request_get_LISTSTREAMS(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be GET"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/collections/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "streams" {
+		doError(w, r, bte.Err(bte.WrongArgs, "expected /collections/{collection}/streams"))
+		return
+	}
+	r.ParseForm()
+	tags := make(map[string]string)
+	for k, v := range r.Form {
+		if strings.HasPrefix(k, "tag.") {
+			tags[strings.TrimPrefix(k, "tag.")] = v[0]
+		}
+	}
+	partial := false
+	if ps := r.Form.Get("partial"); ps != "" {
+		var err error
+		partial, err = strconv.ParseBool(ps)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed partial flag"))
+			return
+		}
+	}
+	annotations := false
+	if as := r.Form.Get("annotations"); as != "" {
+		var err error
+		annotations, err = strconv.ParseBool(as)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed annotations flag"))
+			return
+		}
+	}
+	strms, err := q.StorageProvider().ListStreams(parts[0], partial, tags, annotations)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	rv := make([]stream_listing, len(strms))
+	for i, s := range strms {
+		rv[i] = stream_listing{
+			UUID:       uuid.UUID(s.UUID()).String(),
+			Collection: s.Collection(),
+			Tags:       s.Tags(),
+		}
+		if annotations {
+			ann, aver := s.Annotation()
+			rv[i].Annotation = ann
+			rv[i].AnnotationVersion = &aver
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rv)
+}
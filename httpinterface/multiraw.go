@@ -0,0 +1,158 @@
+package httpinterface
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+type multi_raw_req struct {
+	UUIDS      []string
+	Labels     []string
+	StartTime  int64
+	EndTime    int64
+	UnitofTime string
+	//Include points not yet committed by coalescence on this node
+	ReadYourWrites bool
+	//If given, the generation to read each stream at, 0 meaning the latest.
+	//Buffered points are only included for streams read at the latest
+	Versions []uint64
+}
+
+type raw_row struct {
+	Time   int64              `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+//The head record of one stream in the merge
+type rawHead struct {
+	rec qtree.Record
+	idx int
+}
+
+type rawHeap []rawHead
+
+func (h rawHeap) Len() int { return len(h) }
+func (h rawHeap) Less(i, j int) bool {
+	if h[i].rec.Time == h[j].rec.Time {
+		return h[i].idx < h[j].idx
+	}
+	return h[i].rec.Time < h[j].rec.Time
+}
+func (h rawHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rawHeap) Push(x interface{}) { *h = append(*h, x.(rawHead)) }
+func (h *rawHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	rv := old[n-1]
+	*h = old[:n-1]
+	return rv
+}
+
+//Merges the raw values of several streams by time and writes them out as
+//newline delimited JSON. Only one record per stream is buffered at a time
+func request_post_MULTIRAW(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be POST"))
+		return
+	}
+	var req multi_raw_req
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&req); err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed request: "+err.Error()))
+		return
+	}
+	if len(req.UUIDS) == 0 || len(req.UUIDS) != len(req.Labels) {
+		doError(w, r, bte.Err(bte.WrongArgs, "UUIDS and Labels must be nonempty and of equal length"))
+		return
+	}
+	if len(req.Versions) != 0 && len(req.Versions) != len(req.UUIDS) {
+		doError(w, r, bte.Err(bte.WrongArgs, "Versions must be empty or of the same length as UUIDS"))
+		return
+	}
+	st, et, berr := parseTimeRange(req.StartTime, req.EndTime, req.UnitofTime)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	uids := make([]uuid.UUID, len(req.UUIDS))
+	for i, s := range req.UUIDS {
+		uids[i] = uuid.Parse(s)
+		if uids[i] == nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID: "+s))
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	if req.ReadYourWrites {
+		ctx = btrdb.WithReadYourWrites(ctx)
+	}
+	chanVs := make([]chan qtree.Record, len(uids))
+	chanEs := make([]chan bte.BTE, len(uids))
+	for i, id := range uids {
+		gen := btrdb.LatestGeneration
+		if len(req.Versions) != 0 && req.Versions[i] != 0 {
+			gen = req.Versions[i]
+		}
+		chanVs[i], chanEs[i], _ = q.QueryValuesStream(ctx, id, st, et, gen)
+	}
+
+	h := &rawHeap{}
+	//Loads the next record of the given stream into the heap. The value channel
+	//is closed once the stream is exhausted, but an error may still be pending
+	reload := func(i int) bte.BTE {
+		select {
+		case v, ok := <-chanVs[i]:
+			if ok {
+				heap.Push(h, rawHead{rec: v, idx: i})
+				return nil
+			}
+			select {
+			case err := <-chanEs[i]:
+				return err
+			default:
+				return nil
+			}
+		case err := <-chanEs[i]:
+			return err
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for i := range uids {
+		if err := reload(i); err != nil {
+			enc.Encode(newJSONError(err))
+			return
+		}
+	}
+	for h.Len() > 0 {
+		row := raw_row{Time: (*h)[0].rec.Time, Values: make(map[string]float64)}
+		for h.Len() > 0 && (*h)[0].rec.Time == row.Time {
+			hd := heap.Pop(h).(rawHead)
+			lbl := req.Labels[hd.idx]
+			if _, ok := row.Values[lbl]; ok {
+				lg.Warningf("discarding duplicate time %v:%v", lbl, row.Time)
+			} else {
+				row.Values[lbl] = hd.rec.Val
+			}
+			if err := reload(hd.idx); err != nil {
+				enc.Encode(&row)
+				enc.Encode(newJSONError(err))
+				return
+			}
+		}
+		if err := enc.Encode(&row); err != nil {
+			//The client has gone away
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+type nearest_resp struct {
+	Time  int64   `json:"time"`
+	Value float64 `json:"value"`
+}
+
+//One stream's entry in a collection nearest response. Streams without a
+//nearest point carry the error instead
+type collection_nearest_resp struct {
+	Time  *int64      `json:"time,omitempty"`
+	Value *float64    `json:"value,omitempty"`
+	Error *json_error `json:"error,omitempty"`
+}
+
+//Returns the nearest point before (if backwards) or after the given time.
+//Parameters are uuid, time, unit, backwards and ver or asof
+func request_get_NEAREST(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	id := uuid.Parse(r.Form.Get("uuid"))
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	rawt, err := strconv.ParseInt(r.Form.Get("time"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed time"))
+		return
+	}
+	t, berr := parseTime(rawt, r.Form.Get("unit"))
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	backwards := false
+	if bs := r.Form.Get("backwards"); bs != "" {
+		backwards, err = strconv.ParseBool(bs)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed backwards flag"))
+			return
+		}
+	}
+	ver, berr := parseVersion(q, id, r.Form)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	rec, berr, _ := q.QueryNearestValue(r.Context(), id, t, backwards, ver)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&nearest_resp{Time: rec.Time, Value: rec.Val})
+}
+
+//Returns the nearest point in every stream in a collection with the given
+//tags, as an object keyed by UUID. Parameters are collection, tag (repeated,
+//as key=value), time, unit and backwards
+func request_get_COLLECTIONNEAREST(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	collection := r.Form.Get("collection")
+	if collection == "" {
+		doError(w, r, bte.Err(bte.WrongArgs, "collection is required"))
+		return
+	}
+	tags := make(map[string]string)
+	for _, t := range r.Form["tag"] {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			doError(w, r, bte.Err(bte.WrongArgs, "tags must be given as key=value"))
+			return
+		}
+		tags[kv[0]] = kv[1]
+	}
+	rawt, err := strconv.ParseInt(r.Form.Get("time"), 10, 64)
+	if err != nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed time"))
+		return
+	}
+	t, berr := parseTime(rawt, r.Form.Get("unit"))
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	backwards := false
+	if bs := r.Form.Get("backwards"); bs != "" {
+		backwards, err = strconv.ParseBool(bs)
+		if err != nil {
+			doError(w, r, bte.Err(bte.WrongArgs, "malformed backwards flag"))
+			return
+		}
+	}
+	res, berr := q.QueryCollectionNearest(r.Context(), collection, tags, t, backwards)
+	if berr != nil {
+		doError(w, r, berr)
+		return
+	}
+	rv := make(map[string]collection_nearest_resp, len(res))
+	for id, n := range res {
+		if n.Err != nil {
+			rv[id] = collection_nearest_resp{Error: newJSONError(n.Err)}
+			continue
+		}
+		tm, val := n.Record.Time, n.Record.Val
+		rv[id] = collection_nearest_resp{Time: &tm, Value: &val}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rv)
+}
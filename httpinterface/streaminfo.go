@@ -0,0 +1,75 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+type stream_info_resp struct {
+	UUID              string            `json:"uuid"`
+	Collection        string            `json:"collection"`
+	Tags              map[string]string `json:"tags"`
+	Generation        uint64            `json:"generation"`
+	AnnotationVersion uint64            `json:"annotationVersion"`
+	//RFC 3339, or "unknown" for streams from before it was recorded
+	Created string `json:"created"`
+}
+
+//Handles GET /streams/{uuid}/info, returning the stream's metadata and
+//current generation in one response
+func request_get_STREAMINFO(q *btrdb.Quasar, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		doErrorStatus(w, r, http.StatusMethodNotAllowed, bte.Err(bte.WrongArgs, "method must be GET"))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/streams/"), "/")
+	if len(parts) != 2 || parts[1] != "info" {
+		doError(w, r, bte.Err(bte.WrongArgs, "expected /streams/{uuid}/info"))
+		return
+	}
+	id := uuid.Parse(parts[0])
+	if id == nil {
+		doError(w, r, bte.Err(bte.WrongArgs, "malformed UUID"))
+		return
+	}
+	sp := q.StorageProvider()
+	info, _ := sp.GetStreamInfo(id)
+	if info == nil {
+		doError(w, r, bte.Err(bte.NoSuchStream, "stream not found"))
+		return
+	}
+	gen, err := q.QueryGeneration(id)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	_, aver, err := sp.GetStreamAnnotation(id)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	created, err := sp.GetStreamCreationTime(id)
+	if err != nil {
+		doError(w, r, err)
+		return
+	}
+	cs := "unknown"
+	if !created.IsZero() {
+		cs = created.UTC().Format(time.RFC3339Nano)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&stream_info_resp{
+		UUID:              id.String(),
+		Collection:        info.Collection(),
+		Tags:              info.Tags(),
+		Generation:        gen,
+		AnnotationVersion: aver,
+		Created:           cs,
+	})
+}
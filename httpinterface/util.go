@@ -0,0 +1,158 @@
+package httpinterface
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb"
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	logging "github.com/op/go-logging"
+	"github.com/pborman/uuid"
+)
+
+var lg *logging.Logger
+
+func init() {
+	lg = logging.MustGetLogger("log")
+}
+
+type json_error struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newJSONError(e bte.BTE) *json_error {
+	rv := &json_error{}
+	rv.Error.Code = e.Code()
+	rv.Error.Message = e.Reason()
+	return rv
+}
+
+//Writes the error with the HTTP status matching its code
+func doError(w http.ResponseWriter, r *http.Request, e bte.BTE) {
+	doErrorStatus(w, r, httpStatus(e.Code()), e)
+}
+
+//Writes the error as a JSON object carrying its code and message, or as the
+//bare message if the client only accepts plain text
+func doErrorStatus(w http.ResponseWriter, r *http.Request, status int, e bte.BTE) {
+	if acceptsPlainText(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(e.Reason()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newJSONError(e))
+}
+
+//True if the Accept header asks for text/plain and not for JSON
+func acceptsPlainText(r *http.Request) bool {
+	acc := r.Header.Get("Accept")
+	return strings.Contains(acc, "text/plain") && !strings.Contains(acc, "application/json")
+}
+
+//Maps a BTE error code to the closest HTTP status
+func httpStatus(code int) int {
+	switch code {
+	case bte.NoSuchPoint, bte.NoSuchStream:
+		return http.StatusNotFound
+	case bte.ContextError:
+		return http.StatusRequestTimeout
+	case bte.WrongEndpoint, bte.ClusterDegraded, bte.ShuttingDown, bte.ReadOnly:
+		return http.StatusServiceUnavailable
+	case bte.StorageTimeout, bte.QueryTimeout:
+		return http.StatusGatewayTimeout
+	case bte.StreamExists, bte.SameStream, bte.AnnotationVersionMismatch, bte.StreamVersionMismatch:
+		return http.StatusConflict
+	case bte.NotImplemented:
+		return http.StatusNotImplemented
+	case bte.SuperblockCorrupt, bte.BlockCorrupt, bte.StreamEntryCorrupt:
+		return http.StatusInternalServerError
+	}
+	if code >= 500 {
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+//Returns the number of nanoseconds in the given unit of time. An empty unit
+//is treated as nanoseconds
+func unitMultiplier(unit string) (int64, bool) {
+	switch unit {
+	case "", "ns":
+		return 1, true
+	case "us":
+		return 1000, true
+	case "ms":
+		return 1000000, true
+	case "s":
+		return 1000000000, true
+	}
+	return 0, false
+}
+
+//Converts a time in the given unit to nanoseconds and checks that it is
+//within the range of times that can be stored
+func parseTime(t int64, unit string) (int64, bte.BTE) {
+	mul, ok := unitMultiplier(unit)
+	if !ok {
+		return 0, bte.Err(bte.WrongArgs, "unit of time must be one of ns, us, ms or s")
+	}
+	if t < btrdb.MinimumTime/mul || t >= btrdb.MaximumTime/mul {
+		return 0, bte.Err(bte.InvalidTimeRange, "time out of range")
+	}
+	return t * mul, nil
+}
+
+//Converts a start and end time in the given unit to nanoseconds and checks
+//that they form a valid range
+func parseTimeRange(start, end int64, unit string) (int64, int64, bte.BTE) {
+	mul, ok := unitMultiplier(unit)
+	if !ok {
+		return 0, 0, bte.Err(bte.WrongArgs, "unit of time must be one of ns, us, ms or s")
+	}
+	if start < btrdb.MinimumTime/mul || start >= btrdb.MaximumTime/mul ||
+		end <= btrdb.MinimumTime/mul || end > btrdb.MaximumTime/mul {
+		return 0, 0, bte.Err(bte.InvalidTimeRange, "time out of range")
+	}
+	start *= mul
+	end *= mul
+	if start >= end {
+		return 0, 0, bte.Err(bte.InvalidTimeRange, "start time must be before end time")
+	}
+	return start, end, nil
+}
+
+//Reads the generation to query from the ver parameter, or resolves the asof
+//parameter (an RFC 3339 time) to the generation current at that time. With
+//neither the latest generation is used
+func parseVersion(q *btrdb.Quasar, id uuid.UUID, form url.Values) (uint64, bte.BTE) {
+	vs := form.Get("ver")
+	as := form.Get("asof")
+	if vs != "" && as != "" {
+		return 0, bte.Err(bte.WrongArgs, "only one of ver and asof may be given")
+	}
+	if as != "" {
+		t, err := time.Parse(time.RFC3339Nano, as)
+		if err != nil {
+			return 0, bte.ErrW(bte.WrongArgs, "malformed asof time", err)
+		}
+		return q.GenerationAsOf(id, t)
+	}
+	if vs == "" || vs == "0" {
+		return btrdb.LatestGeneration, nil
+	}
+	ver, err := strconv.ParseUint(vs, 10, 64)
+	if err != nil {
+		return 0, bte.Err(bte.WrongArgs, "malformed version")
+	}
+	return ver, nil
+}
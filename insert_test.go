@@ -0,0 +1,61 @@
+package btrdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bstore"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+//Only what an insert checks before it takes the tree lock
+type insertTestConfig struct {
+	configprovider.Configuration
+	configprovider.ClusterConfiguration
+}
+
+func (insertTestConfig) ClusterEnabled() bool              { return true }
+func (insertTestConfig) StorageCephReadOnly() bool         { return false }
+func (insertTestConfig) WeHoldWriteLockFor(id []byte) bool { return true }
+func (insertTestConfig) InsertClampTimes() bool            { return false }
+
+func TestInsertCancelledWaitingForLock(t *testing.T) {
+	id := uuid.NewRandom()
+	q := &Quasar{
+		cfg:       insertTestConfig{},
+		treelocks: make(map[[16]byte]*sync.Mutex),
+		openTrees: make(map[[16]byte]*openTree),
+		exists:    newExistCache(1),
+	}
+	q.exists.add(bstore.UUIDToMapKey(id))
+	_, mtx, err := q.getTree(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bte.BTE)
+	go func() {
+		done <- q.InsertValues(ctx, id, []qtree.Record{{Time: 1, Val: 1}})
+	}()
+	//Give the insert time to block on the lock
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil || err.Code() != bte.ContextError {
+			t.Fatalf("insert gave %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("insert did not return when its context was cancelled")
+	}
+	//The lock is released once the abandoned wait acquires it
+	mtx.Unlock()
+	mtx.Lock()
+	mtx.Unlock()
+}
@@ -18,6 +18,9 @@ package bprovider
 
 import (
 	"errors"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/SoftwareDefinedBuildings/btrdb/bte"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
@@ -30,15 +33,57 @@ var ErrAnnotationTooBig = errors.New("Annotation too big")
 
 const SpecialVersionCreated = 9
 const SpecialVersionFirst = 10
+
+// The default limit on annotation size, it can be changed with
+// StorageMaxAnnotationSize
 const MaxAnnotationSize = 128 * 1024
 
+// A ReadBudget caps how many read handles a single query may hold at once,
+// so one large query cannot starve the others. A nil budget is unlimited
+type ReadBudget chan struct{}
+
+func NewReadBudget(handles int) ReadBudget {
+	if handles <= 0 {
+		return nil
+	}
+	return make(ReadBudget, handles)
+}
+
+// Blocks until the budget has a handle free
+func (b ReadBudget) Acquire() {
+	if b != nil {
+		b <- struct{}{}
+	}
+}
+
+func (b ReadBudget) Release() {
+	if b != nil {
+		<-b
+	}
+}
+
+type sequentialScanKey struct{}
+
+// WithSequentialScan returns a context that hints that reads made with it
+// are a scan through a stream, so the provider may read ahead
+func WithSequentialScan(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sequentialScanKey{}, true)
+}
+
+// True if the context was made by WithSequentialScan
+func IsSequentialScan(ctx context.Context) bool {
+	scan, _ := ctx.Value(sequentialScanKey{}).(bool)
+	return scan
+}
+
 type Segment interface {
 	//Returns the address of the first free word in the segment when it was locked
 	BaseAddress() uint64
 
 	//Unlocks the segment for the StorageProvider to give to other consumers
-	//Implies a flush
-	Unlock()
+	//Implies a flush, and returns an error if the flush failed, in which case
+	//nothing written to the segment may be referenced
+	Unlock() bte.BTE
 
 	//Writes a slice to the segment, returns immediately
 	//Returns nil if op is OK, otherwise ErrNoSpace or ErrInvalidArgument
@@ -57,8 +102,33 @@ type Stream interface {
 	Collection() string
 	//The stream's tags
 	Tags() map[string]string
+	//The stream's annotation and its version, if it was listed with
+	//annotations. Otherwise nil and zero
+	Annotation() ([]byte, uint64)
+}
+
+type CollectionCount struct {
+	//The name of the collection
+	Collection string
+	//The number of streams in the collection. If Exceeded is true this
+	//is the limit that was passed, not the real count
+	Streams int64
+	//True if the collection has more streams than the count limit
+	Exceeded bool
+}
+
+//A range deleted from a stream, and the generation that deleted it
+type Tombstone struct {
+	Generation uint64
+	Start      int64
+	End        int64
 }
 
+//Calls visit with the address of every block reachable from the given version
+//of a stream. The provider cannot decode blocks itself, so the block store
+//supplies this
+type BlockWalker func(uuid []byte, version uint64, visit func(addr uint64)) bte.BTE
+
 type StorageProvider interface {
 
 	//Called at startup of a normal run
@@ -70,15 +140,29 @@ type StorageProvider interface {
 	//function call
 	CreateDatabase(configprovider.Configuration) error
 
+	// Does a cheap round trip to the underlying storage and returns an error
+	// if it cannot be reached
+	Healthy() bte.BTE
+
 	// Lock a segment, or block until a segment can be locked
 	// Returns a Segment struct
 	LockSegment(uuid []byte) Segment
 
-	// Read the blob into the given buffer
-	Read(uuid []byte, address uint64, buffer []byte) []byte
+	// Read the blob into the given buffer. Returns BlockCorrupt if the stored
+	// length of the blob is not plausible
+	Read(uuid []byte, address uint64, buffer []byte) ([]byte, bte.BTE)
+
+	// As Read, but the read handles used are also taken from the budget. If
+	// ctx is done before the blob is read, its context error is returned
+	ReadBudgeted(ctx context.Context, uuid []byte, address uint64, buffer []byte, budget ReadBudget) ([]byte, bte.BTE)
 
-	// Read the given version of superblock into the buffer.
-	ReadSuperBlock(uuid []byte, version uint64, buffer []byte) []byte
+	// Starts reading the data after the given address into the cache, for a
+	// scan that will read it next. It never blocks, and may do nothing
+	Prefetch(uuid []byte, address uint64)
+
+	// Read the given version of superblock into the buffer. Returns
+	// SuperblockCorrupt if the superblock has a checksum that does not match
+	ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, bte.BTE)
 
 	// Writes a superblock of the given version
 	// TODO I think the storage will need to chunk this, because sb logs of gigabytes are possible
@@ -90,6 +174,10 @@ type StorageProvider interface {
 	// than you get from GetStreamVersion because they might succeed
 	SetStreamVersion(uuid []byte, version uint64)
 
+	// Like SetStreamVersion, but only sets the version if it is currently
+	// expected. Returns StreamVersionMismatch otherwise.
+	SetStreamVersionCAS(uuid []byte, expected uint64, new uint64) bte.BTE
+
 	// Gets the info of a stream. Returns 0 if none exists.
 	GetStreamInfo(uuid []byte) (Stream, uint64)
 
@@ -99,21 +187,79 @@ type StorageProvider interface {
 	// Sets the stream annotation
 	SetStreamAnnotation(uuid []byte, aver uint64, content []byte) bte.BTE
 
+	// Appends to the stream annotation, with the same version check as
+	// SetStreamAnnotation
+	AppendStreamAnnotation(uuid []byte, aver uint64, extra []byte) bte.BTE
+
 	// Gets the stream annotation
 	GetStreamAnnotation(uuid []byte) ([]byte, uint64, bte.BTE)
 
+	// Gets just the version of the stream annotation
+	GetStreamAnnotationVersion(uuid []byte) (uint64, bte.BTE)
+
+	// Gets the time the stream was created. Streams created before this was
+	// recorded return the zero time.
+	GetStreamCreationTime(uuid []byte) (time.Time, bte.BTE)
+
 	// CreateStream makes a stream with the given uuid, collection and tags. Returns
 	// an error if the uuid already exists.
 	CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE
 
+	// ValidateStream runs the same validation and collision checks as CreateStream
+	// but writes nothing. An existing stream with identical tags is SameStream.
+	ValidateStream(collection string, tags map[string]string) bte.BTE
+
+	// CheckTagConflicts runs ValidateStream's checks for many tag sets at once,
+	// returning an error or nil for each. Sets are checked as though created
+	// in order, so they may also collide with each other.
+	CheckTagConflicts(collection string, tagSets []map[string]string) ([]bte.BTE, bte.BTE)
+
+	// RetagStream replaces the tags of an existing stream, returning
+	// AmbiguousStream if the new tags collide with another stream.
+	RetagStream(uuid []byte, newTags map[string]string) bte.BTE
+
+	// MoveStream moves an existing stream, with its tags and data, to another
+	// collection, returning AmbiguousStream if its tags collide with a stream
+	// there.
+	MoveStream(uuid []byte, newCollection string) bte.BTE
+
 	// ListCollections returns a list of collections beginning with prefix (which may be "")
 	// and starting from the given string. If number is > 0, only that many results
 	// will be returned. More can be obtained by re-calling ListCollections with
 	// a given startingFrom and number.
 	ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE)
 
+	// ListCollectionsMatching returns up to number collections matching a glob
+	// pattern, continuing after startingFrom. A non-prefix pattern scans every
+	// index partition, so each call examines a bounded number of entries and
+	// may return fewer matches. The string returned is the startingFrom for the
+	// next call, "" once the scan is finished.
+	ListCollectionsMatching(pattern string, startingFrom string, number int64) ([]string, string, bte.BTE)
+
+	// ListCollectionsWithCounts pages through collections exactly like ListCollections
+	// but also returns the number of streams in each collection. Counting stops
+	// at countLimit streams per collection, in which case Exceeded is set.
+	ListCollectionsWithCounts(prefix string, startingFrom string, number int64, countLimit int64) ([]CollectionCount, bte.BTE)
+
 	// ListStreams lists all the streams within a collection. If tags are specified
 	// then streams are only returned if they have that tag, and the value equals
 	// the value passed. If partial is false, zero or one streams will be returned.
-	ListStreams(collection string, partial bool, tags map[string]string) ([]Stream, bte.BTE)
+	// If annotations is true the annotation of every stream is fetched too.
+	ListStreams(collection string, partial bool, tags map[string]string, annotations bool) ([]Stream, bte.BTE)
+
+	// ListTagKeys returns the distinct tag keys used by streams within a
+	// collection, in sorted order.
+	ListTagKeys(collection string) ([]string, bte.BTE)
+
+	// CountStreams returns the number of streams within a collection that
+	// have all of the given tags, without listing them.
+	CountStreams(collection string, tags map[string]string) (int64, bte.BTE)
+
+	// AddTombstone records that [start, end) was deleted from the stream in
+	// the given generation.
+	AddTombstone(uuid []byte, gen uint64, start int64, end int64) bte.BTE
+
+	// ListTombstones returns the deletions recorded in generations after
+	// startgen up to and including endgen, in generation order.
+	ListTombstones(uuid []byte, startgen uint64, endgen uint64) ([]Tombstone, bte.BTE)
 }
@@ -9,6 +9,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/SoftwareDefinedBuildings/btrdb/bte"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/cephprovider"
@@ -44,6 +46,9 @@ type BlockStore struct {
 	cfg   configprovider.Configuration
 	ccfg  configprovider.ClusterConfiguration
 
+	//If true this is a read replica, which never holds write locks
+	readOnly bool
+
 	sbcache     map[[16]byte]*sbcachet
 	sbmu        sync.Mutex
 	sbcachehit  uint64
@@ -102,6 +107,7 @@ func NewBlockStore(cfg configprovider.Configuration) (*BlockStore, error) {
 	bs.cfg = cfg
 	bs.laschan = make(chan *LASMetric, 1000)
 	bs.ccfg, _ = cfg.(configprovider.ClusterConfiguration)
+	bs.readOnly = cfg.StorageCephReadOnly()
 	bs._wlocks = make(map[[16]byte]*sync.Mutex)
 	bs.sbcache = make(map[[16]byte]*sbcachet, SUPERBLOCK_CACHE_SIZE)
 	bs.alloc = make(chan uint64, 256)
@@ -122,6 +128,9 @@ func NewBlockStore(cfg configprovider.Configuration) (*BlockStore, error) {
 		bs.store = new(fileprovider.FileStorageProvider)
 	}
 	bs.store.Initialize(cfg)
+	if cp, ok := bs.store.(*cephprovider.CephStorageProvider); ok {
+		cp.SetBlockWalker(bs.walkBlocks)
+	}
 	cachesz := cfg.BlockCache()
 	bs.initCache(uint64(cachesz))
 	return &bs, nil
@@ -203,6 +212,9 @@ func (bs *BlockStore) StorageProvider() bprovider.StorageProvider {
 func (bs *BlockStore) ObtainGeneration(id uuid.UUID) (*Generation, bte.BTE) {
 	//The first thing we do is obtain a write lock on the UUID, as a generation
 	//represents a lock
+	if bs.readOnly {
+		return nil, bte.Err(bte.ReadOnly, "storage is read only")
+	}
 	if bs.ccfg != nil && !bs.ccfg.WeHoldWriteLockFor(id) {
 		return nil, bte.ErrF(bte.WrongEndpoint, "We do not have the write lock for %s", id.String())
 	}
@@ -224,7 +236,12 @@ func (bs *BlockStore) ObtainGeneration(id uuid.UUID) (*Generation, bte.BTE) {
 		vblocks: make([]*Vectorblock, 0, 8192),
 	}
 	//We need a generation. Lets check the cache
-	gen.Cur_SB = bs.LoadSuperblock(id, LatestGeneration)
+	var err bte.BTE
+	gen.Cur_SB, err = bs.LoadSuperblock(id, LatestGeneration)
+	if err != nil {
+		mtx.Unlock()
+		return nil, err
+	}
 	if gen.Cur_SB == nil {
 		// Stream doesn't exist, error
 		return nil, bte.Err(bte.NoSuchStream, "Stream does not exist")
@@ -237,13 +254,18 @@ func (bs *BlockStore) ObtainGeneration(id uuid.UUID) (*Generation, bte.BTE) {
 	return gen, nil
 }
 
-//The returned address map is primarily for unit testing
+//The returned address map is primarily for unit testing. If the blocks
+//could not be written the generation is aborted and the error returned
 func (gen *Generation) Commit() (map[uint64]uint64, error) {
 	if gen.flushed {
 		return nil, errors.New("Already Flushed")
 	}
 
-	address_map := LinkAndStore([]byte(*gen.Uuid()), gen.blockstore, gen.blockstore.store, gen.vblocks, gen.cblocks)
+	address_map, err := LinkAndStore([]byte(*gen.Uuid()), gen.blockstore, gen.blockstore.store, gen.vblocks, gen.cblocks)
+	if err != nil {
+		gen.Abort()
+		return nil, err
+	}
 	rootaddr, ok := address_map[gen.New_SB.root]
 	if !ok {
 		lg.Panic("Could not obtain root address")
@@ -273,6 +295,20 @@ func (gen *Generation) Commit() (map[uint64]uint64, error) {
 	return address_map, nil
 }
 
+//Releases the generation without writing anything, for when it cannot be
+//committed
+func (gen *Generation) Abort() {
+	if gen.flushed {
+		return
+	}
+	gen.vblocks = nil
+	gen.cblocks = nil
+	gen.flushed = true
+	gen.blockstore.glock.RLock()
+	gen.blockstore._wlocks[UUIDToMapKey(*gen.Uuid())].Unlock()
+	gen.blockstore.glock.RUnlock()
+}
+
 func (bs *BlockStore) allocateBlock() uint64 {
 	relocation_address := <-bs.alloc
 	return relocation_address
@@ -302,14 +338,28 @@ func (bs *BlockStore) FreeVectorblock(vb **Vectorblock) {
 	*vb = nil
 }
 
-func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) Datablock {
+func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) (Datablock, bte.BTE) {
+	return bs.ReadDatablockBudgeted(context.Background(), uuid, addr, impl_Generation, impl_Pointwidth, impl_StartTime, nil)
+}
+
+//As ReadDatablock, but a cache miss uses read handles from the budget, and
+//gives up with a context error if ctx is done first. If ctx is a sequential
+//scan, a cache miss also has the provider read ahead
+func (bs *BlockStore) ReadDatablockBudgeted(ctx context.Context, uuid uuid.UUID, addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64, budget bprovider.ReadBudget) (Datablock, bte.BTE) {
 	//Try hit the cache first
 	db := bs.cacheGet(addr)
 	if db != nil {
-		return db
+		return db, nil
 	}
 	syncbuf := block_buf_pool.Get().([]byte)
-	trimbuf := bs.store.Read([]byte(uuid), addr, syncbuf)
+	trimbuf, err := bs.store.ReadBudgeted(ctx, []byte(uuid), addr, syncbuf, budget)
+	if err != nil {
+		block_buf_pool.Put(syncbuf)
+		return nil, err
+	}
+	if bprovider.IsSequentialScan(ctx) {
+		bs.store.Prefetch([]byte(uuid), addr)
+	}
 	switch DatablockGetBufferType(trimbuf) {
 	case Core:
 		rv := &Coreblock{}
@@ -320,7 +370,7 @@ func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation
 		rv.PointWidth = impl_Pointwidth
 		rv.StartTime = impl_StartTime
 		bs.cachePut(addr, rv)
-		return rv
+		return rv, nil
 	case Vector:
 		rv := &Vectorblock{}
 		rv.Deserialize(trimbuf)
@@ -330,43 +380,90 @@ func (bs *BlockStore) ReadDatablock(uuid uuid.UUID, addr uint64, impl_Generation
 		rv.PointWidth = impl_Pointwidth
 		rv.StartTime = impl_StartTime
 		bs.cachePut(addr, rv)
-		return rv
+		return rv, nil
 	}
-	lg.Panic("Strange datablock type")
-	return nil
+	block_buf_pool.Put(syncbuf)
+	return nil, bte.ErrF(bte.BlockCorrupt, "block at 0x%016x has an unknown type", addr)
 }
 
-func (bs *BlockStore) LoadSuperblock(id uuid.UUID, generation uint64) *Superblock {
+//Returns nil if the stream or generation does not exist, or SuperblockCorrupt
+//if the superblock fails its checksum
+func (bs *BlockStore) LoadSuperblock(id uuid.UUID, generation uint64) (*Superblock, bte.BTE) {
 	if generation == LatestGeneration {
 		cachedSB := bs.LoadSuperblockFromCache(id)
 		if cachedSB != nil {
 			atomic.AddUint64(&bs.sbcachehit, 1)
-			return cachedSB
+			return cachedSB, nil
 		}
 	}
 	atomic.AddUint64(&bs.sbcachemiss, 1)
 	latestGen := bs.store.GetStreamVersion(id)
 	if latestGen < bprovider.SpecialVersionCreated {
-		return nil
+		return nil, nil
 	}
 	if latestGen == bprovider.SpecialVersionCreated {
-		return NewSuperblock(id)
+		return NewSuperblock(id), nil
 	}
 	//Ok it exists and is not new
 	if generation == LatestGeneration {
 		generation = latestGen
 	}
 	if generation > latestGen {
-		return nil
+		return nil, nil
 	}
 
 	buff := make([]byte, 16)
-	sbarr := bs.store.ReadSuperBlock(id, generation, buff)
+	sbarr, err := bs.store.ReadSuperBlock(id, generation, buff)
+	if err != nil {
+		lg.Errorf("could not load superblock %d for stream %s: %v", generation, id.String(), err)
+		return nil, err
+	}
 	if sbarr == nil {
 		lg.Panicf("Your database is corrupt, superblock %d for stream %s should exist (but doesn't)", generation, id.String())
 	}
 	sb := DeserializeSuperblock(id, generation, sbarr)
-	return sb
+	return sb, nil
+}
+
+//Visits every block reachable from the given version of a stream. This reads
+//directly from the storage provider so that it does not churn the block cache
+func (bs *BlockStore) walkBlocks(id []byte, version uint64, visit func(addr uint64)) bte.BTE {
+	sb, err := bs.LoadSuperblock(uuid.UUID(id), version)
+	if err != nil {
+		return err
+	}
+	if sb == nil {
+		return bte.Err(bte.NoSuchStream, "no such stream or version")
+	}
+	if sb.Root() == 0 {
+		return nil
+	}
+	var walk func(addr uint64) bte.BTE
+	walk = func(addr uint64) bte.BTE {
+		visit(addr)
+		syncbuf := block_buf_pool.Get().([]byte)
+		trimbuf, err := bs.store.Read(id, addr, syncbuf)
+		if err != nil {
+			block_buf_pool.Put(syncbuf)
+			return err
+		}
+		if DatablockGetBufferType(trimbuf) != Core {
+			block_buf_pool.Put(syncbuf)
+			return nil
+		}
+		cb := &Coreblock{}
+		cb.Deserialize(trimbuf)
+		block_buf_pool.Put(syncbuf)
+		for _, child := range cb.Addr {
+			if child != 0 {
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return walk(sb.Root())
 }
 
 func CreateDatabase(cfg configprovider.Configuration) {
@@ -24,6 +24,11 @@ func (s *Superblock) Root() uint64 {
 	return s.root
 }
 
+//The wall clock time in nanoseconds at which the generation was created
+func (s *Superblock) Walltime() int64 {
+	return s.walltime
+}
+
 func (s *Superblock) Uuid() uuid.UUID {
 	return s.uuid
 }
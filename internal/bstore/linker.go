@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
 )
 
@@ -48,7 +49,7 @@ func (bs *BlockStore) LASMetrics(m *LASMetric) {
 	}
 
 }
-func LinkAndStore(uuid []byte, bs *BlockStore, bp bprovider.StorageProvider, vblocks []*Vectorblock, cblocks []*Coreblock) map[uint64]uint64 {
+func LinkAndStore(uuid []byte, bs *BlockStore, bp bprovider.StorageProvider, vblocks []*Vectorblock, cblocks []*Coreblock) (map[uint64]uint64, bte.BTE) {
 	ta := time.Now()
 	loaned_sercbufs := make([][]byte, len(cblocks))
 	loaned_servbufs := make([][]byte, len(vblocks))
@@ -117,7 +118,7 @@ func LinkAndStore(uuid []byte, bs *BlockStore, bp bprovider.StorageProvider, vbl
 		ptr = nptr
 	}
 	te := time.Now()
-	seg.Unlock()
+	uerr := seg.Unlock()
 	//Return buffers to pool
 	for _, v := range loaned_sercbufs {
 		ser_buf_pool.Put(v)
@@ -134,5 +135,8 @@ func LinkAndStore(uuid []byte, bs *BlockStore, bp bprovider.StorageProvider, vbl
 		unlock: int(tf.Sub(te) / time.Microsecond),
 		numc:   len(cblocks),
 		numv:   len(vblocks)})
-	return backpatch
+	if uerr != nil {
+		return nil, uerr
+	}
+	return backpatch, nil
 }
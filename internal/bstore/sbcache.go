@@ -16,6 +16,11 @@ type sbcachet struct {
 }
 
 func (bs *BlockStore) LoadSuperblockFromCache(uu uuid.UUID) *Superblock {
+	if bs.readOnly {
+		//Another node writes the stream, so the superblock is always
+		//loaded from storage
+		return nil
+	}
 	if bs.ccfg != nil && !bs.ccfg.WeHoldWriteLockFor(uu) {
 		//We are in cluster mode and don't hold the write lock for this uuid
 		//so load the superblock from ceph
@@ -38,6 +43,9 @@ func (bs *BlockStore) LoadSuperblockFromCache(uu uuid.UUID) *Superblock {
 func (bs *BlockStore) PutSuperblockInCache(s *Superblock) {
 	// Don't cache superblocks we don't hold the write lock for, we can't
 	// trust them
+	if bs.readOnly {
+		return
+	}
 	if bs.ccfg != nil && !bs.ccfg.WeHoldWriteLockFor(s.uuid) {
 		//We are in cluster mode and don't hold the write lock for this uuid
 		//so load the superblock from ceph
@@ -0,0 +1,56 @@
+// +build ignore
+
+package cephprovider
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
+)
+
+//These need a ceph cluster with the pool below created by btrdbd -makedb
+func testConfig() *configprovider.FileConfig {
+	rv := &configprovider.FileConfig{}
+	rv.Storage.CephConf = "/etc/ceph/ceph.conf"
+	rv.Storage.CephDataPool = "btrdb-test"
+	rv.Storage.CephHotPool = "btrdb-test"
+	//Short enough that some allocations will need to renew
+	rv.Cache.RadosAllocLease = 20
+	return rv
+}
+
+//Two providers (as on two nodes) allocating concurrently must never be
+//handed the same address range
+func TestObtainBaseAddressUnique(t *testing.T) {
+	cfg := testConfig()
+	sps := []*CephStorageProvider{new(CephStorageProvider), new(CephStorageProvider)}
+	for _, sp := range sps {
+		sp.Initialize(cfg)
+	}
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for _, sp := range sps {
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func(sp *CephStorageProvider) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					addr, err := sp.obtainBaseAddress()
+					if err != nil {
+						t.Errorf("could not allocate: %v", err)
+						return
+					}
+					mu.Lock()
+					if seen[addr] {
+						t.Errorf("address 0x%016x handed out twice", addr)
+					}
+					seen[addr] = true
+					mu.Unlock()
+				}
+			}(sp)
+		}
+	}
+	wg.Wait()
+}
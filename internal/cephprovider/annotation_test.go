@@ -0,0 +1,40 @@
+package cephprovider
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/pborman/uuid"
+)
+
+//The size limit is checked before RADOS is touched, so this does not need a
+//cluster
+func TestAnnotationLimitOnUpdate(t *testing.T) {
+	sp := &CephStorageProvider{maxAnnotation: 16}
+	id := uuid.NewRandom()
+	err := sp.SetStreamAnnotation(id, 0, make([]byte, 17))
+	if err == nil || err.Code() != bte.AnnotationTooBig {
+		t.Fatalf("expected AnnotationTooBig on set, got %v", err)
+	}
+	err = sp.AppendStreamAnnotation(id, 0, make([]byte, 17))
+	if err == nil || err.Code() != bte.AnnotationTooBig {
+		t.Fatalf("expected AnnotationTooBig on append, got %v", err)
+	}
+}
+
+func TestAnnotationAppendWrites(t *testing.T) {
+	obj := append([]byte{3, 0, 0, 0, 0, 0, 0, 0}, "abc"...)
+	writes := annotationAppendWrites(uint64(len(obj)), 4, []byte("de"))
+	//A retried operation applies the same writes again
+	for i := 0; i < 2; i++ {
+		for _, w := range writes {
+			if end := int(w.offset) + len(w.data); end > len(obj) {
+				obj = append(obj, make([]byte, end-len(obj))...)
+			}
+			copy(obj[w.offset:], w.data)
+		}
+	}
+	if string(obj) != "\x04\x00\x00\x00\x00\x00\x00\x00abcde" {
+		t.Fatalf("unexpected annotation object %q", obj)
+	}
+}
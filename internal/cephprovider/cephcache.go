@@ -1,16 +1,23 @@
 package cephprovider
 
 import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	//"runtime"
 )
 
-//We are caching 1MB blocks for read, so the address should have the bottom 20 bits clear
-const R_ADDRMASK = ^((uint64(1) << 20) - 1)
-const R_OFFSETMASK = (uint64(1) << 20) - 1
+//The read cache never shrinks below this many chunks, or below
+//minCacheChunks for the number of read handles if that is more
+const MIN_RCACHE_CHUNKS = 40
+
+//How often free memory is checked when shrinking under pressure
+const MEMORY_POLL_INTERVAL = 5 * time.Second
 
-var actualread int64
 var readused int64
 
 type CephCache struct {
@@ -21,9 +28,21 @@ type CephCache struct {
 	cachenew  *CacheItem
 	cachemtx  sync.Mutex
 	cachelen  uint64
-	cachemax  uint64
+	cachemax  uint64 //Written under cachemtx, read atomically without it
 	cacheinv  uint64
 	pool      *sync.Pool
+
+	//The size the cache was last resized to, cachemax may be below this
+	//while memory is short
+	cachetarget uint64
+	//The cache never shrinks below this, see minCacheChunks
+	minchunks uint64
+
+	//The size of the chunks we read and cache. Chunks are aligned to their
+	//size, so addrmask clears the offset within a chunk
+	chunksize  uint64
+	addrmask   uint64
+	offsetmask uint64
 }
 type CacheItem struct {
 	val   []byte
@@ -35,12 +54,33 @@ type CacheItem struct {
 // debugging, must remove, mad memory leak
 var excludemap map[uint64]bool
 
-func (cc *CephCache) initCache(size uint64) {
+//Returns the fewest chunks the cache can hold without thrashing. Every read
+//handle can have a read of an object spanning two chunks in flight, and
+//those chunks should stay cached until it finishes
+func minCacheChunks(handles int) uint64 {
+	rv := uint64(2 * handles)
+	if rv < MIN_RCACHE_CHUNKS {
+		rv = MIN_RCACHE_CHUNKS
+	}
+	return rv
+}
+
+//Size is the number of chunks to cache, chunksize must be a power of two.
+//The cache is made large enough for the given number of read handles
+func (cc *CephCache) initCache(size uint64, chunksize uint64, handles int) {
+	cc.minchunks = minCacheChunks(handles)
+	if size < cc.minchunks {
+		size = cc.minchunks
+	}
 	cc.cachemax = size
+	cc.cachetarget = size
 	cc.cachemap = make(map[uint64]*CacheItem, size)
+	cc.chunksize = chunksize
+	cc.offsetmask = chunksize - 1
+	cc.addrmask = ^cc.offsetmask
 	cc.pool = &sync.Pool{
 		New: func() interface{} {
-			return make([]byte, R_CHUNKSIZE)
+			return make([]byte, chunksize)
 		},
 	}
 	excludemap = make(map[uint64]bool)
@@ -83,7 +123,7 @@ func (cc *CephCache) cachePromote(i *CacheItem) {
 }
 
 func (cc *CephCache) cachePut(addr uint64, item []byte) {
-	if cc.cachemax == 0 {
+	if atomic.LoadUint64(&cc.cachemax) == 0 {
 		return
 	}
 	cc.cachemtx.Lock()
@@ -105,13 +145,13 @@ func (cc *CephCache) cachePut(addr uint64, item []byte) {
 
 func (cc *CephCache) getBlank() []byte {
 	rv := cc.pool.Get().([]byte)
-	rv = rv[0:R_CHUNKSIZE]
+	rv = rv[0:cc.chunksize]
 
 	return rv
 }
 
 func (cc *CephCache) cacheGet(addr uint64) []byte {
-	if cc.cachemax == 0 {
+	if atomic.LoadUint64(&cc.cachemax) == 0 {
 		cc.cachemiss++
 		return nil
 	}
@@ -130,9 +170,17 @@ func (cc *CephCache) cacheGet(addr uint64) []byte {
 	}
 }
 
+//True if the chunk is cached. Unlike cacheGet it does not count as a use
+func (cc *CephCache) cacheHas(addr uint64) bool {
+	cc.cachemtx.Lock()
+	_, ok := cc.cachemap[addr]
+	cc.cachemtx.Unlock()
+	return ok
+}
+
 //This is rare and only happens if the block cache is too small
 func (cc *CephCache) cacheInvalidate(addr uint64) {
-	if cc.cachemax == 0 {
+	if atomic.LoadUint64(&cc.cachemax) == 0 {
 		return
 	}
 	cc.cachemtx.Lock()
@@ -171,3 +219,78 @@ func (cc *CephCache) cacheCheckCap() {
 		cc.cachelen--
 	}
 }
+
+//Sets the number of chunks cached, evicting the oldest down to it
+func (cc *CephCache) setCap(chunks uint64) {
+	if chunks < cc.minchunks {
+		chunks = cc.minchunks
+	}
+	cc.cachemtx.Lock()
+	atomic.StoreUint64(&cc.cachemax, chunks)
+	cc.cacheCheckCap()
+	cc.cachemtx.Unlock()
+}
+
+//Resize changes the size of the cache, evicting the least recently used
+//chunks if it shrinks. Unlike radosreadcache the size really is in MB, it
+//is divided by the chunk size. The cache keeps at least minCacheChunks
+func (cc *CephCache) Resize(newSizeMB uint64) {
+	chunks := (newSizeMB << 20) / cc.chunksize
+	if chunks < cc.minchunks {
+		logger.Warningf("read cache of %d MB is too small for %d read handles, using %d chunks", newSizeMB, NUM_RHANDLES, cc.minchunks)
+		chunks = cc.minchunks
+	}
+	atomic.StoreUint64(&cc.cachetarget, chunks)
+	cc.setCap(chunks)
+	logger.Warningf("read cache resized to %d chunks", chunks)
+}
+
+//Returns the MemAvailable of /proc/meminfo in bytes
+func availableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			return kb * 1024, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, os.ErrNotExist
+}
+
+//Halves the cache while the system has less than minFree bytes available,
+//and doubles it back towards its target once there is twice that
+func (cc *CephCache) watchMemory(minFree uint64) {
+	for {
+		time.Sleep(MEMORY_POLL_INTERVAL)
+		avail, err := availableMemory()
+		if err != nil {
+			logger.Errorf("could not read available memory, not watching memory pressure: %v", err)
+			return
+		}
+		cur := atomic.LoadUint64(&cc.cachemax)
+		target := atomic.LoadUint64(&cc.cachetarget)
+		if avail < minFree && cur > cc.minchunks {
+			logger.Warningf("%d MB of memory available, shrinking read cache to %d chunks", avail>>20, cur/2)
+			cc.setCap(cur / 2)
+		} else if avail > 2*minFree && cur < target {
+			next := cur * 2
+			if next > target {
+				next = target
+			}
+			logger.Infof("memory pressure eased, growing read cache to %d chunks", next)
+			cc.setCap(next)
+		}
+	}
+}
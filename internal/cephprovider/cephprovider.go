@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,8 +17,8 @@ import (
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/configprovider"
 	"github.com/ceph/go-ceph/rados"
-	"github.com/huichen/murmur"
 	logging "github.com/op/go-logging"
+	"golang.org/x/net/context"
 )
 
 var logger *logging.Logger
@@ -31,27 +33,60 @@ const NUM_WHANDLES = 16
 //We know we won't get any addresses here, because this is the relocation base as well
 const METADATA_BASE = 0xFF00000000000000
 
-//4096 blocks per addr lock
+//4096 blocks per addr lock. These are the defaults, they can be lowered with
+//RadosAllocRegionSize and RadosAllocLockSize. The region size is the most
+//address space a segment takes, and ADDR_OBJ_SIZE is also the span of a
+//RADOS object, so it is the most a region can be
 const ADDR_LOCK_SIZE = 0x1000000000
 const ADDR_OBJ_SIZE = 0x0001000000
 
-//Just over the DBSIZE
+//Where the allocator starts in a new database, unless
+//StorageCephInitialAddress is set
+const INITIAL_ADDR = 0x1000000
+
+//Just over the DBSIZE. This is the default, it can be raised with
+//RadosMaxObjectSize
 const MAX_EXPECTED_OBJECT_SIZE = 20485
 
+//Objects are prefixed with a two byte length
+const MAX_OBJECT_SIZE_LIMIT = 0xFFFF
+
 //The number of RADOS blocks to cache (up to 16MB each, probably only 1.6MB each)
 const RADOS_CACHE_SIZE = NUM_RHANDLES * 2
 
 const OFFSET_MASK = 0xFFFFFF
+
+//The default size of the chunks read from RADOS and cached, it can be
+//changed with RadosReadChunkSize
 const R_CHUNKSIZE = 1 << 20
 
 //This is how many uuid/address pairs we will keep to facilitate appending to segments
-//instead of creating new ones.
-const WORTH_CACHING = OFFSET_MASK - MAX_EXPECTED_OBJECT_SIZE
+//instead of creating new ones. These are the defaults, they can be changed with
+//RadosSegmentCacheMinFree and RadosSegmentCacheSize. The default min free is
+//the max object size
 const SEGCACHE_SIZE = 1024
 
+//Segment cache entries older than this are not appended to, as the stream
+//may have been deleted or its objects moved since. It can be changed with
+//RadosSegmentCacheTTL
+const SEGCACHE_TTL = time.Hour
+
 // 1MB for write cache, I doubt we will ever hit this tbh
+// This is the default, it can be changed with RadosSegmentWriteCache
 const WCACHE_SIZE = 1 << 20
 
+// The default lease on the allocator lock, it can be changed with RadosAllocLease
+const ALLOC_LEASE = 5 * time.Second
+
+// How many leases obtainBaseAddress waits for the allocator lock before it
+// gives up. A node that died holding the lock loses it after one lease
+const ALLOC_LOCK_WAIT = 6
+
+// The default number of retries of transient RADOS errors and the delay before
+// the first, they can be changed with RadosRetries and RadosRetryDelay
+const RETRY_COUNT = 2
+const RETRY_DELAY = 50 * time.Millisecond
+
 // Makes 16MB for 16B sblocks
 const SBLOCK_CHUNK_SHIFT = 20
 const SBLOCK_CHUNK_MASK = 0xFFFFF
@@ -77,6 +112,25 @@ type CephSegment struct {
 	wcache      []byte
 	wcache_base uint64
 	hi          int //write handle index
+	//Flushed regions of earlier objects not yet written, see queueFlush
+	pending []pendingWrite
+	//If true the segment is in a region shared with other small streams
+	packed bool
+	pool   string
+	//Bytes written through the segment, for the pack threshold
+	written uint64
+	//Packed objects the segment has added its stream's reference to
+	packrefs map[string]bool
+}
+
+type segcacheEntry struct {
+	//The next free address in the segment's object
+	addr uint64
+	//The write handle that last wrote to it, reusing it lets the RADOS
+	//client batch writes to the same object
+	hi int
+	//When the entry was cached, for the TTL
+	when time.Time
 }
 
 type chunkreqindex struct {
@@ -85,30 +139,108 @@ type chunkreqindex struct {
 }
 
 type CephStorageProvider struct {
+	//Accessed atomically, kept first for 64 bit alignment
+	bytesWritten int64
+	bytesRead    int64
+
 	rh           []*rados.IOContext
 	conn         *rados.Conn
 	rhidx        chan int
 	rhidx_ret    chan int
 	rh_avail     []bool
 	wh           []*rados.IOContext
-	whidx        chan int
-	whidx_ret    chan int
-	wh_avail     []bool
 	ptr          uint64
 	alloc        chan uint64
-	segaddrcache map[[16]byte]uint64
+	segaddrcache map[[16]byte]segcacheEntry
 	segcachelock sync.Mutex
 
 	chunklock sync.Mutex
-	chunkgate map[chunkreqindex][]chan []byte
+	chunkgate map[chunkreqindex][]chan chunkResult
+	//Limits the chunks being fetched at once
+	fetchsem chan struct{}
+	//Chunks read ahead by Prefetch, zero disables it
+	readAhead int
 
 	rcache *CephCache
 
 	dataPool string
 	hotPool  string
 
+	//The RADOS namespace of every object, in every pool
+	namespace string
+	//How collections are hashed to index partitions, see loadIndexFormat
+	indexSeeded bool
+	indexSeed   uint32
+
+	//The data pools of new streams, by collection prefix
+	routes []poolRoute
+	//Read and write contexts for every pool, indexed like rh and wh
+	prh map[string][]*rados.IOContext
+	pwh map[string][]*rados.IOContext
+	//The free write handles of every pool
+	pwhq map[string]*handleQueue
+	//Guards the pool maps, which layoutOf may add to
+	poolMu sync.RWMutex
+	//True once the write handles of every pool are being provided
+	providingWH bool
+	//The pools of streams that are known to exist
+	placement   map[[16]byte]streamLayout
+	placementMu sync.Mutex
+
 	cfg configprovider.Configuration
 
+	//The largest object that may be written or read
+	maxObjectSize int
+	//The address space handed to a segment, and taken from the allocator at
+	//a time
+	regionSize uint64
+	lockSize   uint64
+	//The capacity of each segment's write cache
+	wcacheSize int
+	//The codec data objects are compressed with, if any, and the codecs of
+	//pools that differ from it
+	dataCodec  byte
+	poolCodecs map[string]byte
+	//Serialize appends to compressed objects, see appendFrames
+	framelocks     [FRAME_LOCKS]sync.Mutex
+	frameIndexSeen map[string]bool
+	frameIndexMu   sync.Mutex
+	//Segments whose next address is below this are worth caching
+	segcacheWorth uint64
+	segcacheSize  int
+	//If true a full segcache evicts one entry rather than being dropped
+	segcacheEvictOne bool
+	segcacheTTL      time.Duration
+
+	//The lease on the allocator lock
+	allocLease time.Duration
+
+	//Transient RADOS errors are retried this many times
+	retryCount int
+	retryDelay time.Duration
+
+	//The largest annotation a stream may have
+	maxAnnotation int
+
+	//If true flushed writes are read back and checked
+	verifyWrites bool
+
+	//If true RADOS panics in public methods are returned as errors
+	recoverPanics bool
+
+	//If true this is a read replica, see StorageCephReadOnly
+	readOnly bool
+
+	//Streams that have written less than this are packed, zero disables it
+	packThreshold uint64
+	packWritten   map[[16]byte]uint64
+	packMu        sync.Mutex
+	//Where the packed segment of each bucket of a pool continues from
+	packcache map[packKey]segcacheEntry
+
+	//Used by ReclaimUnreferenced to mark live objects
+	walker bprovider.BlockWalker
+
 	annotationMu sync.Mutex
 }
 
@@ -118,57 +250,173 @@ func (seg *CephSegment) BaseAddress() uint64 {
 }
 
 //Unlocks the segment for the StorageProvider to give to other consumers
-//Implies a flush
-func (seg *CephSegment) Unlock() {
-	seg.flushWrite()
-	seg.sp.whidx_ret <- seg.hi
+//Implies a flush. If the flush fails the error is returned and the segment
+//is not kept for reuse
+func (seg *CephSegment) Unlock() bte.BTE {
+	err := seg.flushWrite()
+	seg.sp.writeHandles(seg.pool).ret <- seg.hi
 	seg.warrs = nil
-	if (seg.naddr & OFFSET_MASK) < WORTH_CACHING {
+	if err != nil {
+		logger.Errorf("segment flush of %x failed: %v", seg.uid, err)
+		return err
+	}
+	seg.sp.recordWritten(seg.uid, seg.written)
+	if (seg.naddr & (seg.sp.regionSize - 1)) < seg.sp.segcacheWorth {
 		seg.sp.segcachelock.Lock()
-		seg.sp.pruneSegCache()
-		seg.sp.segaddrcache[seg.uid] = seg.naddr
+		seg.sp.cacheSegment(seg, segcacheEntry{addr: seg.naddr, hi: seg.hi, when: time.Now()})
 		seg.sp.segcachelock.Unlock()
 	}
+	return nil
+}
+
+//A region of the write cache waiting to be written
+type pendingWrite struct {
+	address uint64
+	data    []byte
+}
+
+//Writes the write cache, along with any queued regions. The regions of each
+//object are written in one RADOS operation. Returns an error if write
+//verification is enabled and fails, or if a packed object reference cannot
+//be added
+func (seg *CephSegment) flushWrite() bte.BTE {
+	seg.queueFlush()
+	pending := seg.pending
+	seg.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := seg.addPackRefs(pending); err != nil {
+		return err
+	}
+	var verr bte.BTE
+	for _, regions := range groupByObject(seg.uid[:], pending) {
+		if err := seg.writeObject(regions); err != nil && verr == nil {
+			verr = err
+		}
+	}
+	return verr
+}
 
+//Splits pending writes into runs for the same object, keeping their order
+func groupByObject(uuid []byte, pending []pendingWrite) [][]pendingWrite {
+	rv := [][]pendingWrite{}
+	idx := make(map[string]int)
+	for _, pw := range pending {
+		oid := dataOid(uuid, pw.address)
+		i, ok := idx[oid]
+		if !ok {
+			i = len(rv)
+			idx[oid] = i
+			rv = append(rv, nil)
+		}
+		rv[i] = append(rv[i], pw)
+	}
+	return rv
 }
 
-func (seg *CephSegment) flushWrite() {
+//Moves the write cache to the pending writes without writing it. When a
+//segment moves on to a new object the region of the old one is queued, and
+//written alongside the next flush
+func (seg *CephSegment) queueFlush() {
 	if len(seg.wcache) == 0 {
 		return
 	}
-	address := seg.wcache_base
-	aa := address >> 24
-	oid := fmt.Sprintf("%032x%010x", seg.uid, aa)
-	offset := address & 0xFFFFFF
-	seg.h.Write(oid, seg.wcache, offset)
-
-	for i := 0; i < len(seg.wcache); i += R_CHUNKSIZE {
-		seg.sp.rcache.cacheInvalidate((uint64(i) + seg.wcache_base) & R_ADDRMASK)
-	}
+	seg.pending = append(seg.pending, pendingWrite{address: seg.wcache_base, data: seg.wcache})
 	//The C code does not finish immediately, so we need to keep a reference to the old
 	//wcache array until the segment is unlocked
 	seg.warrs = append(seg.warrs, seg.wcache)
-	seg.wcache = make([]byte, 0, WCACHE_SIZE)
+	seg.wcache = make([]byte, 0, seg.sp.wcacheSize)
 	seg.wcache_base = seg.naddr
+}
+
+//Writes regions of one object in a single operation
+func (seg *CephSegment) writeObject(regions []pendingWrite) bte.BTE {
+	oid := dataOid(seg.uid[:], regions[0].address)
+	var err bte.BTE
+	var verr bte.BTE
+	if codec := seg.sp.codecFor(seg.pool); codec != CODEC_NONE {
+		frames := make([][]byte, len(regions))
+		locs := make([]frameLoc, len(regions))
+		for i, pw := range regions {
+			offset := pw.address & 0xFFFFFF
+			frames[i] = encodeFrame(codec, offset, pw.data)
+			locs[i] = frameLoc{foff: offset, rawlen: len(pw.data)}
+		}
+		err = seg.appendFrames(compressedOid(oid), frames, locs)
+		for i := 0; err == nil && verr == nil && seg.sp.verifyWrites && i < len(frames); i++ {
+			verr = seg.verifyRegion(compressedOid(oid), locs[i].pos, frames[i])
+		}
+	} else {
+		err = seg.sp.retry("write", func() error {
+			op := rados.CreateWriteOp()
+			defer op.Release()
+			for _, pw := range regions {
+				op.Write(pw.data, pw.address&0xFFFFFF)
+			}
+			return op.Operate(seg.h, oid, rados.OperationNoFlag)
+		})
+		for i := 0; err == nil && verr == nil && seg.sp.verifyWrites && i < len(regions); i++ {
+			verr = seg.verifyRegion(oid, regions[i].address&0xFFFFFF, regions[i].data)
+		}
+	}
+	if err != nil {
+		logger.Panicf("ceph error: %v", err)
+	}
 
+	rc := seg.sp.rcache
+	for _, pw := range regions {
+		for i := uint64(0); i < uint64(len(pw.data)); i += rc.chunksize {
+			rc.cacheInvalidate((i + pw.address) & rc.addrmask)
+		}
+	}
+	return verr
 }
 
-var totalbytes int64
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+//Reads back a region written by flushWrite and compares its checksum with
+//the data that was written
+func (seg *CephSegment) verifyRegion(oid string, offset uint64, data []byte) bte.BTE {
+	expected := crc32.Checksum(data, castagnoli)
+	buf := make([]byte, len(data))
+	read := 0
+	for read < len(buf) {
+		rc, err := seg.h.Read(oid, buf[read:], offset+uint64(read))
+		if err != nil {
+			return bte.ErrW(bte.InvariantFailure, "could not read back write for verification", err)
+		}
+		if rc == 0 {
+			break
+		}
+		read += rc
+	}
+	if read != len(buf) || crc32.Checksum(buf, castagnoli) != expected {
+		logger.Errorf("write verification failed on %s at offset %d: read %d of %d bytes", oid, offset, read, len(buf))
+		return bte.ErrF(bte.InvariantFailure, "write verification failed on %s at offset %d", oid, offset)
+	}
+	return nil
+}
 
 //Writes a slice to the segment, returns immediately
 //Returns nil if op is OK, otherwise ErrNoSpace or ErrInvalidArgument
 //It is up to the implementer to work out how to report no space immediately
 //The uint64 is the address to be used for the next write
 func (seg *CephSegment) Write(uuid []byte, address uint64, data []byte) (uint64, error) {
-	atomic.AddInt64(&totalbytes, int64(len(data)))
+	atomic.AddInt64(&seg.sp.bytesWritten, int64(len(data)))
 	//We don't put written blocks into the cache, because those will be
 	//in the dblock cache much higher up.
 	if address != seg.naddr {
-		logger.Panic("Non-sequential write")
+		invariantf("Non-sequential write")
+	}
+	if len(data) > seg.sp.maxObjectSize {
+		return 0, bte.ErrF(bte.InvariantFailure, "object of %d bytes exceeds the max object size of %d bytes", len(data), seg.sp.maxObjectSize)
 	}
 
 	if len(seg.wcache)+len(data)+2 > cap(seg.wcache) {
-		seg.flushWrite()
+		if err := seg.flushWrite(); err != nil {
+			return 0, err
+		}
 	}
 
 	base := len(seg.wcache)
@@ -176,6 +424,7 @@ func (seg *CephSegment) Write(uuid []byte, address uint64, data []byte) (uint64,
 	seg.wcache[base] = byte(len(data))
 	seg.wcache[base+1] = byte(len(data) >> 8)
 	seg.wcache = append(seg.wcache, data...)
+	seg.written += uint64(len(data) + 2)
 
 	naddr := address + uint64(len(data)+2)
 
@@ -185,11 +434,13 @@ func (seg *CephSegment) Write(uuid []byte, address uint64, data []byte) (uint64,
 	//start of an object. This is why we do not add the object max size here
 	//NEW NOTE:
 	//We cannot go past the end of the allocation anymore because it would break the read cache
-	if ((naddr + MAX_EXPECTED_OBJECT_SIZE + 2) >> 24) != (address >> 24) {
-		//We are gonna need a new object addr
-		naddr = <-seg.sp.alloc
+	rmask := ^(seg.sp.regionSize - 1)
+	if ((naddr + uint64(seg.sp.maxObjectSize) + 2) & rmask) != (address & rmask) {
+		//We are gonna need a new object addr. The old object's region is
+		//written with the next flush
+		naddr = seg.region(<-seg.sp.alloc)
 		seg.naddr = naddr
-		seg.flushWrite()
+		seg.queueFlush()
 		return naddr, nil
 	}
 	seg.naddr = naddr
@@ -207,8 +458,68 @@ func (sp *CephStorageProvider) pruneSegCache() {
 	//This is extremely rare, so its best to handle it simply
 	//If we drop the cache, we will get one shortsized object per stream,
 	//and it won't necessarily be _very_ short.
-	if len(sp.segaddrcache) >= SEGCACHE_SIZE {
-		sp.segaddrcache = make(map[[16]byte]uint64, SEGCACHE_SIZE)
+	if len(sp.segaddrcache) < sp.segcacheSize {
+		return
+	}
+	//Expired entries go first, which may be enough
+	now := time.Now()
+	for k, e := range sp.segaddrcache {
+		if sp.segcacheExpired(e, now) {
+			delete(sp.segaddrcache, k)
+		}
+	}
+	if len(sp.segaddrcache) < sp.segcacheSize {
+		return
+	}
+	if sp.segcacheEvictOne {
+		//Map iteration order is random, so this is random eviction
+		for k := range sp.segaddrcache {
+			delete(sp.segaddrcache, k)
+			return
+		}
+	}
+	sp.segaddrcache = make(map[[16]byte]segcacheEntry, sp.segcacheSize)
+}
+
+func (sp *CephStorageProvider) segcacheExpired(e segcacheEntry, now time.Time) bool {
+	return now.Sub(e.when) > sp.segcacheTTL
+}
+
+//Takes a write handle for the pool, preferring pref if it is available right
+//now. Returns false if tmt fires first
+func (sp *CephStorageProvider) takeWriteHandle(pool string, pref int, tmt <-chan time.Time) (int, bool) {
+	whq := sp.writeHandles(pool)
+	if pref >= 0 {
+		//All the free handles are queued in idx, so look through them
+		skipped := []int{}
+		defer func() {
+			for _, hi := range skipped {
+				whq.ret <- hi
+			}
+		}()
+	scan:
+		for i := 0; i < NUM_WHANDLES; i++ {
+			select {
+			case hi := <-whq.idx:
+				if hi == pref {
+					return hi, true
+				}
+				skipped = append(skipped, hi)
+			default:
+				break scan
+			}
+		}
+		if len(skipped) > 0 {
+			hi := skipped[0]
+			skipped = skipped[1:]
+			return hi, true
+		}
+	}
+	select {
+	case hi := <-whq.idx:
+		return hi, true
+	case <-tmt:
+		return 0, false
 	}
 }
 
@@ -242,31 +553,42 @@ func (sp *CephStorageProvider) provideReadHandles() {
 	}
 }
 
+//Each pool has its own write handles, so writers to a slow pool cannot starve
+//writers to the others
 func (sp *CephStorageProvider) provideWriteHandles() {
+	sp.poolMu.Lock()
+	defer sp.poolMu.Unlock()
+	for _, whq := range sp.pwhq {
+		go whq.provide()
+	}
+	sp.providingWH = true
+}
+
+func (whq *handleQueue) provide() {
 	for {
 		//Read all returned write handles
 	ldretfiw:
 		for {
 			select {
-			case fi := <-sp.whidx_ret:
-				sp.wh_avail[fi] = true
+			case fi := <-whq.ret:
+				whq.avail[fi] = true
 			default:
 				break ldretfiw
 			}
 		}
 
 		found := false
-		for i := 0; i < NUM_WHANDLES; i++ {
-			if sp.wh_avail[i] {
-				sp.whidx <- i
-				sp.wh_avail[i] = false
+		for i := range whq.avail {
+			if whq.avail[i] {
+				whq.idx <- i
+				whq.avail[i] = false
 				found = true
 			}
 		}
 		//If we didn't find one, do a blocking read
 		if !found {
-			idx := <-sp.whidx_ret
-			sp.wh_avail[idx] = true
+			idx := <-whq.ret
+			whq.avail[idx] = true
 		}
 	}
 }
@@ -275,9 +597,18 @@ func (sp *CephStorageProvider) provideAllocs() {
 	base := sp.ptr
 	for {
 		sp.alloc <- sp.ptr
-		sp.ptr += ADDR_OBJ_SIZE
-		if sp.ptr >= base+ADDR_LOCK_SIZE {
-			sp.ptr = sp.obtainBaseAddress()
+		sp.ptr += sp.regionSize
+		if sp.ptr >= base+sp.lockSize {
+			for {
+				ptr, err := sp.obtainBaseAddress()
+				if err == nil {
+					sp.ptr = ptr
+					break
+				}
+				//Writers wait for an allocation rather than crash the node
+				logger.Errorf("could not obtain an address range, retrying: %v", err)
+				time.Sleep(sp.allocLease)
+			}
 			base = sp.ptr
 		}
 	}
@@ -291,45 +622,154 @@ func (sp *CephStorageProvider) GetRH() int {
 		panic(fmt.Sprintf("gottem %d", provided_rh))
 	}
 }
-func (sp *CephStorageProvider) obtainBaseAddress() uint64 {
+//LIBRADOS_LOCK_FLAG_RENEW
+var lockFlagRenew byte = 1
+
+//Takes the next lockSize range from the allocator object. The read and
+//write of the allocator happen under an exclusive lock with a lease of
+//allocLease. If the lease may have lapsed before the write, the lock is
+//renewed first, and if that fails another node could have read the same
+//value so we start again. If the lease lapsed during the write the range
+//may have been handed to another node too, so it is abandoned. Gives up if
+//the lock cannot be taken within ALLOC_LOCK_WAIT leases
+func (sp *CephStorageProvider) obtainBaseAddress() (uint64, bte.BTE) {
 	addr := make([]byte, 8)
 	hi := <-sp.rhidx
 	h := sp.rh[hi]
-	h.LockExclusive("allocator", "alloc_lock", "main", "alloc", 5*time.Second, nil)
-	c, err := h.Read("allocator", addr, 0)
-	if err != nil || c != 8 {
+	defer func() { sp.rhidx_ret <- hi }()
+	deadline := time.Now().Add(ALLOC_LOCK_WAIT * sp.allocLease)
+	for {
+		if time.Now().After(deadline) {
+			return 0, bte.ErrF(bte.StorageTimeout, "could not take the allocator lock within %v", ALLOC_LOCK_WAIT*sp.allocLease)
+		}
+		locked := time.Now()
+		var res int
+		err := sp.retry("allocator lock", func() error {
+			var err error
+			res, err = h.LockExclusive("allocator", "alloc_lock", "main", "alloc", sp.allocLease, nil)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if res != 0 {
+			//Held by another node
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		c, rerr := h.Read("allocator", addr, 0)
+		if rerr != nil || c != 8 {
+			h.Unlock("allocator", "alloc_lock", "main")
+			if rerr != nil {
+				return 0, bte.ErrW(bte.ClusterDegraded, "could not read allocator", rerr)
+			}
+			return 0, bte.ErrF(bte.ClusterDegraded, "allocator is %d bytes, was the database created?", c)
+		}
+		le := binary.LittleEndian.Uint64(addr)
+		if time.Since(locked) > sp.allocLease/2 {
+			renewed := time.Now()
+			res, err := h.LockExclusive("allocator", "alloc_lock", "main", "alloc", sp.allocLease, &lockFlagRenew)
+			if err != nil || res != 0 {
+				logger.Warningf("allocator lock lapsed (%v), retrying", time.Since(locked))
+				h.Unlock("allocator", "alloc_lock", "main")
+				continue
+			}
+			locked = renewed
+		}
+		ne := le + sp.lockSize
+		binary.LittleEndian.PutUint64(addr, ne)
+		err = sp.retry("allocator write", func() error {
+			return h.WriteFull("allocator", addr)
+		})
 		h.Unlock("allocator", "alloc_lock", "main")
-		sp.rhidx_ret <- hi
-		return 0
-	}
-	le := binary.LittleEndian.Uint64(addr)
-	ne := le + ADDR_LOCK_SIZE
-	binary.LittleEndian.PutUint64(addr, ne)
-	err = h.WriteFull("allocator", addr)
-	if err != nil {
-		panic("b")
+		if err != nil {
+			return 0, err
+		}
+		if time.Since(locked) >= sp.allocLease {
+			//Another node may have read le after the lease ran out
+			logger.Warningf("allocator lock lapsed during the write (%v), abandoning 0x%016x", time.Since(locked), le)
+			continue
+		}
+		return le, nil
 	}
-	h.Unlock("allocator", "alloc_lock", "main")
-	sp.rhidx_ret <- hi
-	return le
 }
 
 //Called at startup of a normal run
 func (sp *CephStorageProvider) Initialize(cfg configprovider.Configuration) {
 	//Allocate caches
 	go func() {
+		//Only log when there were reads, rather than every second forever
+		var lastRead, lastUsed int64
 		for {
 			time.Sleep(1 * time.Second)
-			logger.Infof("rawlp[%s %s=%d,%s=%d]", "cachegood", "actual", atomic.LoadInt64(&actualread), "used", atomic.LoadInt64(&readused))
+			read, used := atomic.LoadInt64(&sp.bytesRead), atomic.LoadInt64(&readused)
+			if read == lastRead && used == lastUsed {
+				continue
+			}
+			lastRead, lastUsed = read, used
+			logger.Infof("rawlp[%s %s=%d,%s=%d]", "cachegood", "actual", read, "used", used)
 		}
 	}()
 	sp.cfg = cfg
 	sp.rcache = &CephCache{}
 	cachesz := cfg.RadosReadCache()
-	if cachesz < 40 {
-		cachesz = 40 //one per read handle: 40MB
+	sp.maxObjectSize = cfg.RadosMaxObjectSize()
+	if sp.maxObjectSize == 0 {
+		sp.maxObjectSize = MAX_EXPECTED_OBJECT_SIZE
+	}
+	if sp.maxObjectSize < MAX_EXPECTED_OBJECT_SIZE || sp.maxObjectSize > MAX_OBJECT_SIZE_LIMIT {
+		logger.Panicf("Max object size (%d bytes) must be between %d and %d bytes", sp.maxObjectSize, MAX_EXPECTED_OBJECT_SIZE, MAX_OBJECT_SIZE_LIMIT)
+	}
+	chunksz := cfg.RadosReadChunkSize()
+	if chunksz == 0 {
+		chunksz = R_CHUNKSIZE
+	}
+	sp.regionSize = uint64(cfg.RadosAllocRegionSize())
+	if sp.regionSize == 0 {
+		sp.regionSize = ADDR_OBJ_SIZE
+	}
+	sp.lockSize = uint64(cfg.RadosAllocLockSize())
+	if sp.lockSize == 0 {
+		sp.lockSize = ADDR_LOCK_SIZE
+	}
+	//An object must span at most two chunks, and chunks must not span objects
+	if chunksz&(chunksz-1) != 0 || chunksz < sp.maxObjectSize*2 || uint64(chunksz) > sp.regionSize {
+		logger.Panicf("Read chunk size (%d bytes) must be a power of two between %d and %d bytes", chunksz, sp.maxObjectSize*2, sp.regionSize)
+	}
+	//Chunks are cached by address alone, so a chunk must not hold the regions
+	//of two streams. Regions must stay aligned however other nodes are
+	//configured, so lock sizes are whole objects
+	if sp.regionSize&(sp.regionSize-1) != 0 || sp.regionSize > ADDR_OBJ_SIZE {
+		logger.Panicf("Allocation region size (%d bytes) must be a power of two of at most %d bytes", sp.regionSize, ADDR_OBJ_SIZE)
+	}
+	if sp.lockSize%ADDR_OBJ_SIZE != 0 {
+		logger.Panicf("Allocation lock size (%d bytes) must be a multiple of %d bytes", sp.lockSize, ADDR_OBJ_SIZE)
+	}
+	if minsz := minCacheChunks(NUM_RHANDLES); cachesz > 0 && uint64(cachesz) < minsz {
+		logger.Warningf("radosreadcache of %d chunks is too small for %d read handles, using %d chunks (%d MB)",
+			cachesz, NUM_RHANDLES, minsz, minsz*uint64(chunksz)>>20)
+	}
+	sp.rcache.initCache(uint64(cachesz), uint64(chunksz), NUM_RHANDLES)
+	if minfree := cfg.RadosReadCacheMinFreeMemory(); minfree > 0 {
+		go sp.rcache.watchMemory(uint64(minfree) << 20)
+	}
+	sp.wcacheSize = cfg.RadosSegmentWriteCache()
+	if sp.wcacheSize == 0 {
+		sp.wcacheSize = WCACHE_SIZE
+	}
+	//A single object (plus its length prefix) must always fit in the write cache
+	if sp.wcacheSize <= sp.maxObjectSize+2 {
+		logger.Panicf("Segment write cache (%d bytes) must exceed the max object size (%d bytes)", sp.wcacheSize, sp.maxObjectSize+2)
+	}
+	codec, err := codecFromName(cfg.StorageCephDataCompression())
+	if err != nil {
+		logger.Panicf("Invalid data compression: %v", err)
+	}
+	sp.dataCodec = codec
+	sp.poolCodecs, err = parsePoolCodecs(cfg.StorageCephPoolCompression())
+	if err != nil {
+		logger.Panicf("Invalid pool compression: %v", err)
 	}
-	sp.rcache.initCache(uint64(cachesz))
 	conn, err := rados.NewConn()
 	if err != nil {
 		logger.Panicf("Could not initialize ceph storage: %v", err)
@@ -345,44 +785,98 @@ func (sp *CephStorageProvider) Initialize(cfg configprovider.Configuration) {
 	sp.conn = conn
 	sp.dataPool = cfg.StorageCephDataPool()
 	sp.hotPool = cfg.StorageCephHotPool()
+	if sp.hotPool == "" {
+		sp.hotPool = sp.dataPool
+	}
+	sp.routes, err = parsePoolRoutes(cfg.StorageCephPoolRoutes())
+	if err != nil {
+		logger.Panicf("Invalid pool routes: %v", err)
+	}
+	sp.namespace = cfg.StorageCephNamespace()
+	if err := checkNamespace(sp.namespace); err != nil {
+		logger.Panicf("Invalid namespace: %v", err)
+	}
+	sp.placement = make(map[[16]byte]streamLayout)
+	sp.readOnly = cfg.StorageCephReadOnly()
 
-	sp.rh = make([]*rados.IOContext, NUM_RHANDLES)
 	sp.rh_avail = make([]bool, NUM_RHANDLES)
 	sp.rhidx = make(chan int, NUM_RHANDLES+1)
 	sp.rhidx_ret = make(chan int, NUM_RHANDLES+1)
-	sp.wh = make([]*rados.IOContext, NUM_RHANDLES)
-	sp.wh_avail = make([]bool, NUM_WHANDLES)
-	sp.whidx = make(chan int, NUM_WHANDLES+1)
-	sp.whidx_ret = make(chan int, NUM_WHANDLES+1)
 	sp.alloc = make(chan uint64, 128)
-	sp.segaddrcache = make(map[[16]byte]uint64, SEGCACHE_SIZE)
-	sp.chunkgate = make(map[chunkreqindex][]chan []byte)
+	sp.segcacheSize = cfg.RadosSegmentCacheSize()
+	if sp.segcacheSize == 0 {
+		sp.segcacheSize = SEGCACHE_SIZE
+	}
+	sp.segcacheWorth = sp.regionSize - 1 - uint64(sp.maxObjectSize)
+	if minfree := cfg.RadosSegmentCacheMinFree(); minfree != 0 {
+		if minfree < sp.maxObjectSize || uint64(minfree) >= sp.regionSize {
+			logger.Panicf("Segment cache min free (%d bytes) must be between %d and %d bytes", minfree, sp.maxObjectSize, sp.regionSize)
+		}
+		sp.segcacheWorth = sp.regionSize - 1 - uint64(minfree)
+	}
+	sp.segcacheEvictOne = cfg.RadosSegmentCacheEvictOne()
+	sp.segcacheTTL = time.Duration(cfg.RadosSegmentCacheTTL()) * time.Second
+	if sp.segcacheTTL == 0 {
+		sp.segcacheTTL = SEGCACHE_TTL
+	}
+	sp.segaddrcache = make(map[[16]byte]segcacheEntry, sp.segcacheSize)
+	sp.chunkgate = make(map[chunkreqindex][]chan chunkResult)
+	fetches := cfg.RadosReadConcurrency()
+	if fetches == 0 {
+		fetches = NUM_RHANDLES
+	}
+	if fetches < 0 {
+		logger.Panicf("Read concurrency (%d) must not be negative", fetches)
+	}
+	sp.fetchsem = make(chan struct{}, fetches)
+	sp.readAhead = cfg.RadosReadAhead()
+	if sp.readAhead < 0 {
+		logger.Panicf("Read ahead (%d chunks) must not be negative", sp.readAhead)
+	}
 
 	for i := 0; i < NUM_RHANDLES; i++ {
 		sp.rh_avail[i] = true
-		h, err := conn.OpenIOContext(sp.dataPool)
-		if err != nil {
-			logger.Panicf("Could not open CEPH: %v", err)
-		}
-		sp.rh[i] = h
 	}
+	sp.openPools()
+	sp.loadIndexFormat()
 
-	for i := 0; i < NUM_WHANDLES; i++ {
-		sp.wh_avail[i] = true
-		h, err := conn.OpenIOContext(sp.dataPool)
-		if err != nil {
-			logger.Panicf("Could not open CEPH: %v", err)
-		}
-		sp.wh[i] = h
+	sp.allocLease = time.Duration(cfg.RadosAllocLease()) * time.Millisecond
+	if sp.allocLease == 0 {
+		sp.allocLease = ALLOC_LEASE
+	}
+	sp.verifyWrites = cfg.RadosVerifyWrites()
+	sp.recoverPanics = cfg.RadosRecoverPanics()
+	sp.packThreshold = uint64(cfg.RadosPackThreshold())
+	sp.packWritten = make(map[[16]byte]uint64)
+	sp.packcache = make(map[packKey]segcacheEntry)
+	sp.maxAnnotation = cfg.StorageMaxAnnotationSize()
+	if sp.maxAnnotation == 0 {
+		sp.maxAnnotation = bprovider.MaxAnnotationSize
+	}
+	sp.retryCount = cfg.RadosRetries()
+	if sp.retryCount == 0 {
+		sp.retryCount = RETRY_COUNT
+	} else if sp.retryCount < 0 {
+		sp.retryCount = 0
+	}
+	sp.retryDelay = time.Duration(cfg.RadosRetryDelay()) * time.Millisecond
+	if sp.retryDelay == 0 {
+		sp.retryDelay = RETRY_DELAY
 	}
 
 	//Start serving read handles
 	go sp.provideReadHandles()
+	if sp.readOnly {
+		//A replica never writes, so it needs neither write handles nor
+		//an allocation lock
+		logger.Infof("Storage is read only")
+		return
+	}
 	go sp.provideWriteHandles()
 	//Obtain base address
-	sp.ptr = sp.obtainBaseAddress()
-	if sp.ptr == 0 {
-		logger.Panic("Could not read allocator! DB not created properly?")
+	sp.ptr, err = sp.obtainBaseAddress()
+	if err != nil {
+		logger.Panicf("Could not obtain an address range: %v", err)
 	}
 	logger.Infof("Base address obtained as 0x%016x", sp.ptr)
 
@@ -415,39 +909,175 @@ func (sp *CephStorageProvider) CreateDatabase(cfg configprovider.Configuration)
 	if err != nil {
 		logger.Panicf("Could not create the ceph allocator context: %v", err)
 	}
-	addr := uint64(0x1000000)
+	ns := cfg.StorageCephNamespace()
+	if err := checkNamespace(ns); err != nil {
+		logger.Panicf("Invalid namespace: %v", err)
+	}
+	h.SetNamespace(ns)
+	addr, err := initialAddress(cfg.StorageCephInitialAddress())
+	if err != nil {
+		logger.Panicf("Invalid initial address: %v", err)
+	}
 	baddr := make([]byte, 8)
 	binary.LittleEndian.PutUint64(baddr, addr)
 	err = h.WriteFull("allocator", baddr)
 	if err != nil {
 		logger.Panicf("Could not create the ceph allocator handle: %v", err)
 	}
+	//Without a seed no format is written, so older versions can still read
+	//the database
+	if seed := cfg.StorageCephIndexSeed(); seed != 0 {
+		fmtb := make([]byte, 8)
+		binary.LittleEndian.PutUint32(fmtb[:4], INDEX_FORMAT_SEEDED)
+		binary.LittleEndian.PutUint32(fmtb[4:], seed)
+		err = h.WriteFull(INDEX_FORMAT_OID, fmtb)
+		if err != nil {
+			logger.Panicf("Could not write the index format: %v", err)
+		}
+	}
 	h.Destroy()
 	return nil
 }
 
+//Parses and checks the configured initial allocator address. Allocated
+//addresses must stay clear of the packed and metadata addresses, and a
+//custom start must be aligned to the allocation lock so regions are too
+func initialAddress(s string) (uint64, error) {
+	if s == "" {
+		return INITIAL_ADDR, nil
+	}
+	addr, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, err
+	}
+	if addr == 0 || addr%ADDR_LOCK_SIZE != 0 {
+		return 0, fmt.Errorf("0x%x is not a nonzero multiple of 0x%x", addr, ADDR_LOCK_SIZE)
+	}
+	//PACKED_ADDR_BIT is below METADATA_BASE
+	if addr >= PACKED_ADDR_BIT {
+		return 0, fmt.Errorf("0x%x is not below 0x%x", addr, uint64(PACKED_ADDR_BIT))
+	}
+	return addr, nil
+}
+
+//Checks that the data pool can be reached by statting the allocator object.
+//Unlike Initialize, failures are returned rather than panicking
+func (sp *CephStorageProvider) Healthy() (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	var hi int
+	select {
+	case hi = <-sp.rhidx:
+	case <-time.After(5 * time.Second):
+		return bte.Err(bte.ClusterDegraded, "timed out waiting for a ceph read handle")
+	}
+	defer func() {
+		sp.rhidx_ret <- hi
+	}()
+	_, err := sp.rh[hi].Stat("allocator")
+	if err != nil {
+		return bte.ErrW(bte.ClusterDegraded, "could not stat allocator object", err)
+	}
+	return nil
+}
+
+//ResizeReadCache changes the size of the read cache to the given MB,
+//evicting chunks if it shrinks. It lasts until restart
+func (sp *CephStorageProvider) ResizeReadCache(sizeMB uint64) {
+	sp.rcache.Resize(sizeMB)
+}
+
+//Returns the number of bytes written to segments by this provider
+func (sp *CephStorageProvider) BytesWritten() int64 {
+	return atomic.LoadInt64(&sp.bytesWritten)
+}
+
+//Returns the number of bytes read from the data pool by this provider
+func (sp *CephStorageProvider) BytesRead() int64 {
+	return atomic.LoadInt64(&sp.bytesRead)
+}
+
+//Zeroes both byte counters, returning the values they had
+func (sp *CephStorageProvider) ResetByteCounters() (written int64, read int64) {
+	written = atomic.SwapInt64(&sp.bytesWritten, 0)
+	read = atomic.SwapInt64(&sp.bytesRead, 0)
+	return
+}
+
+//Returns ReadOnly if this is a read replica, for methods that write
+func (sp *CephStorageProvider) checkWritable() bte.BTE {
+	if sp.readOnly {
+		return bte.Err(bte.ReadOnly, "storage is read only")
+	}
+	return nil
+}
+
 // Lock a segment, or block until a segment can be locked
 // Returns a Segment struct
 // Implicit unchecked assumption: you cannot lock more than one segment
 // for a given uuid (without unlocking them in between). It will break
 // segcache
+// A read only provider panics, writes must be rejected before they get here
 func (sp *CephStorageProvider) LockSegment(uuid []byte) bprovider.Segment {
+	rv, err := sp.LockSegmentTimeout(uuid, 0)
+	if err != nil {
+		logger.Panicf("lock segment without timeout failed: %v", err)
+	}
+	return rv
+}
+
+// Like LockSegment, but gives up with StorageTimeout if a write handle and an
+// allocation cannot be obtained within d. A d <= 0 waits forever
+func (sp *CephStorageProvider) LockSegmentTimeout(uuid []byte, d time.Duration) (_ bprovider.Segment, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return nil, err
+	}
+	var tmt <-chan time.Time
+	if d > 0 {
+		tmt = time.After(d)
+	}
+	pools, err := sp.layoutOf(uuid)
+	if err != nil {
+		return nil, err
+	}
 	rv := new(CephSegment)
 	rv.sp = sp
-	rv.hi = <-sp.whidx
-	rv.h = sp.wh[rv.hi]
-	rv.ptr = <-sp.alloc
 	rv.uid = UUIDSliceToArr(uuid)
-	rv.wcache = make([]byte, 0, WCACHE_SIZE)
+	rv.pool = pools.data
+	rv.packed = sp.shouldPack(rv.uid)
+	pref := -1
 	sp.segcachelock.Lock()
-	cached_ptr, ok := sp.segaddrcache[rv.uid]
-	if ok {
-		delete(sp.segaddrcache, rv.uid)
+	if e, ok := sp.cachedSegment(rv, false); ok {
+		pref = e.hi
+	}
+	sp.segcachelock.Unlock()
+	var ok bool
+	rv.hi, ok = sp.takeWriteHandle(pools.data, pref, tmt)
+	if !ok {
+		return nil, bte.Err(bte.StorageTimeout, "timed out waiting for a write handle")
+	}
+	//The segment owns the handle once it is returned, until then give it
+	//back on every error, including a recovered panic
+	locked := false
+	defer func() {
+		if !locked {
+			sp.writeHandles(pools.data).ret <- rv.hi
+		}
+	}()
+	rv.h = sp.whFor(rv.hi, pools.data)
+	select {
+	case rv.ptr = <-sp.alloc:
+		rv.ptr = rv.region(rv.ptr)
+	case <-tmt:
+		return nil, bte.Err(bte.StorageTimeout, "timed out waiting for an allocation")
 	}
+	rv.wcache = make([]byte, 0, sp.wcacheSize)
+	sp.segcachelock.Lock()
+	cached, ok := sp.cachedSegment(rv, true)
 	sp.segcachelock.Unlock()
 	//ok = false
 	if ok {
-		rv.base = cached_ptr
+		rv.base = cached.addr
 		rv.naddr = rv.base
 	} else {
 		rv.base = rv.ptr
@@ -458,60 +1088,152 @@ func (sp *CephStorageProvider) LockSegment(uuid []byte) bprovider.Segment {
 	//the Go GC may free it before C is done. I prevent this by pinning all the written arrays, which get
 	//deref'd after the segment is unlocked
 	rv.warrs = make([][]byte, 0, 64)
-	return rv
+	locked = true
+	return rv, nil
 }
 
-func (sp *CephStorageProvider) rawObtainChunk(uuid []byte, address uint64) []byte {
+//Reads the chunk at address into the cache, unless it is cached already. A
+//chunk read ahead that is short is the end of what has been written, which a
+//later write may extend, so it is not cached
+func (sp *CephStorageProvider) rawObtainChunk(uuid []byte, address uint64, budget bprovider.ReadBudget, prefetch bool) ([]byte, bte.BTE) {
 	chunk := sp.rcache.cacheGet(address)
 	if chunk == nil {
+		layout, lerr := sp.layoutOf(uuid)
+		if lerr != nil {
+			return nil, lerr
+		}
+		pool := layout.data
 		chunk = sp.rcache.getBlank()
+		//Take from the query's budget first, so a query at its limit does not
+		//sit on a handle from the global pool while it waits
+		budget.Acquire()
 		rhidx := sp.GetRH()
-		aa := address >> 24
-		oid := fmt.Sprintf("%032x%010x", uuid, aa)
+		h := sp.rhFor(rhidx, pool)
+		oid := dataOid(uuid, address)
 		offset := address & 0xFFFFFF
-		rc, err := sp.rh[rhidx].Read(oid, chunk, offset)
-		atomic.AddInt64(&actualread, int64(rc))
+		var rc int
+		var compressed bool
+		var err bte.BTE
+		if sp.codecFor(pool) != CODEC_NONE {
+			rc, compressed, err = sp.readCompressedChunk(h, oid, offset, chunk)
+		}
+		if !compressed && err == nil {
+			err = sp.retry("read", func() error {
+				var err error
+				rc, err = h.Read(oid, chunk, offset)
+				return err
+			})
+		}
+		sp.rhidx_ret <- rhidx
+		budget.Release()
 		if err != nil {
-			logger.Panicf("ceph error: %v", err)
+			hotlog.Errorf(fmt.Sprintf("chunk %x", uuid), "could not read chunk 0x%016x of stream %x: %v", address, uuid, err)
+			return nil, err
 		}
+		atomic.AddInt64(&sp.bytesRead, int64(rc))
 		chunk = chunk[0:rc]
-		sp.rhidx_ret <- rhidx
-		sp.rcache.cachePut(address, chunk)
+		if !prefetch || uint64(rc) == sp.rcache.chunksize {
+			sp.rcache.cachePut(address, chunk)
+		}
 	}
-	return chunk
+	return chunk, nil
+}
+
+//What a chunk fetch hands to everyone waiting for it at the gate
+type chunkResult struct {
+	chunk []byte
+	err   bte.BTE
 }
 
-func (sp *CephStorageProvider) obtainChunk(uuid []byte, address uint64) []byte {
+//Returns the chunk from the cache, or reads it. Concurrent reads of a chunk
+//are merged, and only the first takes a place in fetchsem. A caller whose ctx
+//is done stops waiting for the read, which still completes and is cached
+func (sp *CephStorageProvider) obtainChunk(ctx context.Context, uuid []byte, address uint64, budget bprovider.ReadBudget) ([]byte, bte.BTE) {
 	chunk := sp.rcache.cacheGet(address)
 	if chunk != nil {
-		return chunk
+		return chunk, nil
+	}
+	if ctx.Err() != nil {
+		return nil, bte.CtxE(ctx)
 	}
 	index := chunkreqindex{UUID: UUIDSliceToArr(uuid), Addr: address}
-	rvc := make(chan []byte, 1)
+	rvc := make(chan chunkResult, 1)
 	sp.chunklock.Lock()
 	slc, ok := sp.chunkgate[index]
 	if ok {
 		sp.chunkgate[index] = append(slc, rvc)
 		sp.chunklock.Unlock()
 	} else {
-		sp.chunkgate[index] = []chan []byte{rvc}
+		sp.chunkgate[index] = []chan chunkResult{rvc}
 		sp.chunklock.Unlock()
 		go func() {
-			bslice := sp.rawObtainChunk(uuid, address)
-			sp.chunklock.Lock()
-			slc, ok := sp.chunkgate[index]
-			if !ok {
-				panic("inconsistency!!")
-			}
-			for _, chn := range slc {
-				chn <- bslice
-			}
-			delete(sp.chunkgate, index)
-			sp.chunklock.Unlock()
+			sp.fetchsem <- struct{}{}
+			sp.fetchChunk(uuid, index, budget, false)
 		}()
 	}
-	rv := <-rvc
-	return rv
+	select {
+	case rv := <-rvc:
+		return rv.chunk, rv.err
+	case <-ctx.Done():
+		return nil, bte.CtxE(ctx)
+	}
+}
+
+//Reads a chunk registered in the gate and hands it, or the read error, to
+//everyone waiting there. This runs in its own goroutine, so errors must be
+//handed on rather than panic. The caller holds a place in fetchsem, which is
+//given back. Prefetch is true if no one asked for the chunk yet
+func (sp *CephStorageProvider) fetchChunk(uuid []byte, index chunkreqindex, budget bprovider.ReadBudget, prefetch bool) {
+	bslice, err := sp.rawObtainChunk(uuid, index.Addr, budget, prefetch)
+	<-sp.fetchsem
+	sp.chunklock.Lock()
+	slc, ok := sp.chunkgate[index]
+	if !ok {
+		invariantf("chunk request for %x at 0x%016x is missing from the gate", uuid, index.Addr)
+	}
+	for _, chn := range slc {
+		chn <- chunkResult{chunk: bslice, err: err}
+	}
+	delete(sp.chunkgate, index)
+	sp.chunklock.Unlock()
+}
+
+//Starts reading up to readAhead chunks after the one holding address into the
+//read cache, skipping those cached or already being read. Only chunks in the
+//same allocation region are read, as the next region may belong to another
+//stream. Read ahead stops rather than wait for a place in fetchsem, so it
+//never holds up reads that are needed now
+func (sp *CephStorageProvider) Prefetch(uuid []byte, address uint64) {
+	rc := sp.rcache
+	if sp.readAhead == 0 || address&PACKED_ADDR_BIT != 0 || atomic.LoadUint64(&rc.cachemax) == 0 {
+		return
+	}
+	region := address &^ (sp.regionSize - 1)
+	next := address & rc.addrmask
+	for i := 0; i < sp.readAhead; i++ {
+		next += rc.chunksize
+		if next&^(sp.regionSize-1) != region {
+			return
+		}
+		if rc.cacheHas(next) {
+			continue
+		}
+		index := chunkreqindex{UUID: UUIDSliceToArr(uuid), Addr: next}
+		sp.chunklock.Lock()
+		if _, ok := sp.chunkgate[index]; ok {
+			sp.chunklock.Unlock()
+			continue
+		}
+		select {
+		case sp.fetchsem <- struct{}{}:
+		default:
+			sp.chunklock.Unlock()
+			return
+		}
+		sp.chunkgate[index] = []chan chunkResult{}
+		sp.chunklock.Unlock()
+		go sp.fetchChunk(uuid, index, nil, true)
+	}
 }
 
 // Read the blob into the given buffer: direct read
@@ -539,15 +1261,39 @@ func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 var exl_lock sync.Mutex
 
 // Read the blob into the given buffer
-func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte) []byte {
+func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte) (_ []byte, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	return sp.ReadBudgeted(context.Background(), uuid, address, buffer, nil)
+}
+
+// Read the blob into the given buffer, limiting the read handles used to the
+// budget as well as the global pool. The context is checked before each chunk
+// is fetched
+func (sp *CephStorageProvider) ReadBudgeted(ctx context.Context, uuid []byte, address uint64, buffer []byte, budget bprovider.ReadBudget) (_ []byte, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
 	//Get the first chunk for this object:
-	chunk1 := sp.obtainChunk(uuid, address&R_ADDRMASK)[address&R_OFFSETMASK:]
+	rc := sp.rcache
+	chunk1, err := sp.obtainChunk(ctx, uuid, address&rc.addrmask, budget)
+	if err != nil {
+		return nil, err
+	}
+	//A short chunk ends where the written data does
+	if address&rc.offsetmask >= uint64(len(chunk1)) {
+		return nil, bte.ErrF(bte.BlockCorrupt, "object at 0x%016x is past the end of the written data", address)
+	}
+	chunk1 = chunk1[address&rc.offsetmask:]
 	var chunk2 []byte
 	var ln int
 
 	if len(chunk1) < 2 {
 		//not even long enough for the prefix, must be one byte in the first chunk, one in teh second
-		chunk2 = sp.obtainChunk(uuid, (address+R_CHUNKSIZE)&R_ADDRMASK)
+		chunk2, err = sp.obtainChunk(ctx, uuid, (address+rc.chunksize)&rc.addrmask, budget)
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk2) == 0 {
+			return nil, bte.ErrF(bte.BlockCorrupt, "length of object at 0x%016x is truncated", address)
+		}
 		ln = int(chunk1[0]) + (int(chunk2[0]) << 8)
 		chunk2 = chunk2[1:]
 		chunk1 = chunk1[1:]
@@ -556,8 +1302,12 @@ func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 		chunk1 = chunk1[2:]
 	}
 
-	if (ln) > MAX_EXPECTED_OBJECT_SIZE {
-		logger.Panic("WTUF: ", ln)
+	if ln > sp.maxObjectSize || ln > len(buffer) {
+		hotlog.Errorf(fmt.Sprintf("objlen %x", uuid), "object at 0x%016x of stream %x has length %d, max is %d", address, uuid, ln, sp.maxObjectSize)
+		return nil, bte.ErrF(bte.BlockCorrupt, "object at 0x%016x has length %d, larger than the max object size", address, ln)
+	}
+	if ln < 2 {
+		return nil, bte.ErrF(bte.BlockCorrupt, "object at 0x%016x has length %d", address, ln)
 	}
 
 	copied := 0
@@ -572,14 +1322,17 @@ func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 	if copied < ln {
 		//We need some bytes from chunk2
 		if chunk2 == nil {
-			chunk2 = sp.obtainChunk(uuid, (address+R_CHUNKSIZE)&R_ADDRMASK)
+			chunk2, err = sp.obtainChunk(ctx, uuid, (address+rc.chunksize)&rc.addrmask, budget)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(chunk2) < ln-copied {
+			return nil, bte.ErrF(bte.BlockCorrupt, "object at 0x%016x is truncated", address)
 		}
 		copy(buffer[copied:], chunk2[:ln-copied])
 
 	}
-	if ln < 2 {
-		logger.Panic("This is unexpected")
-	}
 	exl_lock.Lock()
 	_, ok := excludemap[address]
 	if !ok {
@@ -587,39 +1340,65 @@ func (sp *CephStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 		readused += int64(ln)
 	}
 	exl_lock.Unlock()
-	return buffer[:ln]
+	return buffer[:ln], nil
 
 }
 
 // Read the given version of superblock into the buffer.
 // mebbeh we want to cache this?
-func (sp *CephStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) []byte {
+func (sp *CephStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) (_ []byte, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	layout, err := sp.layoutOf(uuid)
+	if err != nil {
+		return nil, err
+	}
+	slot := sbSlotSize(layout.sbChecksum)
 	chunk := version >> SBLOCK_CHUNK_SHIFT
-	offset := (version & SBLOCK_CHUNK_MASK) * SBLOCK_SIZE
+	offset := (version & SBLOCK_CHUNK_MASK) * slot
 	oid := fmt.Sprintf("sb%032x%011x", uuid, chunk)
 	hi := sp.GetRH()
-	h := sp.rh[hi]
-	br, err := h.Read(oid, buffer, offset)
-	if br != SBLOCK_SIZE || err != nil {
+	h := sp.rhFor(hi, layout.sb)
+	sbuf := make([]byte, slot)
+	br, err := h.Read(oid, sbuf, offset)
+	sp.rhidx_ret <- hi
+	if uint64(br) != slot || err != nil {
 		logger.Panicf("unexpected sb read rv: %v %v offset=%v oid=%s version=%d bl=%d", br, err, offset, oid, version, len(buffer))
 	}
-	sp.rhidx_ret <- hi
-	return buffer
+	if layout.sbChecksum && !sbChecksumValid(uuid, version, sbuf) {
+		return nil, bte.ErrF(bte.SuperblockCorrupt, "superblock %d of stream %x failed its checksum", version, uuid)
+	}
+	copy(buffer, sbuf[:SBLOCK_SIZE])
+	return buffer[:SBLOCK_SIZE], nil
 }
 
 // Writes a superblock of the given version
 // TODO I think the storage will need to chunk this, because sb logs of gigabytes are possible
+// A read only provider panics, like LockSegment
 func (sp *CephStorageProvider) WriteSuperBlock(uuid []byte, version uint64, buffer []byte) {
+	if err := sp.checkWritable(); err != nil {
+		logger.Panicf("superblock write: %v", err)
+	}
+	layout, lerr := sp.layoutOf(uuid)
+	if lerr != nil {
+		logger.Panicf("superblock write: %v", lerr)
+	}
+	slot := sbSlotSize(layout.sbChecksum)
 	chunk := version >> SBLOCK_CHUNK_SHIFT
-	offset := (version & SBLOCK_CHUNK_MASK) * SBLOCK_SIZE
+	offset := (version & SBLOCK_CHUNK_MASK) * slot
 	oid := fmt.Sprintf("sb%032x%011x", uuid, chunk)
-	hi := <-sp.whidx
-	h := sp.wh[hi]
-	err := h.Write(oid, buffer, offset)
+	if layout.sbChecksum {
+		buffer = withSbChecksum(uuid, version, buffer)
+	}
+	whq := sp.writeHandles(layout.sb)
+	hi := <-whq.idx
+	h := sp.whFor(hi, layout.sb)
+	err := sp.retry("superblock write", func() error {
+		return h.Write(oid, buffer, offset)
+	})
 	if err != nil {
 		logger.Panicf("unexpected sb write rv: %v", err)
 	}
-	sp.whidx_ret <- hi
+	whq.ret <- hi
 }
 
 // Sets the version of a stream. If it is in the past, it is essentially a rollback,
@@ -627,27 +1406,74 @@ func (sp *CephStorageProvider) WriteSuperBlock(uuid []byte, version uint64, buff
 // note to self: you must make sure not to call ReadSuperBlock on versions higher
 // than you get from GetStreamVersion because they might succeed
 func (sp *CephStorageProvider) SetStreamVersion(uuid []byte, version uint64) {
+	if err := sp.checkWritable(); err != nil {
+		logger.Panicf("set stream version: %v", err)
+	}
 	oid := fmt.Sprintf("meta%032x", uuid)
 	hi := sp.GetRH()
 	h := sp.rh[hi]
 	data := make([]byte, 8)
 	binary.LittleEndian.PutUint64(data, version)
-	err := h.SetXattr(oid, "version", data)
+	err := sp.setXattr(h, oid, "version", data)
 	if err != nil {
 		logger.Panicf("ceph error: %v", err)
 	}
 	sp.rhidx_ret <- hi
 }
 
-// Gets the version of a stream. Returns 0 if none exists.
-func (sp *CephStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
+//Makes every version CAS lock cookie unique, so that concurrent calls on
+//this node exclude each other as well as other nodes
+var casCookie uint64
+
+// Sets the version of a stream only if it is currently expected. The version
+// is compared and set while holding an exclusive RADOS lock on the meta object,
+// so two nodes that both think they own the stream cannot both advance it.
+// The lock is advisory, so it does not guard against SetStreamVersion.
+func (sp *CephStorageProvider) SetStreamVersionCAS(uuid []byte, expected uint64, new uint64) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	//Locking creates the object, so check the stream exists first
+	if sp.GetStreamVersion(uuid) == 0 {
+		return bte.Err(bte.NoSuchStream, "Stream does not exist")
+	}
 	oid := fmt.Sprintf("meta%032x", uuid)
 	hi := sp.GetRH()
 	h := sp.rh[hi]
-
-	rv, err := h.ListXattrs(oid)
-	if err == rados.RadosErrorNotFound {
-		sp.rhidx_ret <- hi
+	defer func() { sp.rhidx_ret <- hi }()
+	cookie := fmt.Sprintf("cas%d", atomic.AddUint64(&casCookie, 1))
+	res, err := h.LockExclusive(oid, "version_lock", cookie, "version cas", 5*time.Second, nil)
+	if err != nil || res != 0 {
+		return bte.ErrF(bte.ClusterDegraded, "could not lock stream version (%d): %v", res, err)
+	}
+	defer h.Unlock(oid, "version_lock", cookie)
+	data := make([]byte, 8)
+	bc, berr := sp.getXattr(h, oid, "version", data)
+	if berr != nil || bc != 8 {
+		logger.Panicf("weird ceph error getting xattrs: %v", berr)
+	}
+	current := binary.LittleEndian.Uint64(data)
+	if current != expected {
+		return bte.ErrF(bte.StreamVersionMismatch, "stream version is %d, expected %d", current, expected)
+	}
+	binary.LittleEndian.PutUint64(data, new)
+	berr = sp.setXattr(h, oid, "version", data)
+	if berr != nil {
+		logger.Panicf("ceph error: %v", berr)
+	}
+	return nil
+}
+
+// Gets the version of a stream. Returns 0 if none exists.
+func (sp *CephStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+
+	rv, err := h.ListXattrs(oid)
+	if err == rados.RadosErrorNotFound {
+		sp.rhidx_ret <- hi
 		return nil, 0
 	}
 	if err != nil {
@@ -657,17 +1483,17 @@ func (sp *CephStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uin
 	tdata := rv["stream"]
 	ver := binary.LittleEndian.Uint64(vdata)
 	tparts := strings.SplitN(string(tdata), ";", 2)
+	if len(tparts) != 2 {
+		//Keep the stream reachable by uuid, without its tags
+		logger.Errorf("stream %x has a malformed collection entry %q", uuid, tdata)
+		tparts = append(tparts[:1], "")
+	}
 	collection := tparts[0]
 
-	tags := strings.Split(tparts[1], "@")
-	if tparts[1] == "" {
-		tags = []string{}
-	} else {
-		tags = tags[:len(tags)-1]
-	}
-	tmap := make(map[string]string)
-	for i := 0; i < len(tags); i += 2 {
-		tmap[tags[i]] = tags[i+1]
+	tmap, ok := parseTagListKey(tparts[1])
+	if !ok {
+		logger.Errorf("stream %x has malformed tags %q", uuid, tparts[1])
+		tmap = make(map[string]string)
 	}
 
 	sp.rhidx_ret <- hi
@@ -682,8 +1508,8 @@ func (sp *CephStorageProvider) GetStreamVersion(uuid []byte) uint64 {
 	h := sp.rh[hi]
 
 	data := make([]byte, 8)
-	bc, err := h.GetXattr(oid, "version", data)
-	if err == rados.RadosErrorNotFound {
+	bc, err := sp.getXattr(h, oid, "version", data)
+	if isNotFound(err) {
 		sp.rhidx_ret <- hi
 		return 0
 	}
@@ -711,23 +1537,37 @@ func isValidTagValue(v string) bool {
 	return valsRegex.MatchString(v)
 }
 
-// CreateStream makes a stream with the given uuid, collection and tags. Returns
-// an error if the uuid already exists.
-func (sp *CephStorageProvider) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE {
-	if !isValidCollection(collection) {
-		return bte.Err(bte.InvalidCollection, "Invalid collection name")
+//Create the composite list of tag values and keys used as the omap key
+//in the collection object
+func tagListKey(tags map[string]string) string {
+	tl := make([]string, 0, len(tags))
+	for k, v := range tags {
+		tl = append(tl, fmt.Sprintf("%s@%s@", k, v))
 	}
-	if !sp.cfg.(configprovider.ClusterConfiguration).WeHoldWriteLockFor(uuid) {
-		return bte.Err(bte.WrongEndpoint, "Wrong endpoint for UUID")
+	//Sort it so there is a canonical order
+	sort.Strings(tl)
+	return strings.Join(tl, "")
+}
+
+//Parses the tags back out of a key made by tagListKey. Returns false if the
+//key does not hold whole key value pairs
+func parseTagListKey(key string) (map[string]string, bool) {
+	tmap := make(map[string]string)
+	if key == "" {
+		return tmap, true
 	}
-	if len(annotation) > bprovider.MaxAnnotationSize {
-		return bte.Err(bte.AnnotationTooBig, "Annotation too big")
+	tags := strings.Split(key, "@")
+	tags = tags[:len(tags)-1]
+	if len(tags)%2 != 0 {
+		return nil, false
 	}
-	sp.annotationMu.Lock()
-	defer sp.annotationMu.Unlock()
-
-	aoid := fmt.Sprintf("ann%032x", uuid)
+	for i := 0; i < len(tags); i += 2 {
+		tmap[tags[i]] = tags[i+1]
+	}
+	return tmap, true
+}
 
+func checkTags(tags map[string]string) bte.BTE {
 	for k, v := range tags {
 		if !isValidTagKey(k) {
 			return bte.Err(bte.InvalidTagKey, "Invalid tag key")
@@ -736,36 +1576,41 @@ func (sp *CephStorageProvider) CreateStream(uuid []byte, collection string, tags
 			return bte.Err(bte.InvalidTagValue, "Invalid tag value")
 		}
 	}
+	return nil
+}
 
-	oid := fmt.Sprintf("meta%032x", uuid)
-	hi := sp.GetRH()
-	h := sp.rh[hi]
-	defer func() { sp.rhidx_ret <- hi }()
-	data := make([]byte, 8)
-	bc, err := h.GetXattr(oid, "version", data)
-	if err == nil {
-		return bte.Err(bte.StreamExists, "Stream already exists")
-	} else if err != rados.RadosErrorNotFound {
-		logger.Panicf("ceph error getting version xattr: %v %v", err, bc)
-	}
-
-	//Create the composite list of tag values and keys
-	tl := make([]string, 0, len(tags))
-	for k, v := range tags {
-		tl = append(tl, fmt.Sprintf("%s@%s@", k, v))
+//Returns the uuid of a collection omap entry. An entry too short to hold one
+//is logged and reported as malformed, rather than panicking the listing
+func entryUUID(collection string, key string, val []byte) ([]byte, bool) {
+	if len(val) < 16 {
+		hotlog.Errorf("entry "+collection, "malformed entry %q in collection %q: value is %d bytes", key, collection, len(val))
+		return nil, false
 	}
-	//Sort it so there is a canonical order
-	sort.Strings(tl)
-	tlkey := strings.Join(tl, "")
+	return val[:16], true
+}
 
-	//Check if the stream in collection exists
+//Checks whether a stream already in the collection has tags intersecting
+//tlkey. If uuid is nil, an existing stream with exactly the same tags is
+//reported as SameStream, as it would be if that stream were created again.
+//If own is set, the stream uuid already exists and its entries, such as one
+//left by an earlier failed retag or move, do not collide
+func streamCollision(h *rados.IOContext, collection string, tlkey string, uuid []byte, own bool) bte.BTE {
 	found := false
 	same := false
-	err = h.ListOmapValues("col."+collection, "", tlkey, 10, func(k string, v []byte) {
-		found = true
-		if bytes.Equal(v, uuid) {
-			same = true
+	h.ListOmapValues("col."+collection, "", tlkey, 10, func(k string, v []byte) {
+		if uuid == nil {
+			found = true
+			same = same || k == tlkey
+			return
+		}
+		//A malformed entry still collides, but is never the same stream
+		vuuid, ok := entryUUID(collection, k, v)
+		ours := ok && bytes.Equal(vuuid, uuid)
+		if ours && own {
+			return
 		}
+		found = true
+		same = same || ours
 	})
 	//BUG(mpa) rados returns shitty error here, so just ignore it
 	// if err != nil && err != rados.RadosErrorNotFound {
@@ -778,8 +1623,113 @@ func (sp *CephStorageProvider) CreateStream(uuid []byte, collection string, tags
 			return bte.Err(bte.AmbiguousStream, "A stream exists with intersecting tags")
 		}
 	}
+	return nil
+}
+
+//Runs the same checks as CreateStream for the given collection and tags,
+//without writing anything
+func (sp *CephStorageProvider) ValidateStream(collection string, tags map[string]string) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if !isValidCollection(collection) {
+		return bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	if err := checkTags(tags); err != nil {
+		return err
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	return streamCollision(h, collection, tagListKey(tags), nil, false)
+}
+
+//CheckTagConflicts runs ValidateStream's checks for each of the tag sets in
+//one listing of the collection, returning the error for each set, or nil if
+//it could be created. The sets are checked as though created in order, so a
+//set that collides with an earlier one is reported too
+func (sp *CephStorageProvider) CheckTagConflicts(collection string, tagSets []map[string]string) (_ []bte.BTE, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if !isValidCollection(collection) {
+		return nil, bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	//Omap keys are listed in order, so this is sorted. A missing collection
+	//has no keys, but any other error would hide conflicts
+	keys, err := listOmapKeys(h, "col."+collection)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]bte.BTE, len(tagSets))
+	for i, tags := range tagSets {
+		if err := checkTags(tags); err != nil {
+			rv[i] = err
+			continue
+		}
+		//Like streamCollision, an existing key with this key as a prefix
+		//collides, and is the same stream if equal
+		tlkey := tagListKey(tags)
+		idx := sort.SearchStrings(keys, tlkey)
+		if idx < len(keys) && keys[idx] == tlkey {
+			rv[i] = bte.Err(bte.SameStream, "A stream exists with the same uuid and tags")
+			continue
+		}
+		if idx < len(keys) && strings.HasPrefix(keys[idx], tlkey) {
+			rv[i] = bte.Err(bte.AmbiguousStream, "A stream exists with intersecting tags")
+			continue
+		}
+		keys = append(keys, "")
+		copy(keys[idx+1:], keys[idx:])
+		keys[idx] = tlkey
+	}
+	return rv, nil
+}
+
+// CreateStream makes a stream with the given uuid, collection and tags. Returns
+// an error if the uuid already exists.
+func (sp *CephStorageProvider) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	if !isValidCollection(collection) {
+		return bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	if !sp.cfg.(configprovider.ClusterConfiguration).WeHoldWriteLockFor(uuid) {
+		return bte.Err(bte.WrongEndpoint, "Wrong endpoint for UUID")
+	}
+	if err := sp.checkAnnotationSize(len(annotation)); err != nil {
+		return err
+	}
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	aoid := fmt.Sprintf("ann%032x", uuid)
+
+	if err := checkTags(tags); err != nil {
+		return err
+	}
+
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	data := make([]byte, 8)
+	bc, berr := sp.getXattr(h, oid, "version", data)
+	if berr == nil {
+		return bte.Err(bte.StreamExists, "Stream already exists")
+	} else if !isNotFound(berr) {
+		logger.Panicf("ceph error getting version xattr: %v %v", berr, bc)
+	}
+
+	tlkey := tagListKey(tags)
+
+	//Check if the stream in collection exists
+	if err := streamCollision(h, collection, tlkey, uuid, false); err != nil {
+		return err
+	}
 	//Now create a stream entry in the collection
-	err = h.SetOmap("col."+collection, map[string][]byte{tlkey: uuid})
+	err := h.SetOmap("col."+collection, map[string][]byte{tlkey: uuid})
 	if err != nil {
 		logger.Panicf("ceph error setting tag set: %v", err)
 	}
@@ -791,34 +1741,216 @@ func (sp *CephStorageProvider) CreateStream(uuid []byte, collection string, tags
 	h.WriteFull(aoid, verann)
 
 	//Now note that the collection exists
-	hash := murmur.Murmur3([]byte(collection))
-	partition := hash >> 24
-	err = h.SetOmap(fmt.Sprintf("index.%02x", partition), map[string][]byte{collection: []byte{46}})
+	err = h.SetOmap(indexOid(sp.indexPartition(collection)), map[string][]byte{collection: []byte{46}})
 	if err != nil {
 		logger.Panicf("ceph error setting col index: %v", err)
 	}
 
 	//Set the collection and tags on the uuid
-	err = h.SetXattr(oid, "stream", []byte(fmt.Sprintf("%s;%s", collection, tlkey)))
-	if err != nil {
-		logger.Panicf("ceph error: %v", err)
+	berr = sp.setXattr(h, oid, "stream", []byte(fmt.Sprintf("%s;%s", collection, tlkey)))
+	if berr != nil {
+		logger.Panicf("ceph error: %v", berr)
+	}
+
+	//Record where the stream's objects go, so later route changes do not
+	//move it
+	pools := streamLayout{data: sp.routeCollection(collection), sb: sp.hotPool, sbChecksum: true}
+	berr = sp.setXattr(h, oid, "pool", []byte(pools.data))
+	if berr == nil {
+		berr = sp.setXattr(h, oid, "sbpool", []byte(pools.sb))
+	}
+	if berr == nil {
+		berr = sp.setXattr(h, oid, "sbformat", []byte(SBLOCK_FORMAT_CHECKSUM))
+	}
+	if berr == nil {
+		created := make([]byte, 8)
+		binary.LittleEndian.PutUint64(created, uint64(time.Now().UnixNano()))
+		berr = sp.setXattr(h, oid, "created", created)
+	}
+	if berr != nil {
+		logger.Panicf("ceph error: %v", berr)
 	}
 
 	//As a final step, initialize the stream to version 9
 	binary.LittleEndian.PutUint64(data, bprovider.SpecialVersionCreated)
-	err = h.SetXattr(oid, "version", data)
+	berr = sp.setXattr(h, oid, "version", data)
+	if berr != nil {
+		logger.Panicf("ceph error: %v", berr)
+	}
+	sp.placementMu.Lock()
+	sp.placement[UUIDSliceToArr(uuid)] = pools
+	sp.placementMu.Unlock()
+
+	return nil
+}
+
+// GetStreamCreationTime returns the time the stream was created, or the zero
+// time for streams created before it was recorded.
+func (sp *CephStorageProvider) GetStreamCreationTime(uuid []byte) (_ time.Time, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	data := make([]byte, 8)
+	if _, err := sp.getXattr(h, oid, "version", data); isNotFound(err) {
+		return time.Time{}, bte.Err(bte.NoSuchStream, "Stream does not exist")
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	bc, err := sp.getXattr(h, oid, "created", data)
+	if isNotFound(err) {
+		return time.Time{}, nil
+	}
 	if err != nil {
-		logger.Panicf("ceph error: %v", err)
+		return time.Time{}, err
+	}
+	if bc != 8 {
+		return time.Time{}, bte.Err(bte.StreamEntryCorrupt, "Stream creation time is malformed")
+	}
+	return time.Unix(0, int64(binary.LittleEndian.Uint64(data))), nil
+}
+
+// RetagStream replaces the tags of an existing stream. The new entry is added
+// to the collection before the old one is removed, so if this fails part way
+// the stream is still reachable by its old tags.
+func (sp *CephStorageProvider) RetagStream(uuid []byte, newTags map[string]string) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	if !sp.cfg.(configprovider.ClusterConfiguration).WeHoldWriteLockFor(uuid) {
+		return bte.Err(bte.WrongEndpoint, "Wrong endpoint for UUID")
+	}
+	if err := checkTags(newTags); err != nil {
+		return err
+	}
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+
+	xattrs, err := h.ListXattrs(oid)
+	if err == rados.RadosErrorNotFound {
+		return bte.Err(bte.NoSuchStream, "Stream does not exist")
+	}
+	if err != nil {
+		logger.Panicf("ceph error getting stream xattr: %v", err)
+	}
+	tparts := strings.SplitN(string(xattrs["stream"]), ";", 2)
+	if len(tparts) != 2 {
+		return bte.Err(bte.StreamEntryCorrupt, "Stream collection and tags are malformed")
+	}
+	collection := tparts[0]
+	oldkey := tparts[1]
+	newkey := tagListKey(newTags)
+	if newkey == oldkey {
+		return nil
+	}
+
+	//Same ambiguity check as CreateStream, ignoring our own entry
+	if err := streamCollision(h, collection, newkey, uuid, true); err != nil {
+		return err
+	}
+
+	err = h.SetOmap("col."+collection, map[string][]byte{newkey: uuid})
+	if err != nil {
+		return bte.ErrW(bte.ClusterDegraded, "could not add new tag set", err)
+	}
+	if berr := sp.setXattr(h, oid, "stream", []byte(fmt.Sprintf("%s;%s", collection, newkey))); berr != nil {
+		//Leave the old entry as the only one
+		h.RmOmapKeys("col."+collection, []string{newkey})
+		return berr
 	}
+	err = h.RmOmapKeys("col."+collection, []string{oldkey})
+	if err != nil {
+		logger.Panicf("ceph error removing old tag set: %v", err)
+	}
+	return nil
+}
+
+// MoveStream moves a stream to another collection, keeping its uuid, tags and
+// data, which is keyed by uuid alone. The entry is added to the new collection
+// before the stream xattr is updated and the old entry removed, and if a step
+// fails the earlier ones are undone. The new collection stays in the index
+// either way.
+func (sp *CephStorageProvider) MoveStream(uuid []byte, newCollection string) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	if !isValidCollection(newCollection) {
+		return bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	if !sp.cfg.(configprovider.ClusterConfiguration).WeHoldWriteLockFor(uuid) {
+		return bte.Err(bte.WrongEndpoint, "Wrong endpoint for UUID")
+	}
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
 
+	xattrs, err := h.ListXattrs(oid)
+	if err == rados.RadosErrorNotFound {
+		return bte.Err(bte.NoSuchStream, "Stream does not exist")
+	}
+	if err != nil {
+		logger.Panicf("ceph error getting stream xattr: %v", err)
+	}
+	oldxattr := xattrs["stream"]
+	tparts := strings.SplitN(string(oldxattr), ";", 2)
+	if len(tparts) != 2 {
+		return bte.Err(bte.StreamEntryCorrupt, "Stream collection and tags are malformed")
+	}
+	collection := tparts[0]
+	tlkey := tparts[1]
+	if collection == newCollection {
+		return nil
+	}
+
+	//Same ambiguity check as RetagStream, so an entry left by an earlier
+	//failed move is not a collision
+	if err := streamCollision(h, newCollection, tlkey, uuid, true); err != nil {
+		return err
+	}
+
+	err = h.SetOmap("col."+newCollection, map[string][]byte{tlkey: uuid})
+	if err != nil {
+		return bte.ErrW(bte.ClusterDegraded, "could not add stream to new collection", err)
+	}
+	err = h.SetOmap(indexOid(sp.indexPartition(newCollection)), map[string][]byte{newCollection: []byte{46}})
+	if err != nil {
+		h.RmOmapKeys("col."+newCollection, []string{tlkey})
+		return bte.ErrW(bte.ClusterDegraded, "could not add new collection to the index", err)
+	}
+	if berr := sp.setXattr(h, oid, "stream", []byte(fmt.Sprintf("%s;%s", newCollection, tlkey))); berr != nil {
+		h.RmOmapKeys("col."+newCollection, []string{tlkey})
+		return berr
+	}
+	err = h.RmOmapKeys("col."+collection, []string{tlkey})
+	if err != nil {
+		sp.setXattr(h, oid, "stream", oldxattr)
+		h.RmOmapKeys("col."+newCollection, []string{tlkey})
+		return bte.ErrW(bte.ClusterDegraded, "could not remove stream from old collection", err)
+	}
 	return nil
 }
 
+//The number of collection index entries found in a partition they do not hash to
+var indexMismatches uint64
+
 // ListCollections returns a list of collections beginning with prefix (which may be "")
 // and starting from the given string. Only number many results
 // will be returned. More can be obtained by re-calling ListCollections with
 // a given startingFrom and number.
-func (sp *CephStorageProvider) ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE) {
+func (sp *CephStorageProvider) ListCollections(prefix string, startingFrom string, number int64) (_ []string, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
 	if (prefix != "" && !isValidCollection(prefix)) || (startingFrom != "" && !isValidCollection(startingFrom)) {
 		return nil, bte.Err(bte.InvalidCollection, "Invalid collection name")
 	}
@@ -828,13 +1960,24 @@ func (sp *CephStorageProvider) ListCollections(prefix string, startingFrom strin
 	hi := sp.GetRH()
 	h := sp.rh[hi]
 	rv := []string{}
-	var hash uint32
+	var partition uint32
 	if startingFrom != "" {
-		hash = murmur.Murmur3([]byte(startingFrom))
+		partition = sp.indexPartition(startingFrom)
 	}
-	partition := hash >> 24
 	for {
-		err := h.ListOmapValues(fmt.Sprintf("index.%02x", partition), startingFrom, prefix, number, func(key string, val []byte) {
+		requested := number
+		got := int64(0)
+		last := ""
+		mismatched := 0
+		err := h.ListOmapValues(indexOid(partition), startingFrom, prefix, number, func(key string, val []byte) {
+			got++
+			last = key
+			//Never list a collection from a partition it does not hash to,
+			//or it could be listed twice
+			if sp.indexPartition(key) != partition {
+				mismatched++
+				return
+			}
 			number--
 			rv = append(rv, key)
 		})
@@ -843,6 +1986,15 @@ func (sp *CephStorageProvider) ListCollections(prefix string, startingFrom strin
 		// if err != nil && err != rados.RadosErrorNotFound {
 		// 	logger.Panicf("ceph error %v", err)
 		// }
+		if mismatched > 0 {
+			total := atomic.AddUint64(&indexMismatches, uint64(mismatched))
+			logger.Warningf("skipped %d collections in the wrong index partition %02x (%d total)", mismatched, partition, total)
+			//Skipped entries may have displaced ones we wanted from this partition
+			if got == requested && number > 0 {
+				startingFrom = last
+				continue
+			}
+		}
 		startingFrom = ""
 		partition++
 		if partition > 255 || number == 0 {
@@ -852,23 +2004,82 @@ func (sp *CephStorageProvider) ListCollections(prefix string, startingFrom strin
 	}
 }
 
-func (sp *CephStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, ann []byte) bte.BTE {
-	//We know that we are the only server that is accessing this uuid, so we can
-	//avoid costly distributed locks. But we need to ensure that we do not conflict
-	//with any other requests on the same server
-	sp.annotationMu.Lock()
-	defer sp.annotationMu.Unlock()
+//How many omap entries to fetch per request when counting a collection
+const COUNT_BATCH_SIZE = 1000
 
-	oid := fmt.Sprintf("ann%032x", uuid)
+// ListCollectionsWithCounts pages through collections exactly like ListCollections
+// but also returns the number of streams in each collection. Counting stops
+// at countLimit streams per collection, in which case Exceeded is set.
+func (sp *CephStorageProvider) ListCollectionsWithCounts(prefix string, startingFrom string, number int64, countLimit int64) (_ []bprovider.CollectionCount, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if countLimit < 1 {
+		return nil, bte.Err(bte.InvalidLimit, "Count limit must be > 0")
+	}
+	cols, err := sp.ListCollections(prefix, startingFrom, number)
+	if err != nil {
+		return nil, err
+	}
 	hi := sp.GetRH()
 	h := sp.rh[hi]
 	defer func() { sp.rhidx_ret <- hi }()
+	rv := make([]bprovider.CollectionCount, len(cols))
+	for idx, col := range cols {
+		rv[idx].Collection = col
+		count, exceeded, err := sp.countCollection(h, col, countLimit)
+		if err != nil {
+			return nil, err
+		}
+		rv[idx].Streams = count
+		rv[idx].Exceeded = exceeded
+	}
+	return rv, nil
+}
+
+//Counts the entries in the col.<collection> omap, stopping after limit. The
+//omap values are just the 16 byte uuids so paging through them is cheap. A
+//missing omap object has no entries
+func (sp *CephStorageProvider) countCollection(h *rados.IOContext, collection string, limit int64) (int64, bool, bte.BTE) {
+	var count int64
+	after := ""
+	for {
+		batch := int64(COUNT_BATCH_SIZE)
+		if limit+1-count < batch {
+			batch = limit + 1 - count
+		}
+		got := int64(0)
+		err := h.ListOmapValues("col."+collection, after, "", batch, func(key string, val []byte) {
+			got++
+			after = key
+		})
+		if err := omapListErr(h, "col."+collection, err); err != nil {
+			return 0, false, err
+		}
+		count += got
+		if count > limit {
+			return limit, true, nil
+		}
+		if got < batch {
+			return count, false, nil
+		}
+	}
+}
 
+//Every annotation write is checked against the configured limit
+func (sp *CephStorageProvider) checkAnnotationSize(size int) bte.BTE {
+	if size > sp.maxAnnotation {
+		return bte.ErrF(bte.AnnotationTooBig, "Annotation of %d bytes exceeds the limit of %d", size, sp.maxAnnotation)
+	}
+	return nil
+}
+
+//Reads just the version prefix of the annotation object
+func readAnnotationVersion(h *rados.IOContext, uuid []byte) (uint64, bte.BTE) {
+	oid := fmt.Sprintf("ann%032x", uuid)
 	dat := make([]byte, 8)
 	bc, err := h.Read(oid, dat, 0)
 	if err != nil {
 		if err == rados.RadosErrorNotFound {
-			return bte.Err(bte.NoSuchStream, "Stream does not exist")
+			return 0, bte.Err(bte.NoSuchStream, "Stream does not exist")
 		}
 		//Not 404?
 		logger.Panicf("Unexpected error retrieving annotation object uuid=%v err=%v", uuid, err)
@@ -876,7 +2087,32 @@ func (sp *CephStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, ann
 	if bc != 8 {
 		logger.Panicf("Short read on annotation object uuid=%v bc=%d", uuid, bc)
 	}
-	existingAver := binary.LittleEndian.Uint64(dat)
+	return binary.LittleEndian.Uint64(dat), nil
+}
+
+func (sp *CephStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, ann []byte) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	if err := sp.checkAnnotationSize(len(ann)); err != nil {
+		return err
+	}
+	//We know that we are the only server that is accessing this uuid, so we can
+	//avoid costly distributed locks. But we need to ensure that we do not conflict
+	//with any other requests on the same server
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	oid := fmt.Sprintf("ann%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+
+	existingAver, berr := readAnnotationVersion(h, uuid)
+	if berr != nil {
+		return berr
+	}
 
 	if existingAver != aver && aver != 0 {
 		return bte.Err(bte.AnnotationVersionMismatch, fmt.Sprintf("Stream annotation version is %d, not %d", existingAver, aver))
@@ -886,15 +2122,41 @@ func (sp *CephStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, ann
 	binary.LittleEndian.PutUint64(payload, nextAver)
 	copy(payload[8:], ann)
 
-	err = h.WriteFull(oid, payload)
+	err := h.WriteFull(oid, payload)
 	if err != nil {
 		logger.Panicf("Could not write annotation %v", err)
 	}
 	return nil
 }
 
-// GetStreamAnnotation gets the annotation for a given stream
-func (sp *CephStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64, bte.BTE) {
+//A write at a fixed offset of an object
+type objectWrite struct {
+	offset uint64
+	data   []byte
+}
+
+//The writes that append extra to an annotation object of the given size and
+//set its version prefix to ver. They are at fixed offsets rather than an
+//append, so repeating them after a timeout does not append twice
+func annotationAppendWrites(size uint64, ver uint64, extra []byte) []objectWrite {
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint64(prefix, ver)
+	return []objectWrite{{offset: size, data: extra}, {offset: 0, data: prefix}}
+}
+
+// AppendStreamAnnotation appends to the annotation of a stream rather than
+// rewriting it. The data and the new version prefix are written in one RADOS
+// operation, so a failure cannot leave the data appended under the old
+// version, and the cost does not grow with the size of the annotation
+func (sp *CephStorageProvider) AppendStreamAnnotation(uuid []byte, aver uint64, extra []byte) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	//Catch the obvious case without going to RADOS
+	if err := sp.checkAnnotationSize(len(extra)); err != nil {
+		return err
+	}
 	sp.annotationMu.Lock()
 	defer sp.annotationMu.Unlock()
 
@@ -902,6 +2164,48 @@ func (sp *CephStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64,
 	hi := sp.GetRH()
 	h := sp.rh[hi]
 	defer func() { sp.rhidx_ret <- hi }()
+
+	existingAver, berr := readAnnotationVersion(h, uuid)
+	if berr != nil {
+		return berr
+	}
+	if existingAver != aver && aver != 0 {
+		return bte.Err(bte.AnnotationVersionMismatch, fmt.Sprintf("Stream annotation version is %d, not %d", existingAver, aver))
+	}
+	st, err := h.Stat(oid)
+	if err != nil {
+		logger.Panicf("Could not stat annotation %v", err)
+	}
+	if err := sp.checkAnnotationSize(int(st.Size) - 8 + len(extra)); err != nil {
+		return err
+	}
+	writes := annotationAppendWrites(st.Size, existingAver+1, extra)
+	return sp.retry("annotation append", func() error {
+		op := rados.CreateWriteOp()
+		defer op.Release()
+		for _, w := range writes {
+			op.Write(w.data, w.offset)
+		}
+		return op.Operate(h, oid, rados.OperationNoFlag)
+	})
+}
+
+// GetStreamAnnotation gets the annotation for a given stream
+func (sp *CephStorageProvider) GetStreamAnnotation(uuid []byte) (_ []byte, _ uint64, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	ann, ver := readAnnotation(h, uuid)
+	return ann, ver, nil
+}
+
+//Must be called with annotationMu held
+func readAnnotation(h *rados.IOContext, uuid []byte) ([]byte, uint64) {
+	oid := fmt.Sprintf("ann%032x", uuid)
 	rv := bytes.Buffer{}
 	var off uint64
 	seg := make([]byte, 128*1024)
@@ -918,13 +2222,70 @@ func (sp *CephStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64,
 	}
 	rvarr := rv.Bytes()
 	ver := binary.LittleEndian.Uint64(rvarr[:8])
-	return rvarr[8:], ver, nil
+	return rvarr[8:], ver
+}
+
+//The number of annotations ListStreams reads at once
+const ANNOTATION_FETCH_WORKERS = 8
+
+//Reads the annotations of the listed streams concurrently. Annotation
+//updates wait until all have been read
+func (sp *CephStorageProvider) fetchAnnotations(streams []bprovider.Stream) {
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+	work := make(chan *cephStream, len(streams))
+	for _, s := range streams {
+		work <- s.(*cephStream)
+	}
+	close(work)
+	workers := ANNOTATION_FETCH_WORKERS
+	if len(streams) < workers {
+		workers = len(streams)
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			hi := sp.GetRH()
+			h := sp.rh[hi]
+			defer func() { sp.rhidx_ret <- hi }()
+			for cs := range work {
+				cs.annotation, cs.annver = readAnnotation(h, cs.uuid)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// GetStreamAnnotationVersion gets the version of the annotation for a given
+// stream without reading the annotation itself
+func (sp *CephStorageProvider) GetStreamAnnotationVersion(uuid []byte) (_ uint64, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	sp.annotationMu.Lock()
+	defer sp.annotationMu.Unlock()
+
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	return readAnnotationVersion(h, uuid)
 }
 
 // ListStreams lists all the streams within a collection. If tags are specified
 // then streams are only returned if they have that tag, and the value equals
 // the value passed.
-func (sp *CephStorageProvider) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
+func (sp *CephStorageProvider) ListStreams(collection string, partial bool, tags map[string]string, annotations bool) (_ []bprovider.Stream, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	rv, err := sp.listStreams(collection, partial, tags)
+	if err != nil || !annotations {
+		return rv, err
+	}
+	//The listing's read handle has been returned, so the fetch can use it
+	sp.fetchAnnotations(rv)
+	return rv, nil
+}
+
+func (sp *CephStorageProvider) listStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
 	if !isValidCollection(collection) {
 		return nil, bte.Err(bte.InvalidCollection, "Invalid collection name")
 	}
@@ -942,20 +2303,15 @@ func (sp *CephStorageProvider) ListStreams(collection string, partial bool, tags
 	if partial {
 		rv := []bprovider.Stream{}
 		err := h.ListOmapValues("col."+collection, "", "", 1000000, func(key string, val []byte) {
-			tags := strings.Split(key, "@")
-			if key == "" {
-				tags = []string{}
-			} else {
-				tags = tags[:len(tags)-1]
-			}
-			tmap := make(map[string]string)
-			if len(tags)%2 != 0 {
-				logger.Panicf("Odd tags: %s", key)
+			tmap, ok := parseTagListKey(key)
+			if !ok {
+				hotlog.Errorf("entry "+collection, "malformed entry %q in collection %q: odd number of tag fields", key, collection)
+				return
 			}
-			for i := 0; i < len(tags); i += 2 {
-				tmap[tags[i]] = tags[i+1]
+			uuid, ok := entryUUID(collection, key, val)
+			if !ok {
+				return
 			}
-			uuid := val[:16]
 			rv = append(rv, &cephStream{uuid: uuid, collection: collection, tags: tmap})
 		})
 		if err != nil && err != rados.RadosErrorNotFound {
@@ -983,17 +2339,14 @@ func (sp *CephStorageProvider) ListStreams(collection string, partial bool, tags
 		}
 		srv := []bprovider.Stream{}
 		for k, val := range rv {
-			tags := strings.Split(k, "@")
-			if k == "" {
-				tags = []string{}
-			} else {
-				tags = tags[:len(tags)-1]
+			tmap, ok := parseTagListKey(k)
+			if !ok {
+				return nil, bte.Err(bte.StreamEntryCorrupt, "The stream's collection entry is malformed")
 			}
-			tmap := make(map[string]string)
-			for i := 0; i < len(tags); i += 2 {
-				tmap[tags[i]] = tags[i+1]
+			uuid, ok := entryUUID(collection, k, val)
+			if !ok {
+				return nil, bte.Err(bte.StreamEntryCorrupt, "The stream's collection entry is malformed")
 			}
-			uuid := val[:16]
 			srv = append(srv, &cephStream{uuid: uuid, collection: collection, tags: tmap})
 			break
 		}
@@ -1002,10 +2355,103 @@ func (sp *CephStorageProvider) ListStreams(collection string, partial bool, tags
 
 }
 
+//Returns the sorted set of tag keys used by any stream in the collection.
+//The collection is paged through in batches, so only the set of keys is held
+//in memory, not every stream. Malformed entries are skipped
+func (sp *CephStorageProvider) ListTagKeys(collection string) (_ []string, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if !isValidCollection(collection) {
+		return nil, bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	keys := make(map[string]bool)
+	after := ""
+	for {
+		got := int64(0)
+		err := h.ListOmapValues("col."+collection, after, "", COUNT_BATCH_SIZE, func(key string, val []byte) {
+			got++
+			after = key
+			if _, ok := entryUUID(collection, key, val); !ok {
+				return
+			}
+			//The key is k1@v1@k2@v2@...
+			parts := strings.Split(key, "@")
+			for i := 0; i+1 < len(parts); i += 2 {
+				keys[parts[i]] = true
+			}
+		})
+		if err := collectionListErr(h, collection, err); err != nil {
+			return nil, err
+		}
+		if got < COUNT_BATCH_SIZE {
+			break
+		}
+	}
+	rv := make([]string, 0, len(keys))
+	for k := range keys {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+//Returns true if the collection entry key has every one of the tags
+func entryHasTags(key string, tags map[string]string) bool {
+	//The key is k1@v1@k2@v2@..., and each tag key appears once
+	parts := strings.Split(key, "@")
+	matched := 0
+	for i := 0; i+1 < len(parts); i += 2 {
+		if v, ok := tags[parts[i]]; ok && v == parts[i+1] {
+			matched++
+		}
+	}
+	return matched == len(tags)
+}
+
+//Returns the number of streams in the collection having all of the given
+//tags. The collection is paged through in batches and only the count is
+//kept, no streams are built
+func (sp *CephStorageProvider) CountStreams(collection string, tags map[string]string) (_ int64, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if !isValidCollection(collection) {
+		return 0, bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	if err := checkTags(tags); err != nil {
+		return 0, err
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	var rv int64
+	after := ""
+	for {
+		got := int64(0)
+		err := h.ListOmapValues("col."+collection, after, "", COUNT_BATCH_SIZE, func(key string, val []byte) {
+			got++
+			after = key
+			if _, ok := entryUUID(collection, key, val); ok && entryHasTags(key, tags) {
+				rv++
+			}
+		})
+		if err := collectionListErr(h, collection, err); err != nil {
+			return 0, err
+		}
+		if got < COUNT_BATCH_SIZE {
+			break
+		}
+	}
+	return rv, nil
+}
+
 type cephStream struct {
 	uuid       []byte
 	collection string
 	tags       map[string]string
+	//Only set if listed with annotations
+	annotation []byte
+	annver     uint64
 }
 
 func (cs *cephStream) UUID() []byte {
@@ -1019,3 +2465,7 @@ func (cs *cephStream) Collection() string {
 func (cs *cephStream) Tags() map[string]string {
 	return cs.tags
 }
+
+func (cs *cephStream) Annotation() ([]byte, uint64) {
+	return cs.annotation, cs.annver
+}
@@ -0,0 +1,159 @@
+package cephprovider
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//The most index entries ListCollectionsMatching examines in one call
+const MaxCollectionScan = 10000
+
+//The most wildcards a collection pattern may have
+const MaxPatternWildcards = 8
+
+var collectionGlobRegex = regexp.MustCompile(`^[a-z*?][a-z0-9_.*?]{0,254}$`)
+
+//A compiled collection pattern. Prefix is the literal text before the first
+//wildcard, which the index listing can filter on
+type collectionGlob struct {
+	prefix string
+	re     *regexp.Regexp
+}
+
+//Compiles a collection glob. A * matches any run of characters within one
+//dot separated part of the name, ** matches any run including dots and ?
+//matches one character other than a dot. A pattern must have at least one
+//wildcard and one literal character, and at most MaxPatternWildcards
+//wildcards
+func compileCollectionGlob(pattern string) (*collectionGlob, bte.BTE) {
+	if !collectionGlobRegex.MatchString(pattern) {
+		return nil, bte.Err(bte.InvalidCollection, "Invalid collection pattern")
+	}
+	expr := "^"
+	literal := ""
+	wildcards := 0
+	prefix := ""
+	inPrefix := true
+	for i := 0; i < len(pattern); i++ {
+		var part string
+		switch {
+		case strings.HasPrefix(pattern[i:], "***"):
+			return nil, bte.Err(bte.InvalidCollection, "Collection pattern has more than two * in a row")
+		case strings.HasPrefix(pattern[i:], "**"):
+			part = ".*"
+			i++
+		case pattern[i] == '*':
+			part = "[^.]*"
+		case pattern[i] == '?':
+			part = "[^.]"
+		default:
+			literal += pattern[i : i+1]
+			if inPrefix {
+				prefix += pattern[i : i+1]
+			}
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+			continue
+		}
+		inPrefix = false
+		wildcards++
+		expr += part
+	}
+	if wildcards == 0 {
+		return nil, bte.Err(bte.InvalidCollection, "Collection pattern has no wildcards, use ListCollections")
+	}
+	if literal == "" {
+		return nil, bte.Err(bte.InvalidCollection, "Collection pattern must have a literal character, use ListCollections")
+	}
+	if wildcards > MaxPatternWildcards {
+		return nil, bte.ErrF(bte.InvalidCollection, "Collection pattern has %d wildcards, at most %d are allowed", wildcards, MaxPatternWildcards)
+	}
+	return &collectionGlob{prefix: prefix, re: regexp.MustCompile(expr + "$")}, nil
+}
+
+// ListCollectionsMatching returns up to number collections matching the glob
+// pattern (see compileCollectionGlob), continuing after startingFrom. The
+// index is partitioned by hash, so unless the pattern starts with a literal
+// prefix every entry of all 256 partitions is examined. A call examines at
+// most MaxCollectionScan entries, so it may return fewer than number
+// collections, or none, before the scan is finished. The second result is
+// the startingFrom for the next call, and is "" once every partition has
+// been scanned. Results are in index order, not sorted by name. An error
+// listing a partition is returned rather than the partition being skipped
+func (sp *CephStorageProvider) ListCollectionsMatching(pattern string, startingFrom string, number int64) (_ []string, _ string, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	glob, err := compileCollectionGlob(pattern)
+	if err != nil {
+		return nil, "", err
+	}
+	if startingFrom != "" && !isValidCollection(startingFrom) {
+		return nil, "", bte.Err(bte.InvalidCollection, "Invalid collection name")
+	}
+	if number < 1 {
+		return nil, "", bte.Err(bte.InvalidLimit, "Limit must be > 0")
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	rv := []string{}
+	var partition uint32
+	after := startingFrom
+	if after != "" {
+		partition = sp.indexPartition(after)
+	}
+	scanned := int64(0)
+	for {
+		batch := int64(COUNT_BATCH_SIZE)
+		if MaxCollectionScan-scanned < batch {
+			batch = MaxCollectionScan - scanned
+		}
+		if batch < 1 {
+			batch = 1
+		}
+		got := int64(0)
+		mismatched := 0
+		lerr := h.ListOmapValues(indexOid(partition), after, glob.prefix, batch, func(key string, val []byte) {
+			if int64(len(rv)) == number {
+				return
+			}
+			got++
+			after = key
+			//As in ListCollections, never list a collection from a partition
+			//it does not hash to
+			if sp.indexPartition(key) != partition {
+				mismatched++
+				return
+			}
+			if glob.re.MatchString(key) {
+				rv = append(rv, key)
+			}
+		})
+		//A partition with no collections has no object
+		if err := omapListErr(h, indexOid(partition), lerr); err != nil {
+			return nil, "", err
+		}
+		if mismatched > 0 {
+			total := atomic.AddUint64(&indexMismatches, uint64(mismatched))
+			logger.Warningf("skipped %d collections in the wrong index partition %02x (%d total)", mismatched, partition, total)
+		}
+		scanned += got
+		if int64(len(rv)) == number {
+			return rv, after, nil
+		}
+		if got < batch {
+			after = ""
+			partition++
+			if partition > 255 {
+				return rv, "", nil
+			}
+			continue
+		}
+		//The next call finds its partition by hashing the key it resumes
+		//from, so do not stop on a key in the wrong partition
+		if scanned >= MaxCollectionScan && sp.indexPartition(after) == partition {
+			return rv, after, nil
+		}
+	}
+}
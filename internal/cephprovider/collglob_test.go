@@ -0,0 +1,41 @@
+package cephprovider
+
+import (
+	"testing"
+)
+
+func TestCollectionGlob(t *testing.T) {
+	glob, err := compileCollectionGlob("site.*.voltage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if glob.prefix != "site." {
+		t.Fatalf("expected prefix site., got %q", glob.prefix)
+	}
+	for name, want := range map[string]bool{
+		"site.a1.voltage":    true,
+		"site..voltage":      true,
+		"site.a.b.voltage":   false,
+		"site.a1.voltage2":   false,
+		"other.a1.voltage":   false,
+		"site.a1.current":    false,
+		"xsite.a1.voltage":   false,
+		"site.a1.voltage.l1": false,
+	} {
+		if got := glob.re.MatchString(name); got != want {
+			t.Errorf("%s: expected match %v, got %v", name, want, got)
+		}
+	}
+	glob, err = compileCollectionGlob("**.voltage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if glob.prefix != "" || !glob.re.MatchString("site.a.b.voltage") {
+		t.Fatal("** did not match across parts")
+	}
+	for _, bad := range []string{"", "site.voltage", "*", "**?", "site.***", "Site.*", "site/*", "a*b*c*d*e*f*g*h*i*"} {
+		if _, err := compileCollectionGlob(bad); err == nil {
+			t.Errorf("pattern %q was accepted", bad)
+		}
+	}
+}
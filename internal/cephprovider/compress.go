@@ -0,0 +1,474 @@
+package cephprovider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/golang/snappy"
+)
+
+//The codec is stored in the first byte of every frame
+const CODEC_NONE = 0
+const CODEC_GZIP = 1
+const CODEC_SNAPPY = 2
+
+//codec(1) + offset in object(4) + raw length(4) + compressed length(4)
+const FRAME_HEADER_SIZE = 13
+
+func codecFromName(name string) (byte, error) {
+	switch name {
+	case "", "none":
+		return CODEC_NONE, nil
+	case "gzip":
+		return CODEC_GZIP, nil
+	case "snappy":
+		return CODEC_SNAPPY, nil
+	}
+	return 0, fmt.Errorf("unknown compression codec %q", name)
+}
+
+//Parses the per-pool codecs, each of the form pool:codec
+func parsePoolCodecs(codecs []string) (map[string]byte, error) {
+	rv := make(map[string]byte, len(codecs))
+	for _, c := range codecs {
+		parts := strings.SplitN(c, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("pool compression %q must be of the form pool:codec", c)
+		}
+		codec, err := codecFromName(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rv[parts[0]] = codec
+	}
+	return rv, nil
+}
+
+//Returns the codec data objects in the given pool are compressed with
+func (sp *CephStorageProvider) codecFor(pool string) byte {
+	if codec, ok := sp.poolCodecs[pool]; ok {
+		return codec
+	}
+	return sp.dataCodec
+}
+
+//Compressed data objects are stored under a different name from raw ones, so
+//that objects written before compression was enabled can still be read
+func compressedOid(oid string) string {
+	return "z" + oid
+}
+
+//Compresses a flushed write cache into a frame that is appended to the
+//compressed object. The frame records the offset the data would have had in
+//the raw object, so the addressing is unchanged
+func encodeFrame(codec byte, offset uint64, data []byte) []byte {
+	var payload []byte
+	switch codec {
+	case CODEC_GZIP:
+		buf := bytes.Buffer{}
+		w := gzip.NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+		payload = buf.Bytes()
+	case CODEC_SNAPPY:
+		payload = snappy.Encode(nil, data)
+	default:
+		logger.Panicf("cannot encode frame with codec %d", codec)
+	}
+	rv := make([]byte, FRAME_HEADER_SIZE+len(payload))
+	rv[0] = codec
+	binary.LittleEndian.PutUint32(rv[1:], uint32(offset))
+	binary.LittleEndian.PutUint32(rv[5:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(rv[9:], uint32(len(payload)))
+	copy(rv[FRAME_HEADER_SIZE:], payload)
+	return rv
+}
+
+func decodeFrame(codec byte, payload []byte, rawlen int) ([]byte, error) {
+	var rv []byte
+	var err error
+	switch codec {
+	case CODEC_GZIP:
+		var r *gzip.Reader
+		r, err = gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		rv = make([]byte, rawlen)
+		_, err = io.ReadFull(r, rv)
+	case CODEC_SNAPPY:
+		rv, err = snappy.Decode(nil, payload)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rv) != rawlen {
+		return nil, fmt.Errorf("frame decoded to %d bytes, expected %d", len(rv), rawlen)
+	}
+	return rv, nil
+}
+
+//Every frame of a compressed object is indexed by an omap entry of the
+//object, so a read only fetches the frames that overlap it. The key is the
+//raw offset of the end of the frame in zero padded hex, so listing after an
+//offset starts at the first frame that ends past it. The value is where the
+//frame is in the object, its length and its raw offset, little endian
+const FRAME_INDEX_VALUE_SIZE = 16
+
+//Frame index entries are listed this many at a time
+const FRAME_INDEX_BATCH = 64
+
+//Appends to compressed objects are serialized by one of these, chosen by
+//object name
+const FRAME_LOCKS = 256
+
+func frameIndexKey(end uint64) string {
+	return fmt.Sprintf("%08x", end)
+}
+
+//Where a frame is in a compressed object
+type frameLoc struct {
+	pos    uint64
+	length int
+	foff   uint64
+	rawlen int
+}
+
+func (f frameLoc) key() string {
+	return frameIndexKey(f.foff + uint64(f.rawlen))
+}
+
+func (f frameLoc) value() []byte {
+	rv := make([]byte, FRAME_INDEX_VALUE_SIZE)
+	binary.LittleEndian.PutUint64(rv, f.pos)
+	binary.LittleEndian.PutUint32(rv[8:], uint32(f.length))
+	binary.LittleEndian.PutUint32(rv[12:], uint32(f.foff))
+	return rv
+}
+
+func decodeFrameLoc(key string, val []byte) (frameLoc, bool) {
+	var end uint64
+	if len(val) != FRAME_INDEX_VALUE_SIZE {
+		return frameLoc{}, false
+	}
+	if _, err := fmt.Sscanf(key, "%x", &end); err != nil {
+		return frameLoc{}, false
+	}
+	rv := frameLoc{
+		pos:    binary.LittleEndian.Uint64(val),
+		length: int(binary.LittleEndian.Uint32(val[8:])),
+		foff:   uint64(binary.LittleEndian.Uint32(val[12:])),
+	}
+	if end < rv.foff || rv.length < FRAME_HEADER_SIZE {
+		return frameLoc{}, false
+	}
+	rv.rawlen = int(end - rv.foff)
+	return rv, true
+}
+
+//Calls fn with every frame in buf, which holds the compressed object from
+//pos onwards
+func scanFrames(coid string, buf []byte, pos uint64, fn func(loc frameLoc, codec byte, payload []byte) bte.BTE) bte.BTE {
+	for len(buf) >= FRAME_HEADER_SIZE {
+		codec := buf[0]
+		foff := uint64(binary.LittleEndian.Uint32(buf[1:]))
+		rawlen := int(binary.LittleEndian.Uint32(buf[5:]))
+		clen := int(binary.LittleEndian.Uint32(buf[9:]))
+		if len(buf) < FRAME_HEADER_SIZE+clen {
+			return bte.ErrF(bte.BlockCorrupt, "truncated frame in compressed object %s", coid)
+		}
+		loc := frameLoc{pos: pos, length: FRAME_HEADER_SIZE + clen, foff: foff, rawlen: rawlen}
+		if err := fn(loc, codec, buf[FRAME_HEADER_SIZE:loc.length]); err != nil {
+			return err
+		}
+		buf = buf[loc.length:]
+		pos += uint64(loc.length)
+	}
+	if len(buf) != 0 {
+		return bte.ErrF(bte.BlockCorrupt, "truncated frame in compressed object %s", coid)
+	}
+	return nil
+}
+
+//Decodes a frame into the part of chunk it overlaps. Chunk starts at offset
+//in the raw object. Returns the end of the copied bytes in chunk
+func copyFrame(coid string, chunk []byte, offset uint64, loc frameLoc, codec byte, payload []byte) (int, bte.BTE) {
+	end := offset + uint64(len(chunk))
+	if loc.foff+uint64(loc.rawlen) <= offset || loc.foff >= end {
+		return 0, nil
+	}
+	raw, err := decodeFrame(codec, payload, loc.rawlen)
+	if err != nil {
+		return 0, bte.ErrF(bte.BlockCorrupt, "corrupt frame in compressed object %s: %v", coid, err)
+	}
+	dst := 0
+	if loc.foff < offset {
+		raw = raw[offset-loc.foff:]
+	} else {
+		dst = int(loc.foff - offset)
+	}
+	return dst + copy(chunk[dst:], raw), nil
+}
+
+//Reads length bytes at pos of an object, fewer if it is shorter
+func (sp *CephStorageProvider) readRange(h *rados.IOContext, oid string, pos uint64, length int) ([]byte, bte.BTE) {
+	buf := make([]byte, length)
+	read := 0
+	for read < len(buf) {
+		var rc int
+		err := sp.retry("read", func() error {
+			var err error
+			rc, err = h.Read(oid, buf[read:], pos+uint64(read))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if rc == 0 {
+			break
+		}
+		read += rc
+	}
+	return buf[:read], nil
+}
+
+//Lists the indexed frames of a compressed object that overlap the raw range
+//[offset, end), in the order they were written. Returns nil if the object
+//has no index because it was written before frames were indexed
+func (sp *CephStorageProvider) coveringFrames(h *rados.IOContext, coid string, offset uint64, end uint64) ([]frameLoc, error) {
+	rv := []frameLoc{}
+	after := frameIndexKey(offset)
+	for {
+		got := 0
+		done := false
+		var perr bte.BTE
+		err := h.ListOmapValues(coid, after, "", FRAME_INDEX_BATCH, func(key string, val []byte) {
+			got++
+			after = key
+			if done || perr != nil {
+				return
+			}
+			loc, ok := decodeFrameLoc(key, val)
+			if !ok {
+				perr = bte.ErrF(bte.BlockCorrupt, "frame index entry %q of %s is malformed", key, coid)
+				return
+			}
+			//Every later entry ends after this one, and this starts past the range
+			if loc.foff >= end {
+				done = true
+				return
+			}
+			rv = append(rv, loc)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if perr != nil {
+			return nil, perr
+		}
+		if done || got < FRAME_INDEX_BATCH {
+			break
+		}
+	}
+	if len(rv) == 0 {
+		//Either nothing was written near the range, or there is no index
+		got := 0
+		err := h.ListOmapValues(coid, "", "", 1, func(key string, val []byte) {
+			got++
+		})
+		if err != nil {
+			return nil, err
+		}
+		if got == 0 {
+			return nil, nil
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].pos < rv[j].pos })
+	return rv, nil
+}
+
+//Fills chunk with the raw bytes starting at offset in the compressed form of
+//the given object. Returns false if there is no compressed object, otherwise
+//the number of bytes up to the end of the last frame overlapping the chunk
+func (sp *CephStorageProvider) readCompressedChunk(h *rados.IOContext, oid string, offset uint64, chunk []byte) (int, bool, bte.BTE) {
+	coid := compressedOid(oid)
+	//There may be holes between frames
+	for i := range chunk {
+		chunk[i] = 0
+	}
+	locs, lerr := sp.coveringFrames(h, coid, offset, offset+uint64(len(chunk)))
+	if lerr != nil {
+		//Listing the omap of a missing object is not reported as not found
+		err := sp.retry("stat", func() error {
+			_, err := h.Stat(coid)
+			return err
+		})
+		if isNotFound(err) {
+			return 0, false, nil
+		}
+		if berr, ok := lerr.(bte.BTE); ok {
+			return 0, true, berr
+		}
+		return 0, true, bte.ErrW(bte.ClusterDegraded, "could not list frame index", lerr)
+	}
+	rv := 0
+	apply := func(loc frameLoc, codec byte, payload []byte) bte.BTE {
+		n, err := copyFrame(coid, chunk, offset, loc, codec, payload)
+		if n > rv {
+			rv = n
+		}
+		return err
+	}
+	if locs == nil {
+		//Not indexed, so every frame has to be read
+		var st rados.ObjectStat
+		err := sp.retry("stat", func() error {
+			var err error
+			st, err = h.Stat(coid)
+			return err
+		})
+		if isNotFound(err) {
+			return 0, false, nil
+		}
+		if err != nil {
+			return 0, true, err
+		}
+		buf, berr := sp.readRange(h, coid, 0, int(st.Size))
+		if berr != nil {
+			return 0, true, berr
+		}
+		return rv, true, scanFrames(coid, buf, 0, apply)
+	}
+	//Frames are appended in address order, so the covering frames are
+	//usually contiguous and read together
+	for i := 0; i < len(locs); {
+		j := i + 1
+		length := locs[i].length
+		for j < len(locs) && locs[j].pos == locs[i].pos+uint64(length) {
+			length += locs[j].length
+			j++
+		}
+		buf, err := sp.readRange(h, coid, locs[i].pos, length)
+		if err != nil {
+			return 0, true, err
+		}
+		if len(buf) != length {
+			return 0, true, bte.ErrF(bte.BlockCorrupt, "indexed frame past the end of compressed object %s", coid)
+		}
+		k := i
+		err = scanFrames(coid, buf, locs[i].pos, func(loc frameLoc, codec byte, payload []byte) bte.BTE {
+			if loc != locs[k] {
+				return bte.ErrF(bte.BlockCorrupt, "frame at %d of compressed object %s does not match its index", loc.pos, coid)
+			}
+			k++
+			return apply(loc, codec, payload)
+		})
+		if err != nil {
+			return 0, true, err
+		}
+		i = j
+	}
+	return rv, true, nil
+}
+
+//Appends frames to a compressed object and indexes them in the same
+//operation, so a frame is never without its index entry. Each loc has the raw
+//offset and length of its frame, and is filled in with where the frame was
+//written. Only the segment holding the region of an object writes to it, the
+//lock only orders the flushes of that segment
+func (seg *CephSegment) appendFrames(coid string, frames [][]byte, locs []frameLoc) bte.BTE {
+	sp := seg.sp
+	mu := &sp.framelocks[crc32.ChecksumIEEE([]byte(coid))%FRAME_LOCKS]
+	mu.Lock()
+	defer mu.Unlock()
+	var size uint64
+	err := sp.retry("stat", func() error {
+		st, err := seg.h.Stat(coid)
+		size = st.Size
+		return err
+	})
+	if isNotFound(err) {
+		size, err = 0, nil
+	}
+	if err != nil {
+		return err
+	}
+	index := map[string][]byte{}
+	if size > 0 && !sp.frameIndexed(coid) {
+		//Frames appended before the index was added are indexed now
+		got := 0
+		lerr := seg.h.ListOmapValues(coid, "", "", 1, func(key string, val []byte) {
+			got++
+		})
+		if lerr != nil {
+			return bte.ErrW(bte.ClusterDegraded, "could not list frame index", lerr)
+		}
+		if got == 0 {
+			buf, err := sp.readRange(seg.h, coid, 0, int(size))
+			if err != nil {
+				return err
+			}
+			err = scanFrames(coid, buf, 0, func(loc frameLoc, codec byte, payload []byte) bte.BTE {
+				index[loc.key()] = loc.value()
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	pos := size
+	for i := range locs {
+		locs[i].pos = pos
+		locs[i].length = len(frames[i])
+		index[locs[i].key()] = locs[i].value()
+		pos += uint64(len(frames[i]))
+	}
+	//Unlike an append, a retry rewrites the same bytes
+	err = sp.retry("append", func() error {
+		op := rados.CreateWriteOp()
+		defer op.Release()
+		for i, frame := range frames {
+			op.Write(frame, locs[i].pos)
+		}
+		op.SetOmap(index)
+		return op.Operate(seg.h, coid, rados.OperationNoFlag)
+	})
+	if err != nil {
+		return err
+	}
+	sp.markFrameIndexed(coid)
+	return nil
+}
+
+//Whether a compressed object is known to have a frame index. Once it has
+//one, every later frame is indexed with it
+func (sp *CephStorageProvider) frameIndexed(coid string) bool {
+	sp.frameIndexMu.Lock()
+	defer sp.frameIndexMu.Unlock()
+	return sp.frameIndexSeen[coid]
+}
+
+//Remembers that the object is indexed. The set is dropped when it grows
+//large, which only costs a listing of the next append to each object
+func (sp *CephStorageProvider) markFrameIndexed(coid string) {
+	sp.frameIndexMu.Lock()
+	defer sp.frameIndexMu.Unlock()
+	if sp.frameIndexSeen == nil || len(sp.frameIndexSeen) >= MAX_FRAME_INDEX_SEEN {
+		sp.frameIndexSeen = make(map[string]bool)
+	}
+	sp.frameIndexSeen[coid] = true
+}
+
+//The most compressed objects remembered as indexed
+const MAX_FRAME_INDEX_SEEN = 4096
@@ -0,0 +1,57 @@
+package cephprovider
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+func TestFrameIndex(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, 100)
+	b := bytes.Repeat([]byte{2}, 50)
+	obj := append(encodeFrame(CODEC_SNAPPY, 0, a), encodeFrame(CODEC_GZIP, 200, b)...)
+	locs := []frameLoc{}
+	chunk := make([]byte, 200)
+	end := 0
+	err := scanFrames("zobj", obj, 0, func(loc frameLoc, codec byte, payload []byte) bte.BTE {
+		got, ok := decodeFrameLoc(loc.key(), loc.value())
+		if !ok || got != loc {
+			t.Fatalf("index entry of %+v decoded to %+v", loc, got)
+		}
+		locs = append(locs, loc)
+		n, err := copyFrame("zobj", chunk, 50, loc, codec, payload)
+		if n > end {
+			end = n
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locs) != 2 || locs[1].pos != uint64(locs[0].length) || locs[1].foff != 200 || locs[1].rawlen != 50 {
+		t.Fatalf("unexpected frames %+v", locs)
+	}
+	if end != 200 || chunk[49] != 1 || chunk[50] != 0 || chunk[150] != 2 || chunk[199] != 2 {
+		t.Fatalf("frames were copied to the wrong place, end %d", end)
+	}
+	if err := scanFrames("zobj", obj[:len(obj)-1], 0, func(frameLoc, byte, []byte) bte.BTE { return nil }); err == nil || err.Code() != bte.BlockCorrupt {
+		t.Fatalf("truncated object gave %v", err)
+	}
+}
+
+func TestPoolCodecs(t *testing.T) {
+	codecs, err := parsePoolCodecs([]string{"btrdb-hdd:gzip", "btrdb-ssd:none"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := &CephStorageProvider{dataCodec: CODEC_SNAPPY, poolCodecs: codecs}
+	if sp.codecFor("btrdb-hdd") != CODEC_GZIP || sp.codecFor("btrdb-ssd") != CODEC_NONE || sp.codecFor("btrdb") != CODEC_SNAPPY {
+		t.Fatal("wrong codec for pool")
+	}
+	for _, bad := range []string{"btrdb-hdd", ":gzip", "btrdb-hdd:lz4"} {
+		if _, err := parsePoolCodecs([]string{bad}); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
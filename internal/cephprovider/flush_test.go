@@ -0,0 +1,27 @@
+package cephprovider
+
+import (
+	"testing"
+)
+
+//A flush writes each object once, with its regions in the order they were
+//queued
+func TestGroupByObject(t *testing.T) {
+	uuid := make([]byte, 16)
+	pending := []pendingWrite{
+		{address: 0x1000000, data: []byte{1}},
+		{address: 0x2000000, data: []byte{2}},
+		{address: 0x1000100, data: []byte{3}},
+		{address: PACKED_ADDR_BIT | 0x1000000, data: []byte{4}},
+	}
+	groups := groupByObject(uuid, pending)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 objects, got %d", len(groups))
+	}
+	if len(groups[0]) != 2 || groups[0][0].data[0] != 1 || groups[0][1].data[0] != 3 {
+		t.Fatalf("regions of the first object were not kept in order: %v", groups[0])
+	}
+	if len(groups[1]) != 1 || groups[1][0].data[0] != 2 || len(groups[2]) != 1 || groups[2][0].data[0] != 4 {
+		t.Fatalf("unexpected groups %v", groups)
+	}
+}
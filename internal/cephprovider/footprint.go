@@ -0,0 +1,139 @@
+package cephprovider
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/ceph/go-ceph/rados"
+)
+
+//Sums the sizes of the given objects. Objects that no longer exist are
+//skipped, as they may have been reclaimed since they were found
+func statObjects(h *rados.IOContext, oids []string) (int64, int64, bte.BTE) {
+	var objects, bytes int64
+	for _, oid := range oids {
+		st, err := h.Stat(oid)
+		if err == rados.RadosErrorNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, 0, bte.ErrW(bte.ClusterDegraded, "could not stat object", err)
+		}
+		objects++
+		bytes += int64(st.Size)
+	}
+	return objects, bytes, nil
+}
+
+//Sums the sizes of the metadata, annotation, tombstone and superblock objects
+//of a stream
+func (sp *CephStorageProvider) metadataStats(hi int, uuid []byte, layout streamLayout, version uint64) (int64, int64, bte.BTE) {
+	objects, bytes, err := statObjects(sp.rh[hi], []string{
+		fmt.Sprintf("meta%032x", uuid),
+		fmt.Sprintf("ann%032x", uuid),
+		tombstoneOid(uuid),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	sbs := []string{}
+	for chunk := uint64(0); chunk <= version>>SBLOCK_CHUNK_SHIFT; chunk++ {
+		sbs = append(sbs, fmt.Sprintf("sb%032x%011x", uuid, chunk))
+	}
+	sbo, sbb, err := statObjects(sp.rhFor(hi, layout.sb), sbs)
+	if err != nil {
+		return 0, 0, err
+	}
+	return objects + sbo, bytes + sbb, nil
+}
+
+//StreamStorageStats returns the number of objects and bytes stored in RADOS
+//for the stream: its data objects, raw or compressed, including those only
+//holding old versions, and its metadata, annotation and superblocks. Packed
+//objects are shared with other streams, so they are not counted. It lists
+//the whole data pool, so it is slow
+func (sp *CephStorageProvider) StreamStorageStats(uuid []byte) (_ int64, _ int64, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	version := sp.GetStreamVersion(uuid)
+	if version == 0 {
+		return 0, 0, bte.Err(bte.NoSuchStream, "Stream does not exist")
+	}
+	layout, err := sp.layoutOf(uuid)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi := sp.GetRH()
+	defer func() { sp.rhidx_ret <- hi }()
+	h := sp.rhFor(hi, layout.data)
+
+	prefix := hex.EncodeToString(uuid)
+	oids := []string{}
+	lerr := h.ListObjects(func(oid string) {
+		name := oid
+		if len(name) == 43 && name[0] == 'z' {
+			name = name[1:]
+		}
+		if len(name) == 42 && name[:32] == prefix {
+			oids = append(oids, oid)
+		}
+	})
+	if lerr != nil {
+		return 0, 0, bte.ErrW(bte.ClusterDegraded, "could not list data pool", lerr)
+	}
+	objects, bytes, err := statObjects(h, oids)
+	if err != nil {
+		return 0, 0, err
+	}
+	mo, mb, err := sp.metadataStats(hi, uuid, layout, version)
+	if err != nil {
+		return 0, 0, err
+	}
+	return objects + mo, bytes + mb, nil
+}
+
+//ApproxStreamStorageStats is StreamStorageStats without listing the pool.
+//Only the data objects holding blocks of the current version are counted,
+//found by walking the tree, so objects left over from older versions are
+//missed and the result is a lower bound
+func (sp *CephStorageProvider) ApproxStreamStorageStats(uuid []byte) (_ int64, _ int64, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if sp.walker == nil {
+		return 0, 0, bte.Err(bte.NotImplemented, "no block walker registered")
+	}
+	version := sp.GetStreamVersion(uuid)
+	if version == 0 {
+		return 0, 0, bte.Err(bte.NoSuchStream, "Stream does not exist")
+	}
+	live := make(map[string]bool)
+	err := sp.walker(uuid, version, func(addr uint64) {
+		if addr&PACKED_ADDR_BIT == 0 {
+			live[dataOid(uuid, addr)] = true
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	layout, err := sp.layoutOf(uuid)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi := sp.GetRH()
+	defer func() { sp.rhidx_ret <- hi }()
+	h := sp.rhFor(hi, layout.data)
+
+	//An object is stored raw or compressed, so try both
+	oids := make([]string, 0, 2*len(live))
+	for oid := range live {
+		oids = append(oids, oid, compressedOid(oid))
+	}
+	objects, bytes, err := statObjects(h, oids)
+	if err != nil {
+		return 0, 0, err
+	}
+	mo, mb, err := sp.metadataStats(hi, uuid, layout, version)
+	if err != nil {
+		return 0, 0, err
+	}
+	return objects + mo, bytes + mb, nil
+}
@@ -0,0 +1,216 @@
+package cephprovider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/huichen/murmur"
+)
+
+//How many omap keys to fetch per request when checking the index
+const INDEX_CHECK_BATCH = 1000
+
+//Listing the omap of a missing object fails with an i/o error rather than
+//not found, so the object is checked. Returns nil if the listing failed
+//because the object is missing, otherwise the error
+func omapListErr(h *rados.IOContext, oid string, err error) bte.BTE {
+	if err == nil || err == rados.RadosErrorNotFound {
+		return nil
+	}
+	if _, serr := h.Stat(oid); serr == rados.RadosErrorNotFound {
+		return nil
+	}
+	return bte.ErrW(bte.ClusterDegraded, "could not list omap of "+oid, err)
+}
+
+//Like omapListErr for the omap of a collection, but a missing collection is
+//reported as NoSuchStream
+func collectionListErr(h *rados.IOContext, collection string, err error) bte.BTE {
+	if err == nil {
+		return nil
+	}
+	if lerr := omapListErr(h, "col."+collection, err); lerr != nil {
+		return lerr
+	}
+	return bte.Err(bte.NoSuchStream, "Collection not found")
+}
+
+//Returns every key of an omap. A missing object has no keys
+func listOmapKeys(h *rados.IOContext, oid string) ([]string, bte.BTE) {
+	rv := []string{}
+	after := ""
+	for {
+		got := 0
+		err := h.ListOmapValues(oid, after, "", INDEX_CHECK_BATCH, func(key string, val []byte) {
+			got++
+			after = key
+			rv = append(rv, key)
+		})
+		if err := omapListErr(h, oid, err); err != nil {
+			return nil, err
+		}
+		if got < INDEX_CHECK_BATCH {
+			return rv, nil
+		}
+	}
+}
+
+//Returns true if the collection object has at least one stream
+func hasStreams(h *rados.IOContext, collection string) (bool, bte.BTE) {
+	got := 0
+	err := h.ListOmapValues("col."+collection, "", "", 1, func(key string, val []byte) {
+		got++
+	})
+	if err := omapListErr(h, "col."+collection, err); err != nil {
+		return false, err
+	}
+	return got > 0, nil
+}
+
+func indexOid(partition uint32) string {
+	return fmt.Sprintf("index.%02x", partition)
+}
+
+//The object recording how collections are hashed to index partitions. A
+//database without it uses the original unseeded hash
+const INDEX_FORMAT_OID = "indexfmt"
+
+//Collections are hashed with the seed prepended to their name
+const INDEX_FORMAT_SEEDED = 1
+
+//Reads the index format of the database. Must be called before the read
+//handles are served
+func (sp *CephStorageProvider) loadIndexFormat() {
+	buf := make([]byte, 8)
+	n, err := sp.rh[0].Read(INDEX_FORMAT_OID, buf, 0)
+	if err == rados.RadosErrorNotFound || err == nil && n == 0 {
+		return
+	}
+	if err != nil {
+		logger.Panicf("Could not read the index format: %v", err)
+	}
+	if n != 8 || binary.LittleEndian.Uint32(buf[:4]) != INDEX_FORMAT_SEEDED {
+		logger.Panicf("Unknown index format %x, was the database created by a newer version?", buf[:n])
+	}
+	sp.indexSeeded = true
+	sp.indexSeed = binary.LittleEndian.Uint32(buf[4:])
+}
+
+//Returns the index partition a collection is listed in
+func (sp *CephStorageProvider) indexPartition(collection string) uint32 {
+	if !sp.indexSeeded {
+		return murmur.Murmur3([]byte(collection)) >> 24
+	}
+	key := make([]byte, 4+len(collection))
+	binary.LittleEndian.PutUint32(key, sp.indexSeed)
+	copy(key[4:], collection)
+	return murmur.Murmur3(key) >> 24
+}
+
+//VerifyCollectionIndex cross-checks the collection index against the
+//collection objects, returning a description of each discrepancy: a
+//collection with streams but no index entry, an index entry for a
+//collection with no streams, and an index entry in a partition the
+//collection does not hash to. It lists the whole data pool, so it is slow
+func (sp *CephStorageProvider) VerifyCollectionIndex() (_ []string, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	return sp.checkCollectionIndex(false)
+}
+
+//RepairCollectionIndex rebuilds the collection index from the collection
+//objects, fixing the discrepancies VerifyCollectionIndex reports, which are
+//returned. CreateStream writes the collection object before the index
+//entry, so running this alongside stream creation is safe
+func (sp *CephStorageProvider) RepairCollectionIndex() (_ []string, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return nil, err
+	}
+	return sp.checkCollectionIndex(true)
+}
+
+func (sp *CephStorageProvider) checkCollectionIndex(repair bool) ([]string, bte.BTE) {
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+
+	//Collections that have at least one stream
+	collections := make(map[string]bool)
+	var names []string
+	lerr := h.ListObjects(func(oid string) {
+		if strings.HasPrefix(oid, "col.") {
+			names = append(names, oid[len("col."):])
+		}
+	})
+	if lerr != nil {
+		return nil, bte.ErrW(bte.ClusterDegraded, "could not list data pool", lerr)
+	}
+	for _, c := range names {
+		has, err := hasStreams(h, c)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			collections[c] = true
+		}
+	}
+
+	rv := []string{}
+	indexed := make(map[string]bool)
+	for partition := uint32(0); partition < 256; partition++ {
+		var remove []string
+		keys, err := listOmapKeys(h, indexOid(partition))
+		if err != nil {
+			//A partial listing would have a repair drop good entries
+			return rv, err
+		}
+		for _, c := range keys {
+			want := sp.indexPartition(c)
+			//The collection may have been created since the pool was listed
+			if !collections[c] {
+				has, err := hasStreams(h, c)
+				if err != nil {
+					return rv, err
+				}
+				if has {
+					collections[c] = true
+				}
+			}
+			switch {
+			case !collections[c]:
+				rv = append(rv, fmt.Sprintf("index entry %q in partition %02x has no streams", c, partition))
+				remove = append(remove, c)
+			case want != partition:
+				rv = append(rv, fmt.Sprintf("index entry %q is in partition %02x, not %02x", c, partition, want))
+				remove = append(remove, c)
+			default:
+				indexed[c] = true
+			}
+		}
+		if repair && len(remove) > 0 {
+			if err := h.RmOmapKeys(indexOid(partition), remove); err != nil {
+				return rv, bte.ErrW(bte.ClusterDegraded, "could not remove index entries", err)
+			}
+		}
+	}
+	for c := range collections {
+		if indexed[c] {
+			continue
+		}
+		partition := sp.indexPartition(c)
+		rv = append(rv, fmt.Sprintf("collection %q has no index entry in partition %02x", c, partition))
+		if repair {
+			err := h.SetOmap(indexOid(partition), map[string][]byte{c: []byte{46}})
+			if err != nil {
+				return rv, bte.ErrW(bte.ClusterDegraded, "could not add index entry", err)
+			}
+		}
+	}
+	if repair && len(rv) > 0 {
+		logger.Warningf("repaired %d collection index discrepancies", len(rv))
+	}
+	return rv, nil
+}
@@ -0,0 +1,77 @@
+package cephprovider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//A message logged from a hot path is repeated at most once per interval
+const LOG_THROTTLE_INTERVAL = 10 * time.Second
+
+//If more keys than this are being throttled, they are all forgotten
+const LOG_THROTTLE_KEYS = 4096
+
+//Rate limits log messages that can repeat for every read or entry, such as
+//those about a corrupt stream. The first message for a key is always logged,
+//later ones at most once per interval with a count of those suppressed
+type logThrottle struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+func newLogThrottle(interval time.Duration) *logThrottle {
+	return &logThrottle{
+		interval:   interval,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+var hotlog = newLogThrottle(LOG_THROTTLE_INTERVAL)
+
+//Returns true if a message for the key should be logged now, and how many
+//were suppressed since the last one that was
+func (lt *logThrottle) allow(key string) (bool, int) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	now := time.Now()
+	if last, ok := lt.last[key]; ok && now.Sub(last) < lt.interval {
+		lt.suppressed[key]++
+		return false, 0
+	}
+	if len(lt.last) >= LOG_THROTTLE_KEYS {
+		lt.last = make(map[string]time.Time)
+		lt.suppressed = make(map[string]int)
+	}
+	n := lt.suppressed[key]
+	delete(lt.suppressed, key)
+	lt.last[key] = now
+	return true, n
+}
+
+func (lt *logThrottle) format(key string, format string, args []interface{}) (string, bool) {
+	ok, n := lt.allow(key)
+	if !ok {
+		return "", false
+	}
+	msg := fmt.Sprintf(format, args...)
+	if n > 0 {
+		msg = fmt.Sprintf("%s (%d similar suppressed)", msg, n)
+	}
+	return msg, true
+}
+
+func (lt *logThrottle) Errorf(key string, format string, args ...interface{}) {
+	if msg, ok := lt.format(key, format, args); ok {
+		logger.Error(msg)
+	}
+}
+
+func (lt *logThrottle) Warningf(key string, format string, args ...interface{}) {
+	if msg, ok := lt.format(key, format, args); ok {
+		logger.Warning(msg)
+	}
+}
@@ -0,0 +1,25 @@
+package cephprovider
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogThrottle(t *testing.T) {
+	lt := newLogThrottle(time.Hour)
+	if ok, _ := lt.allow("a"); !ok {
+		t.Fatal("first message was suppressed")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := lt.allow("a"); ok {
+			t.Fatal("repeated message was not suppressed")
+		}
+	}
+	if ok, _ := lt.allow("b"); !ok {
+		t.Fatal("message for another key was suppressed")
+	}
+	lt.last["a"] = time.Now().Add(-2 * time.Hour)
+	if ok, n := lt.allow("a"); !ok || n != 3 {
+		t.Fatalf("expected the message after the interval with 3 suppressed, got %v %d", ok, n)
+	}
+}
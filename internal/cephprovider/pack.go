@@ -0,0 +1,193 @@
+package cephprovider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//Regions of the address space given to packed segments have this bit set.
+//It is far above any address the allocator will reach and below the
+//block store's relocation addresses. Whether an address is packed is
+//decided by the address alone, so streams can move in and out of packing
+//without their existing data moving
+const PACKED_ADDR_BIT = 1 << 61
+
+//The number of packed segments small streams in a pool are spread over
+const PACK_BUCKETS = 16
+
+//If more streams than this have their writes tracked, the counts are reset
+const PACK_TRACKED_STREAMS = 1 << 20
+
+//Streams in a bucket of a pool share packed segments
+type packKey struct {
+	pool   string
+	bucket uint8
+}
+
+func packBucket(uuid []byte) uint8 {
+	return uuid[15] % PACK_BUCKETS
+}
+
+//Returns the object holding the given address of a stream. The object of an
+//unpacked address belongs to the stream, the object of a packed one is
+//shared by every stream in the bucket that wrote to that region
+func dataOid(uuid []byte, address uint64) string {
+	if address&PACKED_ADDR_BIT != 0 {
+		return fmt.Sprintf("pk%02x%010x", packBucket(uuid), (address&^PACKED_ADDR_BIT)>>24)
+	}
+	return fmt.Sprintf("%032x%010x", uuid, address>>24)
+}
+
+//The bytes a stream has written are kept in this xattr of its meta object
+//until they reach the pack threshold, so packing survives a restart
+const PACK_WRITTEN_XATTR = "written"
+
+//Returns the bytes the stream has written, loading them from its meta object
+//if they are not tracked
+func (sp *CephStorageProvider) packWrittenOf(uid [16]byte) uint64 {
+	sp.packMu.Lock()
+	n, ok := sp.packWritten[uid]
+	sp.packMu.Unlock()
+	if ok {
+		return n
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	data := make([]byte, 8)
+	bc, err := sp.getXattr(h, fmt.Sprintf("meta%032x", uid[:]), PACK_WRITTEN_XATTR, data)
+	sp.rhidx_ret <- hi
+	switch {
+	case err == nil && bc == 8:
+		n = binary.LittleEndian.Uint64(data)
+	case err != nil && !isNotFound(err):
+		//Packing is only an optimization, so the count is not fatal
+		hotlog.Warningf("pack written", "could not read bytes written by %x: %v", uid, err)
+	}
+	sp.packMu.Lock()
+	defer sp.packMu.Unlock()
+	if cur, ok := sp.packWritten[uid]; ok {
+		return cur
+	}
+	if len(sp.packWritten) >= PACK_TRACKED_STREAMS {
+		sp.packWritten = make(map[[16]byte]uint64)
+	}
+	sp.packWritten[uid] = n
+	return n
+}
+
+//Returns true if the stream has written less than the pack threshold, so its
+//segments should be packed
+func (sp *CephStorageProvider) shouldPack(uid [16]byte) bool {
+	if sp.packThreshold == 0 {
+		return false
+	}
+	return sp.packWrittenOf(uid) < sp.packThreshold
+}
+
+//Adds to the bytes the stream has written. Once the count passes the pack
+//threshold it no longer matters, so it is only stored while it is below
+func (sp *CephStorageProvider) recordWritten(uid [16]byte, n uint64) {
+	if sp.packThreshold == 0 || n == 0 {
+		return
+	}
+	old := sp.packWrittenOf(uid)
+	sp.packMu.Lock()
+	if cur, ok := sp.packWritten[uid]; ok {
+		old = cur
+	}
+	sp.packWritten[uid] = old + n
+	sp.packMu.Unlock()
+	if old >= sp.packThreshold {
+		return
+	}
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, old+n)
+	if err := sp.setXattr(h, fmt.Sprintf("meta%032x", uid[:]), PACK_WRITTEN_XATTR, data); err != nil {
+		hotlog.Warningf("pack written", "could not store bytes written by %x: %v", uid, err)
+	}
+}
+
+//Packed objects are shared, so each has an xattr for every stream that
+//wrote to it, which ReclaimUnreferenced removes. The reference is added
+//before the data is written, so data in a packed object always has one
+func packRefXattr(uuid []byte) string {
+	return fmt.Sprintf("ref%032x", uuid)
+}
+
+//Adds the stream's reference to the packed objects of the pending writes,
+//skipping those it has already added
+func (seg *CephSegment) addPackRefs(pending []pendingWrite) bte.BTE {
+	for _, pw := range pending {
+		if pw.address&PACKED_ADDR_BIT == 0 {
+			continue
+		}
+		oid := dataOid(seg.uid[:], pw.address)
+		if seg.sp.codecFor(seg.pool) != CODEC_NONE {
+			oid = compressedOid(oid)
+		}
+		if seg.packrefs[oid] {
+			continue
+		}
+		if err := seg.sp.setXattr(seg.h, oid, packRefXattr(seg.uid[:]), []byte{1}); err != nil {
+			return err
+		}
+		if seg.packrefs == nil {
+			seg.packrefs = make(map[string]bool)
+		}
+		seg.packrefs[oid] = true
+	}
+	return nil
+}
+
+//Returns the address to start a newly allocated region at
+func (seg *CephSegment) region(addr uint64) uint64 {
+	if seg.packed {
+		return addr | PACKED_ADDR_BIT
+	}
+	return addr
+}
+
+//Looks up where the segment can continue from, removing the entry if take
+//is set. An expired entry is removed and not returned. Must be called with
+//the segcache lock held
+func (sp *CephStorageProvider) cachedSegment(seg *CephSegment, take bool) (segcacheEntry, bool) {
+	if seg.packed {
+		k := packKey{pool: seg.pool, bucket: packBucket(seg.uid[:])}
+		e, ok := sp.packcache[k]
+		if ok && sp.segcacheExpired(e, time.Now()) {
+			delete(sp.packcache, k)
+			return segcacheEntry{}, false
+		}
+		if ok && take {
+			delete(sp.packcache, k)
+		}
+		return e, ok
+	}
+	e, ok := sp.segaddrcache[seg.uid]
+	if ok && sp.segcacheExpired(e, time.Now()) {
+		delete(sp.segaddrcache, seg.uid)
+		return segcacheEntry{}, false
+	}
+	if ok && take {
+		delete(sp.segaddrcache, seg.uid)
+	}
+	return e, ok
+}
+
+//Remembers where the segment can continue from. Must be called with the
+//segcache lock held
+func (sp *CephStorageProvider) cacheSegment(seg *CephSegment, e segcacheEntry) {
+	if seg.packed {
+		//There are at most PACK_BUCKETS entries per pool, so no pruning
+		sp.packcache[packKey{pool: seg.pool, bucket: packBucket(seg.uid[:])}] = e
+		return
+	}
+	sp.pruneSegCache()
+	sp.segaddrcache[seg.uid] = e
+}
@@ -0,0 +1,237 @@
+package cephprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/ceph/go-ceph/rados"
+)
+
+//A prefix of collection names whose streams are placed in a pool
+type poolRoute struct {
+	prefix string
+	pool   string
+}
+
+//Where and how a stream's objects are stored. Streams created before routing
+//was added have no pools recorded and live entirely in the data pool, and
+//streams created before superblock checksums have none
+type streamLayout struct {
+	data string
+	sb   string
+	//If true the stream's superblocks are followed by a checksum
+	sbChecksum bool
+}
+
+//The longest namespace allowed
+const MAX_NAMESPACE_LEN = 64
+
+//Namespaces are restricted to characters that are safe in object names and
+//config files
+func checkNamespace(ns string) error {
+	if len(ns) > MAX_NAMESPACE_LEN {
+		return fmt.Errorf("namespace %q is longer than %d characters", ns, MAX_NAMESPACE_LEN)
+	}
+	for _, c := range ns {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("namespace %q may only contain letters, digits, '-', '_' and '.'", ns)
+		}
+	}
+	return nil
+}
+
+func parsePoolRoutes(routes []string) ([]poolRoute, error) {
+	rv := make([]poolRoute, 0, len(routes))
+	for _, r := range routes {
+		parts := strings.SplitN(r, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("pool route %q must be of the form prefix:pool", r)
+		}
+		rv = append(rv, poolRoute{prefix: parts[0], pool: parts[1]})
+	}
+	return rv, nil
+}
+
+//Returns the pool the data of a new stream in the given collection goes to
+func (sp *CephStorageProvider) routeCollection(collection string) string {
+	rv := sp.dataPool
+	best := -1
+	for _, r := range sp.routes {
+		if strings.HasPrefix(collection, r.prefix) && len(r.prefix) > best {
+			rv = r.pool
+			best = len(r.prefix)
+		}
+	}
+	return rv
+}
+
+//The free handle indices of a pool. They are queued in idx and returned to
+//ret
+type handleQueue struct {
+	idx   chan int
+	ret   chan int
+	avail []bool
+}
+
+func newHandleQueue(n int) *handleQueue {
+	rv := &handleQueue{
+		idx:   make(chan int, n+1),
+		ret:   make(chan int, n+1),
+		avail: make([]bool, n),
+	}
+	for i := range rv.avail {
+		rv.avail[i] = true
+	}
+	return rv
+}
+
+//Opens NUM_RHANDLES read and NUM_WHANDLES write contexts on every pool that
+//may be used, all in the configured namespace. The read contexts for a pool
+//are indexed like rh, so a handle index taken from rhidx may be used with any
+//pool. Write handles are taken from the pool's own queue. A read only
+//provider opens no write contexts. Pools that are no longer configured but
+//still hold streams are opened by layoutOf when they are first used
+func (sp *CephStorageProvider) openPools() {
+	sp.prh = make(map[string][]*rados.IOContext)
+	sp.pwh = make(map[string][]*rados.IOContext)
+	sp.pwhq = make(map[string]*handleQueue)
+	pools := []string{sp.dataPool, sp.hotPool}
+	for _, r := range sp.routes {
+		pools = append(pools, r.pool)
+	}
+	for _, pool := range pools {
+		if err := sp.openPool(pool); err != nil {
+			logger.Panicf("Could not open CEPH pool %s: %v", pool, err)
+		}
+	}
+	sp.rh = sp.prh[sp.dataPool]
+	sp.wh = sp.pwh[sp.dataPool]
+}
+
+//Opens the contexts of a pool unless it is open already. If the write
+//handles are already being provided, the new pool's are too
+func (sp *CephStorageProvider) openPool(pool string) bte.BTE {
+	sp.poolMu.Lock()
+	defer sp.poolMu.Unlock()
+	if _, ok := sp.prh[pool]; ok {
+		return nil
+	}
+	open := func(n int) ([]*rados.IOContext, bte.BTE) {
+		rv := make([]*rados.IOContext, n)
+		for i := range rv {
+			h, err := sp.conn.OpenIOContext(pool)
+			if err != nil {
+				for _, o := range rv[:i] {
+					o.Destroy()
+				}
+				return nil, bte.ErrW(bte.ClusterDegraded, "could not open pool "+pool, err)
+			}
+			h.SetNamespace(sp.namespace)
+			rv[i] = h
+		}
+		return rv, nil
+	}
+	rh, err := open(NUM_RHANDLES)
+	if err != nil {
+		return err
+	}
+	if !sp.readOnly {
+		wh, err := open(NUM_WHANDLES)
+		if err != nil {
+			for _, o := range rh {
+				o.Destroy()
+			}
+			return err
+		}
+		sp.pwh[pool] = wh
+		sp.pwhq[pool] = newHandleQueue(NUM_WHANDLES)
+		if sp.providingWH {
+			go sp.pwhq[pool].provide()
+		}
+	}
+	sp.prh[pool] = rh
+	return nil
+}
+
+//Returns the read context on the given pool for a handle index from rhidx.
+//The pool must have been opened, which layoutOf does for a stream's pools
+func (sp *CephStorageProvider) rhFor(hi int, pool string) *rados.IOContext {
+	sp.poolMu.RLock()
+	rv, ok := sp.prh[pool]
+	sp.poolMu.RUnlock()
+	if !ok {
+		invariantf("pool %s was used before it was opened", pool)
+	}
+	return rv[hi]
+}
+
+//Returns the write handle queue of the given pool
+func (sp *CephStorageProvider) writeHandles(pool string) *handleQueue {
+	sp.poolMu.RLock()
+	rv, ok := sp.pwhq[pool]
+	sp.poolMu.RUnlock()
+	if !ok {
+		invariantf("pool %s was used before it was opened", pool)
+	}
+	return rv
+}
+
+//Returns the write context on the given pool for a handle index taken from
+//the pool's queue
+func (sp *CephStorageProvider) whFor(hi int, pool string) *rados.IOContext {
+	sp.poolMu.RLock()
+	rv, ok := sp.pwh[pool]
+	sp.poolMu.RUnlock()
+	if !ok {
+		invariantf("pool %s was used before it was opened", pool)
+	}
+	return rv[hi]
+}
+
+//Returns the pools of the given stream, opening any that are not open yet.
+//This takes a read handle, so it must not be called while holding one
+func (sp *CephStorageProvider) layoutOf(uuid []byte) (streamLayout, bte.BTE) {
+	id := UUIDSliceToArr(uuid)
+	sp.placementMu.Lock()
+	rv, ok := sp.placement[id]
+	sp.placementMu.Unlock()
+	if ok {
+		return rv, nil
+	}
+	rv = streamLayout{data: sp.dataPool, sb: sp.dataPool}
+	oid := fmt.Sprintf("meta%032x", uuid)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	xattrs, err := h.ListXattrs(oid)
+	sp.rhidx_ret <- hi
+	if err == rados.RadosErrorNotFound {
+		//Not cached, as the stream may yet be created by another node
+		return rv, nil
+	}
+	if err != nil {
+		return rv, bte.ErrW(bte.ClusterDegraded, "could not read stream layout", err)
+	}
+	if p, ok := xattrs["pool"]; ok {
+		rv.data = string(p)
+	}
+	if p, ok := xattrs["sbpool"]; ok {
+		rv.sb = string(p)
+	}
+	if f, ok := xattrs["sbformat"]; ok {
+		if string(f) != SBLOCK_FORMAT_CHECKSUM {
+			return rv, bte.ErrF(bte.StreamEntryCorrupt, "stream %x has unknown superblock format %q", uuid, f)
+		}
+		rv.sbChecksum = true
+	}
+	//The stream may be in a pool that has since been removed from the routes
+	for _, pool := range []string{rv.data, rv.sb} {
+		if err := sp.openPool(pool); err != nil {
+			return rv, err
+		}
+	}
+	sp.placementMu.Lock()
+	sp.placement[id] = rv
+	sp.placementMu.Unlock()
+	return rv, nil
+}
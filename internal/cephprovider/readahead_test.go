@@ -0,0 +1,99 @@
+package cephprovider
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+)
+
+const testChunkSize = 16
+
+//A provider with only a read cache, holding the given chunks
+func cacheOnlyProvider(chunks map[uint64][]byte) *CephStorageProvider {
+	rc := &CephCache{
+		cachemax:   64,
+		cachemap:   make(map[uint64]*CacheItem),
+		chunksize:  testChunkSize,
+		offsetmask: testChunkSize - 1,
+		addrmask:   ^uint64(testChunkSize - 1),
+		pool:       &sync.Pool{New: func() interface{} { return make([]byte, testChunkSize) }},
+	}
+	for addr, chunk := range chunks {
+		rc.cachePut(addr, chunk)
+	}
+	excludemap = make(map[uint64]bool)
+	return &CephStorageProvider{
+		rcache:        rc,
+		chunkgate:     make(map[chunkreqindex][]chan chunkResult),
+		fetchsem:      make(chan struct{}, 1),
+		regionSize:    4 * testChunkSize,
+		maxObjectSize: 1024,
+	}
+}
+
+func TestSequentialScanHint(t *testing.T) {
+	ctx := context.Background()
+	if bprovider.IsSequentialScan(ctx) {
+		t.Fatal("plain context is a scan")
+	}
+	scan, cancel := context.WithCancel(bprovider.WithSequentialScan(ctx))
+	defer cancel()
+	if !bprovider.IsSequentialScan(scan) {
+		t.Fatal("scan hint was lost")
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	uuid := make([]byte, 16)
+	sp := cacheOnlyProvider(map[uint64][]byte{testChunkSize: make([]byte, testChunkSize)})
+	inflight := chunkreqindex{UUID: UUIDSliceToArr(uuid), Addr: 2 * testChunkSize}
+	sp.chunkgate[inflight] = []chan chunkResult{}
+	//Disabled
+	sp.Prefetch(uuid, 0)
+	//Packed addresses belong to other streams
+	sp.readAhead = 3
+	sp.Prefetch(uuid, PACKED_ADDR_BIT)
+	//The last chunk of a region
+	sp.Prefetch(uuid, 3*testChunkSize)
+	if len(sp.chunkgate) != 1 || len(sp.fetchsem) != 0 {
+		t.Fatal("prefetch read a chunk it should not have")
+	}
+	//The next chunk is cached and the one after is being read, so only the
+	//third is wanted, and there is no place free to read it
+	sp.fetchsem <- struct{}{}
+	sp.Prefetch(uuid, 0)
+	if len(sp.chunkgate) != 1 {
+		t.Fatal("prefetch waited for a place in fetchsem")
+	}
+}
+
+func TestReadBudgetedBounds(t *testing.T) {
+	uuid := make([]byte, 16)
+	chunk0 := make([]byte, testChunkSize)
+	chunk0[testChunkSize-1] = 4
+	sp := cacheOnlyProvider(map[uint64][]byte{
+		0:             chunk0,
+		testChunkSize: {0, 1, 2, 3, 4},
+		//A short chunk, where the written data ends
+		2 * testChunkSize: {2, 0, 9, 9},
+	})
+	buf := make([]byte, 1024)
+	got, err := sp.ReadBudgeted(context.Background(), uuid, testChunkSize-1, buf, nil)
+	if err != nil || len(got) != 4 || got[0] != 1 || got[3] != 4 {
+		t.Fatalf("read across chunks gave %v, %v", got, err)
+	}
+	for _, addr := range []uint64{2*testChunkSize + 4, 2*testChunkSize + 8} {
+		if _, err := sp.ReadBudgeted(context.Background(), uuid, addr, buf, nil); err == nil || err.Code() != bte.BlockCorrupt {
+			t.Fatalf("read at 0x%x past the written data gave %v", addr, err)
+		}
+	}
+	//The second byte of the length is in a chunk with nothing written
+	sp.rcache.cachePut(3*testChunkSize, chunk0)
+	sp.rcache.cachePut(4*testChunkSize, []byte{})
+	if _, err := sp.ReadBudgeted(context.Background(), uuid, 4*testChunkSize-1, buf, nil); err == nil || err.Code() != bte.BlockCorrupt {
+		t.Fatalf("read of a truncated length gave %v", err)
+	}
+}
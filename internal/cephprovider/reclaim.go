@@ -0,0 +1,173 @@
+package cephprovider
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+	"golang.org/x/net/context"
+)
+
+//Objects modified more recently than this are never reclaimed, as they may
+//belong to a write that has not yet committed its superblock
+const RECLAIM_GRACE = 1 * time.Hour
+
+//The number of objects deleted between checks that the stream has not moved on
+const RECLAIM_BATCH = 64
+
+func (sp *CephStorageProvider) SetBlockWalker(w bprovider.BlockWalker) {
+	sp.walker = w
+}
+
+//Deletes the data objects of a stream that hold no blocks reachable from
+//keepVersion, which must be the current version of the stream (i.e. the
+//stream must already have been rolled back with SetStreamVersion). All other
+//versions of the stream become unreadable.
+//
+//Packed objects are shared by the streams of a bucket, so the stream's
+//reference is removed from each one it no longer uses, and the object is only
+//deleted once it has no references left. Packed objects written before
+//references were recorded have none, and are never deleted.
+//
+//This is never run automatically. It lists the whole data pool, so it is slow,
+//but it can be aborted at any point by cancelling the context: only objects
+//found to be unreferenced are deleted, and it stops if the stream version
+//changes underneath it. Returns the number of objects deleted.
+func (sp *CephStorageProvider) ReclaimUnreferenced(ctx context.Context, uuid []byte, keepVersion uint64) (_ int, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return 0, err
+	}
+	if sp.walker == nil {
+		return 0, bte.Err(bte.NotImplemented, "no block walker registered")
+	}
+	if sp.GetStreamVersion(uuid) != keepVersion {
+		return 0, bte.Err(bte.WrongArgs, "keepVersion must be the current stream version")
+	}
+	started := time.Now()
+
+	//Mark
+	live := make(map[uint64]bool)
+	err := sp.walker(uuid, keepVersion, func(addr uint64) {
+		live[addr>>24] = true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if ctx.Err() != nil {
+		return 0, bte.CtxE(ctx)
+	}
+
+	layout, err := sp.layoutOf(uuid)
+	if err != nil {
+		return 0, err
+	}
+	pool := layout.data
+	hi := sp.GetRH()
+	h := sp.rhFor(hi, pool)
+	defer func() {
+		sp.rhidx_ret <- hi
+	}()
+
+	//Find this stream's data objects, raw or compressed, and the packed
+	//objects of its bucket
+	prefix := hex.EncodeToString(uuid)
+	pkprefix := fmt.Sprintf("pk%02x", packBucket(uuid))
+	candidates := []string{}
+	packed := []string{}
+	lerr := h.ListObjects(func(oid string) {
+		name := oid
+		if len(name) > 0 && name[0] == 'z' {
+			name = name[1:]
+		}
+		if len(name) == 14 && name[:4] == pkprefix {
+			aa, err := strconv.ParseUint(name[4:], 16, 64)
+			if err != nil || live[aa|PACKED_ADDR_BIT>>24] {
+				return
+			}
+			packed = append(packed, oid)
+			return
+		}
+		if len(name) != 42 || name[:32] != prefix {
+			return
+		}
+		aa, err := strconv.ParseUint(name[32:], 16, 64)
+		if err != nil || live[aa] {
+			return
+		}
+		candidates = append(candidates, oid)
+	})
+	if lerr != nil {
+		return 0, bte.ErrW(bte.ClusterDegraded, "could not list data pool", lerr)
+	}
+
+	//Sweep
+	deleted := 0
+	for i, oid := range candidates {
+		if i%RECLAIM_BATCH == 0 && sp.GetStreamVersion(uuid) != keepVersion {
+			return deleted, bte.Err(bte.WrongArgs, "stream version changed during reclaim")
+		}
+		if ctx.Err() != nil {
+			return deleted, bte.CtxE(ctx)
+		}
+		st, err := h.Stat(oid)
+		if err != nil {
+			//It may have been deleted by a concurrent reclaim
+			continue
+		}
+		if st.ModTime.After(started.Add(-RECLAIM_GRACE)) {
+			continue
+		}
+		err = h.Delete(oid)
+		if err != nil {
+			return deleted, bte.ErrW(bte.ClusterDegraded, "could not delete object", err)
+		}
+		deleted++
+	}
+	released := 0
+	ref := packRefXattr(uuid)
+	for i, oid := range packed {
+		if i%RECLAIM_BATCH == 0 && sp.GetStreamVersion(uuid) != keepVersion {
+			return deleted, bte.Err(bte.WrongArgs, "stream version changed during reclaim")
+		}
+		if ctx.Err() != nil {
+			return deleted, bte.CtxE(ctx)
+		}
+		//A packed object written to recently may be about to be referenced
+		//by another stream
+		st, err := h.Stat(oid)
+		if err != nil || st.ModTime.After(started.Add(-RECLAIM_GRACE)) {
+			continue
+		}
+		xattrs, err := h.ListXattrs(oid)
+		if err != nil {
+			continue
+		}
+		if _, ok := xattrs[ref]; !ok {
+			continue
+		}
+		others := 0
+		for name := range xattrs {
+			if name != ref && strings.HasPrefix(name, "ref") {
+				others++
+			}
+		}
+		if others > 0 {
+			if err := h.RmXattr(oid, ref); err != nil {
+				return deleted, bte.ErrW(bte.ClusterDegraded, "could not remove packed object reference", err)
+			}
+			released++
+			continue
+		}
+		if err := h.Delete(oid); err != nil {
+			return deleted, bte.ErrW(bte.ClusterDegraded, "could not delete object", err)
+		}
+		deleted++
+	}
+	logger.Infof("reclaimed %d of %d unreferenced objects for %x, and released %d shared objects", deleted, len(candidates)+len(packed), uuid, released)
+	return deleted, nil
+}
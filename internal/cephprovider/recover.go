@@ -0,0 +1,43 @@
+package cephprovider
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A panic for a broken invariant of the provider, where carrying on could
+//corrupt data. These are never recovered
+type invariantPanic string
+
+func (p invariantPanic) String() string {
+	return string(p)
+}
+
+//Logs and panics with an invariantPanic
+func invariantf(format string, args ...interface{}) {
+	logger.Criticalf(format, args...)
+	panic(invariantPanic(fmt.Sprintf(format, args...)))
+}
+
+//Deferred by the public methods that return a bte.BTE, with a pointer to
+//that result. If the provider recovers panics, a panic from a RADOS error is
+//returned as ClusterDegraded instead. Invariant panics and runtime errors are
+//bugs and are re-raised. Panics in goroutines other than the caller's, and in
+//methods that cannot return an error, still crash the server
+func (sp *CephStorageProvider) recoverErr(err *bte.BTE) {
+	if !sp.recoverPanics {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	switch r.(type) {
+	case invariantPanic, runtime.Error:
+		panic(r)
+	}
+	logger.Errorf("returning ceph panic as an error: %v", r)
+	*err = bte.ErrF(bte.ClusterDegraded, "ceph error: %v", r)
+}
@@ -0,0 +1,40 @@
+package cephprovider
+
+import (
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+func TestRecoverErr(t *testing.T) {
+	sp := &CephStorageProvider{recoverPanics: true}
+	call := func(f func()) (rerr bte.BTE) {
+		defer sp.recoverErr(&rerr)
+		f()
+		return nil
+	}
+	err := call(func() { panic("ceph error: timed out") })
+	if err == nil || err.Code() != bte.ClusterDegraded {
+		t.Fatalf("expected a cluster degraded error, got %v", err)
+	}
+	if err := call(func() {}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	func() {
+		defer func() {
+			if _, ok := recover().(invariantPanic); !ok {
+				t.Fatal("invariant panic was not re-raised")
+			}
+		}()
+		call(func() { panic(invariantPanic("Non-sequential write")) })
+	}()
+	sp.recoverPanics = false
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic was recovered with the policy off")
+			}
+		}()
+		call(func() { panic("ceph error: timed out") })
+	}()
+}
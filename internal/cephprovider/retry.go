@@ -0,0 +1,70 @@
+package cephprovider
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/ceph/go-ceph/rados"
+)
+
+//Only errors that may go away on their own are retried. In particular not
+//found and invalid argument are returned immediately
+func isRetryable(err error) bool {
+	rerr, ok := err.(rados.RadosError)
+	if !ok {
+		return false
+	}
+	code := int(rerr)
+	if code < 0 {
+		code = -code
+	}
+	switch syscall.Errno(code) {
+	case syscall.EAGAIN, syscall.ETIMEDOUT, syscall.EINTR, syscall.EBUSY:
+		return true
+	}
+	return false
+}
+
+//Returns true if the error returned by retry is because the object does not
+//exist
+func isNotFound(err bte.BTE) bool {
+	return err != nil && err.Cause() == rados.RadosErrorNotFound
+}
+
+//Runs op, retrying it with exponential backoff while it fails with a
+//transient error. The RADOS error is kept as the cause of the returned error
+func (sp *CephStorageProvider) retry(what string, op func() error) bte.BTE {
+	delay := sp.retryDelay
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) {
+			return bte.ErrW(bte.ClusterDegraded, "ceph error during "+what, err)
+		}
+		if i >= sp.retryCount {
+			return bte.ErrW(bte.StorageTimeout, "ceph error during "+what+" persisted after retrying", err)
+		}
+		hotlog.Warningf("retry "+what, "retrying %s in %v after ceph error: %v", what, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (sp *CephStorageProvider) getXattr(h *rados.IOContext, oid string, name string, data []byte) (int, bte.BTE) {
+	var rv int
+	err := sp.retry("getxattr "+name, func() error {
+		var err error
+		rv, err = h.GetXattr(oid, name, data)
+		return err
+	})
+	return rv, err
+}
+
+func (sp *CephStorageProvider) setXattr(h *rados.IOContext, oid string, name string, data []byte) bte.BTE {
+	return sp.retry("setxattr "+name, func() error {
+		return h.SetXattr(oid, name, data)
+	})
+}
@@ -0,0 +1,43 @@
+package cephprovider
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+//The value of the sbformat xattr of streams whose superblocks are followed by
+//a checksum. Streams without the xattr use bare SBLOCK_SIZE superblocks
+const SBLOCK_FORMAT_CHECKSUM = "crc32c"
+
+//A superblock followed by its checksum
+const SBLOCK_CHECKED_SIZE = SBLOCK_SIZE + 4
+
+func sbSlotSize(checksum bool) uint64 {
+	if checksum {
+		return SBLOCK_CHECKED_SIZE
+	}
+	return SBLOCK_SIZE
+}
+
+//The checksum covers the uuid and version as well as the superblock, so a
+//superblock written to the wrong slot is also caught
+func sbChecksum(uuid []byte, version uint64, sb []byte) uint32 {
+	buf := make([]byte, 0, 16+8+SBLOCK_SIZE)
+	buf = append(buf, uuid...)
+	vb := make([]byte, 8)
+	binary.LittleEndian.PutUint64(vb, version)
+	buf = append(buf, vb...)
+	buf = append(buf, sb[:SBLOCK_SIZE]...)
+	return crc32.Checksum(buf, castagnoli)
+}
+
+func withSbChecksum(uuid []byte, version uint64, sb []byte) []byte {
+	rv := make([]byte, SBLOCK_CHECKED_SIZE)
+	copy(rv, sb[:SBLOCK_SIZE])
+	binary.LittleEndian.PutUint32(rv[SBLOCK_SIZE:], sbChecksum(uuid, version, sb))
+	return rv
+}
+
+func sbChecksumValid(uuid []byte, version uint64, slot []byte) bool {
+	return binary.LittleEndian.Uint32(slot[SBLOCK_SIZE:]) == sbChecksum(uuid, version, slot)
+}
@@ -0,0 +1,23 @@
+package cephprovider
+
+import (
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestSuperblockChecksum(t *testing.T) {
+	id := uuid.NewRandom()
+	sb := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	slot := withSbChecksum(id, 7, sb)
+	if !sbChecksumValid(id, 7, slot) {
+		t.Fatal("valid superblock failed its checksum")
+	}
+	if sbChecksumValid(id, 8, slot) {
+		t.Fatal("superblock in the wrong slot passed its checksum")
+	}
+	slot[3] ^= 0x10
+	if sbChecksumValid(id, 7, slot) {
+		t.Fatal("corrupt superblock passed its checksum")
+	}
+}
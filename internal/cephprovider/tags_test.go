@@ -0,0 +1,21 @@
+package cephprovider
+
+import (
+	"testing"
+)
+
+func TestParseTagListKey(t *testing.T) {
+	tags := map[string]string{"name": "voltage", "unit": "V"}
+	got, ok := parseTagListKey(tagListKey(tags))
+	if !ok || len(got) != 2 || got["name"] != "voltage" || got["unit"] != "V" {
+		t.Fatalf("round trip gave %v, %v", got, ok)
+	}
+	if got, ok := parseTagListKey(""); !ok || len(got) != 0 {
+		t.Fatalf("empty key gave %v, %v", got, ok)
+	}
+	for _, bad := range []string{"name@", "name@voltage@unit@"} {
+		if _, ok := parseTagListKey(bad); ok {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cephprovider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+	"github.com/ceph/go-ceph/rados"
+)
+
+//The tombstones of a stream are omap entries of this object, keyed by the
+//generation in zero padded hex so they list in generation order. The value is
+//the start and end of the deleted range, little endian
+func tombstoneOid(uuid []byte) string {
+	return fmt.Sprintf("tomb%032x", uuid)
+}
+
+func tombstoneKey(gen uint64) string {
+	return fmt.Sprintf("%016x", gen)
+}
+
+// AddTombstone records that [start, end) was deleted from the stream in the
+// given generation. The tombstone object is in the data pool, with the
+// stream's other metadata.
+func (sp *CephStorageProvider) AddTombstone(uuid []byte, gen uint64, start int64, end int64) (rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	whq := sp.writeHandles(sp.dataPool)
+	hi := <-whq.idx
+	h := sp.whFor(hi, sp.dataPool)
+	defer func() { whq.ret <- hi }()
+	val := make([]byte, 16)
+	binary.LittleEndian.PutUint64(val[:8], uint64(start))
+	binary.LittleEndian.PutUint64(val[8:], uint64(end))
+	return sp.retry("tombstone", func() error {
+		return h.SetOmap(tombstoneOid(uuid), map[string][]byte{tombstoneKey(gen): val})
+	})
+}
+
+// ListTombstones returns the deletions recorded in generations after startgen
+// up to and including endgen, in generation order.
+func (sp *CephStorageProvider) ListTombstones(uuid []byte, startgen uint64, endgen uint64) (_ []bprovider.Tombstone, rerr bte.BTE) {
+	defer sp.recoverErr(&rerr)
+	hi := sp.GetRH()
+	h := sp.rh[hi]
+	defer func() { sp.rhidx_ret <- hi }()
+	rv := []bprovider.Tombstone{}
+	after := tombstoneKey(startgen)
+	for {
+		got := int64(0)
+		var perr bte.BTE
+		err := h.ListOmapValues(tombstoneOid(uuid), after, "", COUNT_BATCH_SIZE, func(key string, val []byte) {
+			got++
+			after = key
+			gen, err := strconv.ParseUint(key, 16, 64)
+			if err != nil || len(val) != 16 {
+				perr = bte.ErrF(bte.StreamEntryCorrupt, "tombstone %q is malformed", key)
+				return
+			}
+			if gen > endgen {
+				return
+			}
+			rv = append(rv, bprovider.Tombstone{
+				Generation: gen,
+				Start:      int64(binary.LittleEndian.Uint64(val[:8])),
+				End:        int64(binary.LittleEndian.Uint64(val[8:])),
+			})
+		})
+		if err == rados.RadosErrorNotFound {
+			//No deletions were ever recorded
+			return rv, nil
+		}
+		if err != nil {
+			return nil, bte.ErrW(bte.ClusterDegraded, "could not list deletions", err)
+		}
+		if perr != nil {
+			return nil, perr
+		}
+		if got < COUNT_BATCH_SIZE || after > tombstoneKey(endgen) {
+			break
+		}
+	}
+	return rv, nil
+}
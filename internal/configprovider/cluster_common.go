@@ -280,7 +280,16 @@ func (c *etcdconfig) setDefaultNodeKeys() {
 		}
 	}
 	setifnotexists("in", True)
-	setifnotexists("weight", "100")
+	if c.fileconfig.StorageCephReadOnly() {
+		//A read replica cannot hold write locks, so it must never be given a
+		//range of the mash, even if it was a writer before
+		_, err := c.eclient.Put(c.ctx, fmt.Sprintf("%s/x/m/%s/weight", c.ClusterPrefix(), c.nodename), "0")
+		if err != nil {
+			c.Fault("setting replica weight: %v", err)
+		}
+	} else {
+		setifnotexists("weight", "100")
+	}
 	setifnotexists("readweight", "1.0")
 	setifnotexists("enabled", True)
 
@@ -114,3 +114,15 @@ func TestLeaderConcurrent(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 }
+func TestReadReplicaWeight(t *testing.T) {
+	fcfg := defaultConfig()
+	fcfg.Storage.CephReadOnly = true
+	cfg, err := LoadEtcdConfig(fcfg, "test6")
+	if err != nil {
+		t.Fatalf("could not load config: %v", err)
+	}
+	resp, err := cfg.(*etcdconfig).eclient.Get(context.TODO(), "clustertest/x/m/test6/weight")
+	if err != nil || resp.Count != 1 || string(resp.Kvs[0].Value) != "0" {
+		t.Errorf("read replica was registered with a weight: %v %v", err, resp.Kvs)
+	}
+}
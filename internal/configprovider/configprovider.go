@@ -4,23 +4,140 @@ type Configuration interface {
 	ClusterEnabled() bool
 	ClusterPrefix() string
 	ClusterEtcdEndpoints() []string
+	// If true, queries for streams whose write lock is held by another node
+	// are served from storage instead of being rejected. Such reads do not see
+	// data still buffered on the owning node.
+	ClusterAllowStaleReads() bool
 	StorageCephConf() string
 	StorageFilepath() string
 	StorageCephDataPool() string
 	StorageCephHotPool() string
+	// The codec (gzip or snappy) used to compress data objects written to the
+	// data pool. Empty means objects are written uncompressed
+	StorageCephDataCompression() string
+	// Codecs for particular pools, each of the form pool:codec, overriding
+	// StorageCephDataCompression for data written to that pool
+	StorageCephPoolCompression() []string
+	// The largest annotation in bytes a stream may have. Zero means use the
+	// provider default
+	StorageMaxAnnotationSize() int
+	// Routes that place the data of new streams in other pools, each of the
+	// form collectionprefix:pool. The longest matching prefix wins
+	StorageCephPoolRoutes() []string
+	// The RADOS namespace all objects are stored in, so several databases can
+	// share pools. Empty means the default namespace
+	StorageCephNamespace() string
+	// The address the allocator starts at when the database is created, as
+	// a decimal or 0x prefixed hex number. Empty means the provider default
+	StorageCephInitialAddress() string
+	// If nonzero, a new database hashes collections to index partitions
+	// with this seed. Existing databases keep the hashing they were created
+	// with
+	StorageCephIndexSeed() uint32
+	// If true, the node is a read replica: it opens no write handles, does
+	// not allocate, and every write is rejected with ReadOnly
+	StorageCephReadOnly() bool
 	HttpEnabled() bool
 	HttpListen() string
 	HttpAdvertise() []string
+	// The bearer token required by administrative HTTP endpoints. Empty
+	// disables those endpoints
+	HttpAdminToken() string
+	// If true, POST /streams/{uuid}/delete deletes time ranges. It also
+	// requires the admin token
+	HttpAllowDelete() bool
+	// If true, POST /streams/{uuid}/insert inserts points. It also requires
+	// the admin token
+	HttpAllowInsert() bool
+	// If true, debugging endpoints such as /debug/superblocks are served.
+	// They also require the admin token
+	HttpDebugEndpoints() bool
 	GRPCEnabled() bool
 	GRPCListen() string
 	GRPCAdvertise() []string
 	BlockCache() int
+	// How many streams are remembered as existing so that inserts need not
+	// check storage. Zero means use the default, negative disables the cache
+	StreamExistsCache() int
 	RadosReadCache() int
+	// If the system has less than this many MB available, the read cache is
+	// halved every few seconds until it recovers. Zero disables this
+	RadosReadCacheMinFreeMemory() int
 	RadosWriteCache() int
+	// The capacity in bytes of the write cache each locked segment buffers
+	// into before writing to RADOS. Zero means use the provider default
+	RadosSegmentWriteCache() int
+	// The size in bytes of the chunks read from RADOS and held in the read
+	// cache. Must be a power of two, zero means use the provider default
+	RadosReadChunkSize() int
+	// How many distinct chunks may be fetched from RADOS at once. Zero means
+	// the number of read handles
+	RadosReadConcurrency() int
+	// How many chunks after the one being read are fetched in the background
+	// during a sequential scan. Zero disables read ahead
+	RadosReadAhead() int
+	// How many streams' partially filled RADOS objects are remembered so
+	// later writes can append to them. Zero means use the provider default
+	RadosSegmentCacheSize() int
+	// An object is only remembered for appending if it has at least this
+	// many bytes free. Zero means use the provider default
+	RadosSegmentCacheMinFree() int
+	// If true, a full segment cache evicts one entry instead of being cleared
+	RadosSegmentCacheEvictOne() bool
+	// Remembered objects older than this many seconds are not appended to,
+	// in case they have since moved. Zero means use the provider default
+	RadosSegmentCacheTTL() int
+	// The largest object in bytes that may be stored in RADOS. Reads of
+	// longer objects fail as corrupt. Zero means use the provider default
+	RadosMaxObjectSize() int
+	// The lease in milliseconds on the RADOS allocator lock. Zero means use
+	// the provider default
+	RadosAllocLease() int
+	// How many times a RADOS operation failing with a transient error is
+	// retried. Zero means use the provider default, negative disables retries
+	RadosRetries() int
+	// The delay in milliseconds before the first retry, doubling on each
+	// subsequent one. Zero means use the provider default
+	RadosRetryDelay() int
+	// If true, every segment flush is read back and checksummed. This doubles
+	// write IO so it is meant for debugging
+	RadosVerifyWrites() bool
+	// If true, a RADOS error in a storage call that can return an error is
+	// returned as one instead of crashing the server
+	RadosRecoverPanics() bool
+	// Streams that have written less than this many bytes since startup share
+	// RADOS objects with other small streams. Zero disables packing
+	RadosPackThreshold() int
+	// The address space in bytes given to a segment, a power of two of at
+	// most 16MB. Zero means 16MB
+	RadosAllocRegionSize() int
+	// The address space in bytes taken from the allocator at a time, a
+	// multiple of 16MB. Zero means 64GB
+	RadosAllocLockSize() int
+
+	// How many storage read handles a single query may hold at once, unless
+	// the query sets its own budget. Zero means unlimited
+	QueryReadHandles() int
+	// Histogram queries use HistogramBuckets log spaced bucket bounds, the
+	// first at HistogramMin and each HistogramFactor times the last. Zero
+	// means use the default
+	QueryHistogramMin() float64
+	QueryHistogramFactor() float64
+	QueryHistogramBuckets() int
+
+	// If true, inserted points with times outside the storable range are
+	// clamped to it instead of the insert being rejected
+	InsertClampTimes() bool
 
 	// Note that these are "live" and called in the hotpath, so buffer them
 	CoalesceMaxPoints() int
 	CoalesceMaxInterval() int
+	// A stream's buffered points are also committed once they take roughly
+	// this many bytes of memory. Zero disables this limit
+	CoalesceMaxBytes() int
+	// How many streams are committed at once on shutdown. Zero means use the
+	// default
+	CoalesceShutdownWorkers() int
 }
 
 type ClusterConfiguration interface {
@@ -149,6 +149,9 @@ func (c *etcdconfig) ClusterPrefix() string {
 func (c *etcdconfig) ClusterEtcdEndpoints() []string {
 	return c.fileconfig.ClusterEtcdEndpoints()
 }
+func (c *etcdconfig) ClusterAllowStaleReads() bool {
+	return c.fileconfig.ClusterAllowStaleReads()
+}
 func (c *etcdconfig) StorageCephConf() string {
 	return c.stringNodeKey("cephConf")
 }
@@ -161,12 +164,49 @@ func (c *etcdconfig) StorageCephDataPool() string {
 func (c *etcdconfig) StorageCephHotPool() string {
 	return c.stringGlobalKey("cephHotPool")
 }
+func (c *etcdconfig) StorageCephDataCompression() string {
+	return c.fileconfig.StorageCephDataCompression()
+}
+func (c *etcdconfig) StorageMaxAnnotationSize() int {
+	return c.fileconfig.StorageMaxAnnotationSize()
+}
+func (c *etcdconfig) StorageCephPoolRoutes() []string {
+	return c.fileconfig.StorageCephPoolRoutes()
+}
+func (c *etcdconfig) StorageCephPoolCompression() []string {
+	return c.fileconfig.StorageCephPoolCompression()
+}
+func (c *etcdconfig) StorageCephNamespace() string {
+	return c.fileconfig.StorageCephNamespace()
+}
+func (c *etcdconfig) StorageCephInitialAddress() string {
+	return c.fileconfig.StorageCephInitialAddress()
+}
+func (c *etcdconfig) StorageCephIndexSeed() uint32 {
+	return c.fileconfig.StorageCephIndexSeed()
+}
+func (c *etcdconfig) StorageCephReadOnly() bool {
+	return c.fileconfig.StorageCephReadOnly()
+}
 func (c *etcdconfig) HttpEnabled() bool {
 	return c.stringNodeKey("httpEnabled") == "true"
 }
 func (c *etcdconfig) HttpListen() string {
 	return c.stringNodeKey("httpListen")
 }
+//The token is a secret, so it is never copied into etcd
+func (c *etcdconfig) HttpAdminToken() string {
+	return c.fileconfig.HttpAdminToken()
+}
+func (c *etcdconfig) HttpAllowDelete() bool {
+	return c.fileconfig.HttpAllowDelete()
+}
+func (c *etcdconfig) HttpAllowInsert() bool {
+	return c.fileconfig.HttpAllowInsert()
+}
+func (c *etcdconfig) HttpDebugEndpoints() bool {
+	return c.fileconfig.HttpDebugEndpoints()
+}
 func (c *etcdconfig) HttpAdvertise() []string {
 	j := c.stringNodeKey("httpAdvertise")
 	if j == "" {
@@ -202,6 +242,9 @@ func (c *etcdconfig) RadosReadCache() int {
 	}
 	return rv
 }
+func (c *etcdconfig) RadosReadCacheMinFreeMemory() int {
+	return c.fileconfig.RadosReadCacheMinFreeMemory()
+}
 func (c *etcdconfig) RadosWriteCache() int {
 	rv, err := strconv.Atoi(c.stringNodeKey("radosWriteCache"))
 	if err != nil {
@@ -209,6 +252,75 @@ func (c *etcdconfig) RadosWriteCache() int {
 	}
 	return rv
 }
+func (c *etcdconfig) RadosSegmentWriteCache() int {
+	return c.fileconfig.RadosSegmentWriteCache()
+}
+func (c *etcdconfig) RadosReadChunkSize() int {
+	return c.fileconfig.RadosReadChunkSize()
+}
+func (c *etcdconfig) RadosReadConcurrency() int {
+	return c.fileconfig.RadosReadConcurrency()
+}
+func (c *etcdconfig) RadosReadAhead() int {
+	return c.fileconfig.RadosReadAhead()
+}
+func (c *etcdconfig) RadosSegmentCacheSize() int {
+	return c.fileconfig.RadosSegmentCacheSize()
+}
+func (c *etcdconfig) StreamExistsCache() int {
+	return c.fileconfig.StreamExistsCache()
+}
+func (c *etcdconfig) RadosSegmentCacheMinFree() int {
+	return c.fileconfig.RadosSegmentCacheMinFree()
+}
+func (c *etcdconfig) RadosSegmentCacheEvictOne() bool {
+	return c.fileconfig.RadosSegmentCacheEvictOne()
+}
+func (c *etcdconfig) RadosSegmentCacheTTL() int {
+	return c.fileconfig.RadosSegmentCacheTTL()
+}
+func (c *etcdconfig) RadosMaxObjectSize() int {
+	return c.fileconfig.RadosMaxObjectSize()
+}
+func (c *etcdconfig) RadosAllocLease() int {
+	return c.fileconfig.RadosAllocLease()
+}
+func (c *etcdconfig) RadosRetries() int {
+	return c.fileconfig.RadosRetries()
+}
+func (c *etcdconfig) RadosRetryDelay() int {
+	return c.fileconfig.RadosRetryDelay()
+}
+func (c *etcdconfig) RadosVerifyWrites() bool {
+	return c.fileconfig.RadosVerifyWrites()
+}
+func (c *etcdconfig) RadosRecoverPanics() bool {
+	return c.fileconfig.RadosRecoverPanics()
+}
+func (c *etcdconfig) RadosPackThreshold() int {
+	return c.fileconfig.RadosPackThreshold()
+}
+func (c *etcdconfig) RadosAllocRegionSize() int {
+	return c.fileconfig.RadosAllocRegionSize()
+}
+func (c *etcdconfig) RadosAllocLockSize() int {
+	return c.fileconfig.RadosAllocLockSize()
+}
+func (c *etcdconfig) QueryReadHandles() int {
+	return c.fileconfig.QueryReadHandles()
+}
+func (c *etcdconfig) QueryHistogramMin() float64 {
+	return c.fileconfig.QueryHistogramMin()
+}
+func (c *etcdconfig) QueryHistogramFactor() float64 {
+	return c.fileconfig.QueryHistogramFactor()
+}
+func (c *etcdconfig) QueryHistogramBuckets() int {
+	return c.fileconfig.QueryHistogramBuckets()
+}
+func (c *etcdconfig) InsertClampTimes() bool {
+	return c.fileconfig.InsertClampTimes()
+}
 func (c *etcdconfig) CoalesceMaxPoints() int {
 	rv, err := strconv.Atoi(c.stringNodeKey("coalesceMaxPoints"))
 	if err != nil {
@@ -216,6 +328,9 @@ func (c *etcdconfig) CoalesceMaxPoints() int {
 	}
 	return rv
 }
+func (c *etcdconfig) CoalesceMaxBytes() int {
+	return c.fileconfig.CoalesceMaxBytes()
+}
 func (c *etcdconfig) CoalesceMaxInterval() int {
 	rv, err := strconv.Atoi(c.stringNodeKey("coalesceMaxInterval"))
 	if err != nil {
@@ -223,6 +338,9 @@ func (c *etcdconfig) CoalesceMaxInterval() int {
 	}
 	return rv
 }
+func (c *etcdconfig) CoalesceShutdownWorkers() int {
+	return c.fileconfig.CoalesceShutdownWorkers()
+}
 
 func (c *etcdconfig) PeerHTTPAdvertise(nodename string) ([]string, error) {
 	rv, err := c.stringPeerNodeKey(nodename, "httpAdvertise")
@@ -8,14 +8,19 @@ import (
 
 type FileConfig struct {
 	Cluster struct {
-		Prefix       string
-		EtcdEndpoint []string
-		Enabled      bool
+		Prefix          string
+		EtcdEndpoint    []string
+		Enabled         bool
+		AllowStaleReads bool
 	}
 	Http struct {
-		Listen    string
-		Advertise []string
-		Enabled   bool
+		Listen         string
+		Advertise      []string
+		Enabled        bool
+		AdminToken     string
+		AllowDelete    bool
+		AllowInsert    bool
+		DebugEndpoints bool
 	}
 	Grpc struct {
 		Listen    string
@@ -23,23 +28,61 @@ type FileConfig struct {
 		Enabled   bool
 	}
 	Storage struct {
-		Filepath     string
-		CephDataPool string
-		CephHotPool  string
-		CephConf     string
+		Filepath            string
+		CephDataPool        string
+		CephHotPool         string
+		CephConf            string
+		CephDataCompression string
+		MaxAnnotationSize   int
+		CephPoolRoute       []string
+		CephPoolCompression []string
+		CephNamespace       string
+		CephInitialAddress  string
+		CephIndexSeed       uint32
+		CephReadOnly        bool
 	}
 	Cache struct {
-		BlockCache      int
-		RadosWriteCache int
-		RadosReadCache  int
+		BlockCache                  int
+		StreamExistsCache           int
+		RadosWriteCache             int
+		RadosReadCache              int
+		RadosReadCacheMinFreeMemory int
+		RadosSegmentWriteCache      int
+		RadosReadChunkSize          int
+		RadosReadConcurrency        int
+		RadosReadAhead              int
+		RadosSegmentCacheSize       int
+		RadosSegmentCacheMinFree    int
+		RadosSegmentCacheEvictOne   bool
+		RadosSegmentCacheTTL        int
+		RadosMaxObjectSize          int
+		RadosAllocLease             int
+		RadosRetries                int
+		RadosRetryDelay             int
+		RadosVerifyWrites           bool
+		RadosRecoverPanics          bool
+		RadosPackThreshold          int
+		RadosAllocRegionSize        int
+		RadosAllocLockSize          int
 	}
 	Debug struct {
 		Cpuprofile  bool
 		Heapprofile bool
 	}
 	Coalescence struct {
-		MaxPoints int
-		Interval  int
+		MaxPoints       int
+		Interval        int
+		MaxBytes        int
+		ShutdownWorkers int
+	}
+	Insert struct {
+		ClampTimes bool
+	}
+	Query struct {
+		ReadHandles      int
+		HistogramMin     float64
+		HistogramFactor  float64
+		HistogramBuckets int
 	}
 }
 
@@ -61,6 +104,9 @@ func (c *FileConfig) ClusterPrefix() string {
 func (c *FileConfig) ClusterEtcdEndpoints() []string {
 	return c.Cluster.EtcdEndpoint
 }
+func (c *FileConfig) ClusterAllowStaleReads() bool {
+	return c.Cluster.AllowStaleReads
+}
 func (c *FileConfig) StorageCephConf() string {
 	return c.Storage.CephConf
 }
@@ -73,12 +119,48 @@ func (c *FileConfig) StorageCephDataPool() string {
 func (c *FileConfig) StorageCephHotPool() string {
 	return c.Storage.CephHotPool
 }
+func (c *FileConfig) StorageCephDataCompression() string {
+	return c.Storage.CephDataCompression
+}
+func (c *FileConfig) StorageMaxAnnotationSize() int {
+	return c.Storage.MaxAnnotationSize * 1024
+}
+func (c *FileConfig) StorageCephPoolRoutes() []string {
+	return c.Storage.CephPoolRoute
+}
+func (c *FileConfig) StorageCephPoolCompression() []string {
+	return c.Storage.CephPoolCompression
+}
+func (c *FileConfig) StorageCephNamespace() string {
+	return c.Storage.CephNamespace
+}
+func (c *FileConfig) StorageCephInitialAddress() string {
+	return c.Storage.CephInitialAddress
+}
+func (c *FileConfig) StorageCephIndexSeed() uint32 {
+	return c.Storage.CephIndexSeed
+}
+func (c *FileConfig) StorageCephReadOnly() bool {
+	return c.Storage.CephReadOnly
+}
 func (c *FileConfig) HttpEnabled() bool {
 	return c.Http.Enabled
 }
 func (c *FileConfig) HttpListen() string {
 	return c.Http.Listen
 }
+func (c *FileConfig) HttpAdminToken() string {
+	return c.Http.AdminToken
+}
+func (c *FileConfig) HttpAllowDelete() bool {
+	return c.Http.AllowDelete
+}
+func (c *FileConfig) HttpAllowInsert() bool {
+	return c.Http.AllowInsert
+}
+func (c *FileConfig) HttpDebugEndpoints() bool {
+	return c.Http.DebugEndpoints
+}
 func (c *FileConfig) HttpAdvertise() []string {
 	rv := []string{}
 	for _, x := range c.Http.Advertise {
@@ -123,12 +205,90 @@ func (c *FileConfig) BlockCache() int {
 func (c *FileConfig) RadosReadCache() int {
 	return c.Cache.RadosReadCache
 }
+func (c *FileConfig) RadosReadCacheMinFreeMemory() int {
+	return c.Cache.RadosReadCacheMinFreeMemory
+}
 func (c *FileConfig) RadosWriteCache() int {
 	return c.Cache.RadosWriteCache
 }
+func (c *FileConfig) RadosSegmentWriteCache() int {
+	return c.Cache.RadosSegmentWriteCache * 1024
+}
+func (c *FileConfig) RadosReadChunkSize() int {
+	return c.Cache.RadosReadChunkSize * 1024
+}
+func (c *FileConfig) RadosReadConcurrency() int {
+	return c.Cache.RadosReadConcurrency
+}
+func (c *FileConfig) RadosReadAhead() int {
+	return c.Cache.RadosReadAhead
+}
+func (c *FileConfig) StreamExistsCache() int {
+	return c.Cache.StreamExistsCache
+}
+func (c *FileConfig) RadosSegmentCacheSize() int {
+	return c.Cache.RadosSegmentCacheSize
+}
+func (c *FileConfig) RadosSegmentCacheMinFree() int {
+	return c.Cache.RadosSegmentCacheMinFree * 1024
+}
+func (c *FileConfig) RadosSegmentCacheEvictOne() bool {
+	return c.Cache.RadosSegmentCacheEvictOne
+}
+func (c *FileConfig) RadosSegmentCacheTTL() int {
+	return c.Cache.RadosSegmentCacheTTL
+}
+func (c *FileConfig) RadosMaxObjectSize() int {
+	return c.Cache.RadosMaxObjectSize
+}
+func (c *FileConfig) RadosAllocLease() int {
+	return c.Cache.RadosAllocLease
+}
+func (c *FileConfig) RadosRetries() int {
+	return c.Cache.RadosRetries
+}
+func (c *FileConfig) RadosRetryDelay() int {
+	return c.Cache.RadosRetryDelay
+}
+func (c *FileConfig) RadosVerifyWrites() bool {
+	return c.Cache.RadosVerifyWrites
+}
+func (c *FileConfig) RadosRecoverPanics() bool {
+	return c.Cache.RadosRecoverPanics
+}
+func (c *FileConfig) RadosPackThreshold() int {
+	return c.Cache.RadosPackThreshold * 1024
+}
+func (c *FileConfig) RadosAllocRegionSize() int {
+	return c.Cache.RadosAllocRegionSize * 1024
+}
+func (c *FileConfig) RadosAllocLockSize() int {
+	return c.Cache.RadosAllocLockSize * 1024 * 1024
+}
+func (c *FileConfig) QueryReadHandles() int {
+	return c.Query.ReadHandles
+}
+func (c *FileConfig) QueryHistogramMin() float64 {
+	return c.Query.HistogramMin
+}
+func (c *FileConfig) QueryHistogramFactor() float64 {
+	return c.Query.HistogramFactor
+}
+func (c *FileConfig) QueryHistogramBuckets() int {
+	return c.Query.HistogramBuckets
+}
+func (c *FileConfig) InsertClampTimes() bool {
+	return c.Insert.ClampTimes
+}
 func (c *FileConfig) CoalesceMaxPoints() int {
 	return c.Coalescence.MaxPoints
 }
+func (c *FileConfig) CoalesceMaxBytes() int {
+	return c.Coalescence.MaxBytes * 1024
+}
 func (c *FileConfig) CoalesceMaxInterval() int {
 	return c.Coalescence.Interval
 }
+func (c *FileConfig) CoalesceShutdownWorkers() int {
+	return c.Coalescence.ShutdownWorkers
+}
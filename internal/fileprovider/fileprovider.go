@@ -5,6 +5,9 @@ import (
 	"io"
 	"os"
 	"sync"
+	"time"
+
+	"golang.org/x/net/context"
 
 	"github.com/SoftwareDefinedBuildings/btrdb/bte"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
@@ -79,9 +82,10 @@ func (seg *FileProviderSegment) BaseAddress() uint64 {
 
 //Unlocks the segment for the StorageProvider to give to other consumers
 //Implies a flush
-func (seg *FileProviderSegment) Unlock() {
+func (seg *FileProviderSegment) Unlock() bte.BTE {
 	seg.Flush()
 	seg.sp.retfidx <- seg.fidx
+	return nil
 }
 
 //Writes a slice to the segment, returns immediately
@@ -209,7 +213,20 @@ func (sp *FileStorageProvider) LockSegment(uuid []byte) bprovider.Segment {
 //This is the size of a maximal size cblock + header
 const FIRSTREAD = 3459
 
-func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte) []byte {
+//Files are not read through a handle pool, so the budget does not apply.
+//Reads are local, so the context is only checked first
+func (sp *FileStorageProvider) ReadBudgeted(ctx context.Context, uuid []byte, address uint64, buffer []byte, budget bprovider.ReadBudget) ([]byte, bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.CtxE(ctx)
+	}
+	return sp.Read(uuid, address, buffer)
+}
+
+//Files are read through the OS page cache, which does its own read ahead
+func (sp *FileStorageProvider) Prefetch(uuid []byte, address uint64) {
+}
+
+func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte) ([]byte, bte.BTE) {
 	fidx := address >> 50
 	off := int64(address & ((1 << 50) - 1))
 	if fidx > NUMFILES {
@@ -225,6 +242,10 @@ func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 	}
 	//Now we read the blob size
 	bsize := int(buffer[0]) + (int(buffer[1]) << 8)
+	if bsize+2 > len(buffer) {
+		sp.dbrf_mtx[fidx].Unlock()
+		return nil, bte.ErrF(bte.BlockCorrupt, "object at 0x%016x has length %d, larger than the read buffer", address, bsize)
+	}
 	if bsize > nread-2 {
 		_, err := sp.dbrf[fidx].ReadAt(buffer[nread:bsize+2], off+int64(nread))
 		if err != nil {
@@ -232,7 +253,16 @@ func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte)
 		}
 	}
 	sp.dbrf_mtx[fidx].Unlock()
-	return buffer[2 : bsize+2]
+	return buffer[2 : bsize+2], nil
+}
+
+//Checks that the database files are still accessible
+func (sp *FileStorageProvider) Healthy() bte.BTE {
+	_, err := sp.dbrf[0].Stat()
+	if err != nil {
+		return bte.ErrW(bte.ClusterDegraded, "could not stat blockstore file", err)
+	}
+	return nil
 }
 
 //Called to create the database for the first time
@@ -267,7 +297,7 @@ func (sp *FileStorageProvider) CreateDatabase(cfg configprovider.Configuration)
 }
 
 // Read the given version of superblock into the buffer.
-func (sp *FileStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) []byte {
+func (sp *FileStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, bte.BTE) {
 	panic("yo not supported bro")
 }
 
@@ -285,6 +315,10 @@ func (sp *FileStorageProvider) SetStreamVersion(uuid []byte, version uint64) {
 	panic("yo not supported bro")
 }
 
+func (sp *FileStorageProvider) SetStreamVersionCAS(uuid []byte, expected uint64, new uint64) bte.BTE {
+	panic("yo not supported bro")
+}
+
 // Gets the version of a stream. Returns 0 if none exists.
 func (sp *FileStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
 	panic("yo not supported bro")
@@ -309,10 +343,53 @@ func (sp *FileStorageProvider) ListCollections(prefix string, startingFrom strin
 	panic("yo not supported bro")
 }
 
+func (sp *FileStorageProvider) ListCollectionsMatching(pattern string, startingFrom string, number int64) ([]string, string, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+// ListCollectionsWithCounts pages through collections exactly like ListCollections
+// but also returns the number of streams in each collection. Counting stops
+// at countLimit streams per collection, in which case Exceeded is set.
+func (sp *FileStorageProvider) ListCollectionsWithCounts(prefix string, startingFrom string, number int64, countLimit int64) ([]bprovider.CollectionCount, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) ValidateStream(collection string, tags map[string]string) bte.BTE {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) CheckTagConflicts(collection string, tagSets []map[string]string) ([]bte.BTE, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) RetagStream(uuid []byte, newTags map[string]string) bte.BTE {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) MoveStream(uuid []byte, newCollection string) bte.BTE {
+	panic("yo not supported bro")
+}
+
 // ListStreams lists all the streams within a collection. If tags are specified
 // then streams are only returned if they have that tag, and the value equals
 // the value passed. If partial is false, zero or one streams will be returned.
-func (sp *FileStorageProvider) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
+func (sp *FileStorageProvider) ListStreams(collection string, partial bool, tags map[string]string, annotations bool) ([]bprovider.Stream, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) ListTagKeys(collection string) ([]string, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) CountStreams(collection string, tags map[string]string) (int64, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) AddTombstone(uuid []byte, gen uint64, start int64, end int64) bte.BTE {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) ListTombstones(uuid []byte, startgen uint64, endgen uint64) ([]bprovider.Tombstone, bte.BTE) {
 	panic("yo not supported bro")
 }
 
@@ -321,7 +398,21 @@ func (sp *FileStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, con
 	panic("yo not supported bro")
 }
 
+// Appends to the stream annotation
+func (sp *FileStorageProvider) AppendStreamAnnotation(uuid []byte, aver uint64, extra []byte) bte.BTE {
+	panic("yo not supported bro")
+}
+
 // Gets the stream annotation
 func (sp *FileStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64, bte.BTE) {
 	panic("yo not supported bro")
 }
+
+// Gets just the version of the stream annotation
+func (sp *FileStorageProvider) GetStreamAnnotationVersion(uuid []byte) (uint64, bte.BTE) {
+	panic("yo not supported bro")
+}
+
+func (sp *FileStorageProvider) GetStreamCreationTime(uuid []byte) (time.Time, bte.BTE) {
+	panic("yo not supported bro")
+}
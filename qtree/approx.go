@@ -0,0 +1,40 @@
+package qtree
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A statistical record from a query whose descent may have been capped
+type ApproxStatRecord struct {
+	StatRecord
+	//The record covers 2^PointWidth nanoseconds, which is coarser than the
+	//requested pointwidth if Approximate is set
+	PointWidth  uint8
+	Approximate bool
+}
+
+//QueryStatisticalValuesApprox is QueryStatisticalValues, except the tree is
+//descended at most maxDepth levels below the root. Where the requested
+//pointwidth is finer than the nodes at that depth can give, their children's
+//summaries are returned instead, marked as approximate. This bounds the
+//number of nodes read however fine the pointwidth is
+func (tr *QTree) QueryStatisticalValuesApprox(ctx context.Context, start int64, end int64, pw uint8, maxDepth uint8) (chan ApproxStatRecord, chan bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
+	}
+	rv := make(chan ApproxStatRecord, ChanBufferSize)
+	rve := make(chan bte.BTE, 10)
+	if tr.root != nil {
+		go func() {
+			tr.root.queryStatisticalValues(ctx, rve, start, end, pw, 0, maxDepth, func(r StatRecord, rpw uint8, approx bool) {
+				rv <- ApproxStatRecord{StatRecord: r, PointWidth: rpw, Approximate: approx}
+			})
+			close(rv)
+		}()
+	} else {
+		close(rv)
+	}
+	return rv, rve
+}
@@ -0,0 +1,82 @@
+package qtree
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A point along with the generation of the leaf block that holds it
+type BlockGenerationRecord struct {
+	Record
+	BlockGeneration uint64
+}
+
+//ReadValuesWithBlockGeneration is ReadStandardValuesCI, but each point carries
+//the generation of the leaf it is stored in. Leaves are copy on write, so this
+//is the last generation that changed any point in the leaf, which is only an
+//upper bound on the generation the point itself was committed in
+func (tr *QTree) ReadValuesWithBlockGeneration(ctx context.Context, start int64, end int64) (chan BlockGenerationRecord, chan bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
+	}
+	rv := make(chan BlockGenerationRecord, ChanBufferSize)
+	rve := make(chan bte.BTE, 10)
+	if tr.root == nil || end <= start {
+		close(rv)
+		return rv, rve
+	}
+	go func() {
+		if err := tr.root.readBlockGeneration(ctx, rv, start, end); err != nil {
+			rve <- err
+		}
+		close(rv)
+	}()
+	return rv, rve
+}
+
+func (n *QTreeNode) readBlockGeneration(ctx context.Context, rv chan BlockGenerationRecord, start int64, end int64) bte.BTE {
+	if ctx.Err() != nil {
+		return bte.QueryCtxE(ctx)
+	}
+	if n.isLeaf {
+		gen := n.Generation()
+		for i := 0; i < int(n.vector_block.Len); i++ {
+			t := n.vector_block.Time[i]
+			if t < start {
+				continue
+			}
+			if t >= end {
+				break
+			}
+			select {
+			case rv <- BlockGenerationRecord{Record: Record{t, n.vector_block.Value[i]}, BlockGeneration: gen}:
+			case <-ctx.Done():
+				return bte.QueryCtxE(ctx)
+			}
+		}
+		return nil
+	}
+	for b := uint16(0); b < KFACTOR; b++ {
+		if n.core_block.Addr[b] == 0 {
+			continue
+		}
+		if n.ChildEndTime(b) <= start || n.ChildStartTime(b) >= end {
+			continue
+		}
+		c, err := n.Child(b)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		err = c.readBlockGeneration(ctx, rv, start, end)
+		c.Free()
+		n.child_cache[b] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
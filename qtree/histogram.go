@@ -0,0 +1,158 @@
+package qtree
+
+import (
+	"context"
+	"sort"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A histogram of the values in the window starting at Time. Buckets[i] counts
+//values below Bounds[i] (and at or above Bounds[i-1]), the last bucket counts
+//values at or above the last bound
+type HistRecord struct {
+	Time    int64
+	Count   uint64
+	Buckets []uint64
+}
+
+//Returns n bucket bounds starting at min, each factor times the last
+func LogBuckets(min float64, factor float64, n int) []float64 {
+	rv := make([]float64, n)
+	b := min
+	for i := range rv {
+		rv[i] = b
+		b *= factor
+	}
+	return rv
+}
+
+type histContext struct {
+	ctx    context.Context
+	start  int64
+	end    int64
+	pw     uint8
+	bounds []float64
+	rv     chan HistRecord
+	cur    *HistRecord
+}
+
+func (hc *histContext) bucket(v float64) int {
+	return sort.Search(len(hc.bounds), func(i int) bool { return v < hc.bounds[i] })
+}
+
+//Adds count values in the given bucket to the window containing t. Windows
+//are visited in time order, so a new window means the last one is complete
+func (hc *histContext) add(t int64, bucket int, count uint64) bte.BTE {
+	ws := t &^ ((1 << hc.pw) - 1)
+	if hc.cur != nil && hc.cur.Time != ws {
+		if err := hc.emit(); err != nil {
+			return err
+		}
+	}
+	if hc.cur == nil {
+		hc.cur = &HistRecord{Time: ws, Buckets: make([]uint64, len(hc.bounds)+1)}
+	}
+	hc.cur.Count += count
+	hc.cur.Buckets[bucket] += count
+	return nil
+}
+
+func (hc *histContext) emit() bte.BTE {
+	if hc.cur == nil {
+		return nil
+	}
+	select {
+	case hc.rv <- *hc.cur:
+	case <-hc.ctx.Done():
+		return bte.QueryCtxE(hc.ctx)
+	}
+	hc.cur = nil
+	return nil
+}
+
+//QueryHistogram returns a histogram of the values in each window of 2^pw
+//nanoseconds in [start, end), which must be aligned to the window. Bounds
+//must be sorted. A child whose min and max fall in the same bucket is
+//counted from its parent's summary rather than descended into, so narrow
+//distributions cost about as much as QueryStatisticalValues
+func (tr *QTree) QueryHistogram(ctx context.Context, start int64, end int64, pw uint8, bounds []float64) (chan HistRecord, chan bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
+	}
+	rv := make(chan HistRecord, ChanBufferSize)
+	rve := make(chan bte.BTE, 10)
+	if tr.root == nil {
+		close(rv)
+		return rv, rve
+	}
+	hc := &histContext{ctx: ctx, start: start, end: end, pw: pw, bounds: bounds, rv: rv}
+	go func() {
+		err := tr.root.queryHistogram(hc)
+		if err == nil {
+			err = hc.emit()
+		}
+		if err != nil {
+			rve <- err
+			return
+		}
+		close(rv)
+	}()
+	return rv, rve
+}
+
+func (n *QTreeNode) queryHistogram(hc *histContext) bte.BTE {
+	if hc.ctx.Err() != nil {
+		return bte.QueryCtxE(hc.ctx)
+	}
+	if n.isLeaf {
+		for i := 0; i < int(n.vector_block.Len); i++ {
+			t := n.vector_block.Time[i]
+			if t < hc.start {
+				continue
+			}
+			if t >= hc.end {
+				break
+			}
+			if err := hc.add(t, hc.bucket(n.vector_block.Value[i]), 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for b := uint16(0); b < KFACTOR; b++ {
+		if n.core_block.Count[b] == 0 {
+			continue
+		}
+		cs := n.ChildStartTime(b)
+		ce := n.ChildEndTime(b)
+		if ce <= hc.start || cs >= hc.end {
+			continue
+		}
+		//The child is within one window and the range, and all of its values
+		//are in one bucket
+		if n.PointWidth() <= hc.pw && cs >= hc.start && ce <= hc.end {
+			mb := hc.bucket(n.core_block.Min[b])
+			if mb == hc.bucket(n.core_block.Max[b]) {
+				if err := hc.add(cs, mb, n.core_block.Count[b]); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		c, err := n.Child(b)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		err = c.queryHistogram(hc)
+		c.Free()
+		n.child_cache[b] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package qtree
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//ReadLastN returns the last n points of the tree in time order, or all of
+//them if there are fewer. Only the right edge of the tree is descended,
+//reading children and leaves backwards until n points are found
+func (tr *QTree) ReadLastN(ctx context.Context, n int) ([]Record, bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.QueryCtxE(ctx)
+	}
+	if tr.root == nil || n <= 0 {
+		return []Record{}, nil
+	}
+	prealloc := n
+	if prealloc > ChanBufferSize {
+		prealloc = ChanBufferSize
+	}
+	rv := make([]Record, 0, prealloc)
+	if err := tr.root.readLastN(ctx, n, &rv); err != nil {
+		return nil, err
+	}
+	//They were collected newest first
+	for i, j := 0, len(rv)-1; i < j; i, j = i+1, j-1 {
+		rv[i], rv[j] = rv[j], rv[i]
+	}
+	return rv, nil
+}
+
+func (n *QTreeNode) readLastN(ctx context.Context, want int, rv *[]Record) bte.BTE {
+	if ctx.Err() != nil {
+		return bte.QueryCtxE(ctx)
+	}
+	if n.isLeaf {
+		for i := int(n.vector_block.Len) - 1; i >= 0 && len(*rv) < want; i-- {
+			*rv = append(*rv, Record{n.vector_block.Time[i], n.vector_block.Value[i]})
+		}
+		return nil
+	}
+	for b := int(KFACTOR) - 1; b >= 0 && len(*rv) < want; b-- {
+		if n.core_block.Addr[b] == 0 {
+			continue
+		}
+		c, err := n.Child(uint16(b))
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		err = c.readLastN(ctx, want, rv)
+		c.Free()
+		n.child_cache[b] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
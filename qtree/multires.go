@@ -0,0 +1,150 @@
+package qtree
+
+import (
+	"context"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A statistical record of a window of 2^PointWidth nanoseconds
+type MultiStatRecord struct {
+	PointWidth uint8
+	StatRecord
+}
+
+type multiresContext struct {
+	ctx context.Context
+	//Sorted ascending, without duplicates
+	pws []uint8
+	//The range of windows to emit at each pointwidth
+	starts []int64
+	ends   []int64
+	//The window being accumulated at each coarser pointwidth
+	wins []WindowContext
+	rv   chan MultiStatRecord
+}
+
+func (mc *multiresContext) send(pw uint8, r StatRecord) bool {
+	select {
+	case mc.rv <- MultiStatRecord{PointWidth: pw, StatRecord: r}:
+		return true
+	case <-mc.ctx.Done():
+		return false
+	}
+}
+
+//Emits the accumulated window at pws[i] if it is within range
+func (mc *multiresContext) emit(i int) bool {
+	w := &mc.wins[i]
+	if !w.Active {
+		return true
+	}
+	w.Active = false
+	if w.Time < mc.starts[i] || w.Time >= mc.ends[i] {
+		return true
+	}
+	return mc.send(mc.pws[i], StatRecord{
+		Time:  w.Time,
+		Count: w.Count,
+		Min:   w.Min,
+		Mean:  w.Total / float64(w.Count),
+		Max:   w.Max,
+	})
+}
+
+//Adds a record at the finest pointwidth, which arrive in time order
+func (mc *multiresContext) add(r StatRecord) bool {
+	if r.Time >= mc.starts[0] && r.Time < mc.ends[0] {
+		if !mc.send(mc.pws[0], r) {
+			return false
+		}
+	}
+	for i := 1; i < len(mc.pws); i++ {
+		w := &mc.wins[i]
+		ws := r.Time &^ ((1 << mc.pws[i]) - 1)
+		if w.Active && w.Time != ws {
+			if !mc.emit(i) {
+				return false
+			}
+		}
+		if !w.Active {
+			*w = WindowContext{Time: ws, Min: r.Min, Max: r.Max, Active: true}
+		}
+		w.Count += r.Count
+		w.Total += r.Mean * float64(r.Count)
+		if r.Min < w.Min {
+			w.Min = r.Min
+		}
+		if r.Max > w.Max {
+			w.Max = r.Max
+		}
+	}
+	return true
+}
+
+//QueryMultiResolution returns the statistical records of [start, end) at
+//each of the given pointwidths, which must be sorted ascending without
+//duplicates. The tree is walked once at the finest pointwidth and the coarser
+//windows are aggregated from its records, as they summarize the same nodes.
+//Records of each pointwidth are in time order, but the pointwidths are
+//interleaved. As with QueryStatisticalValues, the range of each pointwidth is
+//start and end rounded down to its window
+func (tr *QTree) QueryMultiResolution(ctx context.Context, start int64, end int64, pws []uint8) (chan MultiStatRecord, chan bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
+	}
+	rv := make(chan MultiStatRecord, ChanBufferSize)
+	rve := make(chan bte.BTE, 10)
+	if tr.root == nil || len(pws) == 0 {
+		close(rv)
+		return rv, rve
+	}
+	mc := &multiresContext{
+		ctx:    ctx,
+		pws:    pws,
+		starts: make([]int64, len(pws)),
+		ends:   make([]int64, len(pws)),
+		wins:   make([]WindowContext, len(pws)),
+		rv:     rv,
+	}
+	for i, pw := range pws {
+		mc.starts[i] = start &^ ((1 << pw) - 1)
+		mc.ends[i] = end &^ ((1 << pw) - 1)
+	}
+	//The coarsest windows start first, the finest end last
+	wstart := mc.starts[len(pws)-1]
+	wend := mc.ends[0]
+	go func() {
+		recordc, errc := tr.QueryStatisticalValues(ctx, wstart, wend, pws[0])
+		for {
+			select {
+			case err := <-errc:
+				rve <- err
+				return
+			case r, ok := <-recordc:
+				if !ok {
+					//The tree closes its channel after an error too
+					select {
+					case err := <-errc:
+						rve <- err
+						return
+					default:
+					}
+					for i := 1; i < len(pws); i++ {
+						if !mc.emit(i) {
+							rve <- bte.QueryCtxE(ctx)
+							return
+						}
+					}
+					close(rv)
+					return
+				}
+				if !mc.add(r) {
+					rve <- bte.QueryCtxE(ctx)
+					return
+				}
+			}
+		}
+	}()
+	return rv, rve
+}
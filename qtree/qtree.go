@@ -26,7 +26,7 @@ func init() {
 //record. For forwards, time is inclusive.
 func (n *QTreeNode) FindNearestValue(ctx context.Context, time int64, backwards bool) (Record, bte.BTE) {
 	if ctx.Err() != nil {
-		return Record{}, bte.CtxE(ctx)
+		return Record{}, bte.QueryCtxE(ctx)
 	}
 	if n.isLeaf {
 		if n.vector_block.Len == 0 {
@@ -77,7 +77,11 @@ func (n *QTreeNode) FindNearestValue(ctx context.Context, time int64, backwards
 		//for backwards, idx points to the containing window
 		//for forwards, idx points to the window after the containing window
 
-		val, err := n.Child(uint16(idx)).FindNearestValue(ctx, time, backwards)
+		c, cerr := n.Child(uint16(idx))
+		if cerr != nil {
+			return Record{}, cerr
+		}
+		val, err := c.FindNearestValue(ctx, time, backwards)
 
 		//For both, we also need the window before this point
 		if idx != 0 && n.core_block.Count[idx-1] != 0 { //The block containing the time is not empty
@@ -86,7 +90,11 @@ func (n *QTreeNode) FindNearestValue(ctx context.Context, time int64, backwards
 			//that FOLLOWS the time, because its possible for all the data points in the CONTAINS window to fall before
 			//the time. For backwards we have the same thing but VAL above is the CONTAINS window, and we need to check
 			//the BEFORE window
-			other, oerr := n.Child(uint16(idx-1)).FindNearestValue(ctx, time, backwards)
+			oc, cerr := n.Child(uint16(idx - 1))
+			if cerr != nil {
+				return Record{}, cerr
+			}
+			other, oerr := oc.FindNearestValue(ctx, time, backwards)
 			if oerr != nil {
 				//Oh well the standard window is the only option
 				return val, err
@@ -176,7 +184,7 @@ func (n *QTreeNode) FindNearestValue(ctx context.Context, time int64, backwards
 //NOSYNC }
 func (tr *QTree) FindChangedSince(ctx context.Context, gen uint64, resolution uint8) (chan ChangedRange, chan bte.BTE) {
 	if ctx.Err() != nil {
-		return nil, bte.Chan(bte.CtxE(ctx))
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
 	}
 	rv := make(chan ChangedRange, 1024)
 	rve := make(chan bte.BTE, 1)
@@ -199,7 +207,7 @@ func (tr *QTree) FindChangedSince(ctx context.Context, gen uint64, resolution ui
 	return rv, rve
 }
 
-func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
+func (n *QTreeNode) DeleteRange(start int64, end int64) (*QTreeNode, bte.BTE) {
 	if n.isLeaf {
 		widx, ridx := 0, 0
 		//First check if this operation deletes all the entries or only some
@@ -207,7 +215,7 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 			lg.Panicf("This shouldn't happen")
 		}
 		if start <= n.vector_block.Time[0] && end > n.vector_block.Time[n.vector_block.Len-1] {
-			return nil
+			return nil, nil
 		}
 		//Otherwise we need to copy the parts that still exist
 		//lg.Debug("Calling uppatch loc1")
@@ -226,13 +234,13 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 			ridx++
 		}
 		n.vector_block.Len = uint16(widx)
-		return n
+		return n, nil
 	} else {
 		if start <= n.StartTime() && end > n.EndTime() {
 			//This node is being deleted in its entirety. As we are no longer using the dereferences, we can
 			//prune the whole branch up here. Note that this _does_ leak references for all the children, but
 			//we are no longer using them
-			return nil
+			return nil, nil
 		}
 
 		//We have at least one reading somewhere in here not being deleted
@@ -258,9 +266,15 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 		newchildren := make([]*QTreeNode, 64)
 		nonnull := false
 		for i := sb; i <= eb; i++ {
-			ch := n.Child(i)
+			ch, err := n.Child(i)
+			if err != nil {
+				return nil, err
+			}
 			if ch != nil {
-				newchildren[i] = ch.DeleteRange(start, end)
+				newchildren[i], err = ch.DeleteRange(start, end)
+				if err != nil {
+					return nil, err
+				}
 				if newchildren[i] != nil {
 					nonnull = true
 					//The child might have done the uppatch
@@ -272,7 +286,7 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 		}
 
 		if !nonnull && !othernodes {
-			return nil
+			return nil, nil
 		} else {
 			//This node is not completely empty
 			newn, err := n.AssertNewUpPatch()
@@ -284,7 +298,7 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 			for i := sb; i <= eb; i++ {
 				n.SetChild(i, newchildren[i])
 			}
-			return n
+			return n, nil
 		}
 	}
 }
@@ -299,7 +313,7 @@ func (n *QTreeNode) DeleteRange(start int64, end int64) *QTreeNode {
 //			 the stuff in the chan will also need coalescence but not as much
 func (n *QTreeNode) FindChangedSince(ctx context.Context, gen uint64, rchan chan ChangedRange, echan chan bte.BTE, resolution uint8) ChangedRange {
 	if ctx.Err() != nil {
-		echan <- bte.CtxE(ctx)
+		echan <- bte.QueryCtxE(ctx)
 		return ChangedRange{}
 	}
 	if n.isLeaf {
@@ -352,7 +366,12 @@ func (n *QTreeNode) FindChangedSince(ctx context.Context, gen uint64, rchan chan
 					}
 				} else {
 					//We have a child, we need to recurse, and it has a worthy generation:
-					rcr := n.Child(uint16(k)).FindChangedSince(ctx, gen, rchan, echan, resolution)
+					c, err := n.Child(uint16(k))
+					if err != nil {
+						echan <- err
+						return ChangedRange{}
+					}
+					rcr := c.FindChangedSince(ctx, gen, rchan, echan, resolution)
 					if rcr.Valid {
 						if cr.Valid {
 							if rcr.Start == cr.End {
@@ -399,27 +418,37 @@ func (n *QTreeNode) HasChild(i uint16) bool {
 	}
 	return true
 }
-func (n *QTreeNode) Child(i uint16) *QTreeNode {
+//Returns the child in bucket i, or nil if there is none. If it could not be
+//loaded, because of a storage error or the tree's context ending, the error
+//is returned
+func (n *QTreeNode) Child(i uint16) (*QTreeNode, bte.BTE) {
 	//lg.Debug("Child %v called on %v",i, n.TreePath())
 	if n.isLeaf {
 		lg.Panicf("Child of leaf?")
 	}
 	if n.core_block.Addr[i] == 0 {
-		return nil
+		return nil, nil
 	}
 	if n.child_cache[i] != nil {
-		return n.child_cache[i]
+		return n.child_cache[i], nil
 	}
 
-	child := n.tr.LoadNode(n.core_block.Addr[i],
+	child, err := n.tr.LoadNode(n.core_block.Addr[i],
 		n.core_block.CGeneration[i], n.ChildPW(), n.ChildStartTime(i))
+	//Only read trees have a context that can end
+	if err != nil && n.tr.ctx.Err() != nil {
+		return nil, bte.QueryCtxE(n.tr.ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
 	child.parent = n
 	n.child_cache[i] = child
-	return child
+	return child, nil
 }
 
 //Like Child() but creates the node if it doesn't exist
-func (n *QTreeNode) wchild(i uint16, isVector bool) *QTreeNode {
+func (n *QTreeNode) wchild(i uint16, isVector bool) (*QTreeNode, bte.BTE) {
 	if n.isLeaf {
 		lg.Panicf("Child of leaf?")
 	}
@@ -444,16 +473,19 @@ func (n *QTreeNode) wchild(i uint16, isVector bool) *QTreeNode {
 		newn.parent = n
 		n.child_cache[i] = newn
 		n.core_block.Addr[i] = newn.ThisAddr()
-		return newn
+		return newn, nil
 	}
 	if n.child_cache[i] != nil {
-		return n.child_cache[i]
+		return n.child_cache[i], nil
 	}
-	child := n.tr.LoadNode(n.core_block.Addr[i],
+	child, err := n.tr.LoadNode(n.core_block.Addr[i],
 		n.core_block.CGeneration[i], n.ChildPW(), n.ChildStartTime(i))
+	if err != nil {
+		return nil, err
+	}
 	child.parent = n
 	n.child_cache[i] = child
-	return child
+	return child, nil
 }
 
 //This function assumes that n is already new
@@ -614,6 +646,15 @@ func (n *QTreeNode) ConvertToCore(newvals []Record) *QTreeNode {
  * that the data is sorted, so we do that here
  */
 func (tr *QTree) InsertValues(records []Record) (e bte.BTE) {
+	return tr.insertValues(records, false)
+}
+
+//InsertSortedValues is InsertValues for records already in time order
+func (tr *QTree) InsertSortedValues(records []Record) bte.BTE {
+	return tr.insertValues(records, true)
+}
+
+func (tr *QTree) insertValues(records []Record, sorted bool) (e bte.BTE) {
 	if tr.gen == nil {
 		panic("nil generation on tree?")
 	}
@@ -640,7 +681,9 @@ func (tr *QTree) InsertValues(records []Record) (e bte.BTE) {
 	// 		e = ErrBadInsert
 	// 	}
 	// }()
-	sort.Sort(RecordSlice(proc_records))
+	if !sorted {
+		sort.Sort(RecordSlice(proc_records))
+	}
 	n, err := tr.root.InsertValues(proc_records)
 	if err != nil {
 		return bte.ErrW(bte.InsertFailure, "insert failure", err)
@@ -651,11 +694,14 @@ func (tr *QTree) InsertValues(records []Record) (e bte.BTE) {
 	return nil
 }
 
-func (tr *QTree) DeleteRange(start int64, end int64) error {
+func (tr *QTree) DeleteRange(start int64, end int64) bte.BTE {
 	if tr.gen == nil {
 		lg.Panicf("nil gen?")
 	}
-	n := tr.root.DeleteRange(start, end)
+	n, err := tr.root.DeleteRange(start, end)
+	if err != nil {
+		return err
+	}
 	tr.root = n
 	if n == nil {
 		tr.gen.UpdateRootAddr(0)
@@ -742,9 +788,13 @@ func (n *QTreeNode) InsertValues(records []Record) (*QTreeNode, error) {
 				if n.ChildPW() == 0 {
 					childisleaf = true
 				}
-				newchild, err := n.wchild(lbuckt, childisleaf).InsertValues(records[lidx:idx])
+				c, cerr := n.wchild(lbuckt, childisleaf)
+				if cerr != nil {
+					return nil, cerr
+				}
+				newchild, err := c.InsertValues(records[lidx:idx])
 				if err != nil {
-					lg.Panicf("%v", err)
+					return nil, err
 				}
 				n.SetChild(lbuckt, newchild) //This should set parent link too
 				lidx = idx
@@ -752,10 +802,14 @@ func (n *QTreeNode) InsertValues(records []Record) (*QTreeNode, error) {
 			}
 		}
 		//lg.Debug("reched end of records. flushing to child %v", buckt)
-		newchild, err := n.wchild(lbuckt, (len(records)-lidx) < bstore.VSIZE).InsertValues(records[lidx:])
+		c, cerr := n.wchild(lbuckt, (len(records)-lidx) < bstore.VSIZE)
+		if cerr != nil {
+			return nil, cerr
+		}
+		newchild, err := c.InsertValues(records[lidx:])
 		//lg.Debug("Address of new child was %08x", newchild.ThisAddr())
 		if err != nil {
-			lg.Panicf("%v", err)
+			return nil, err
 		}
 		n.SetChild(lbuckt, newchild)
 
@@ -765,13 +819,68 @@ func (n *QTreeNode) InsertValues(records []Record) (*QTreeNode, error) {
 
 var ErrBadTimeRange error = errors.New("Invalid time range")
 
+//A comparison operator for a ValueFilter
+type FilterOp string
+
+const (
+	FilterLT FilterOp = "<"
+	FilterLE FilterOp = "<="
+	FilterGT FilterOp = ">"
+	FilterGE FilterOp = ">="
+	FilterEQ FilterOp = "=="
+	FilterNE FilterOp = "!="
+)
+
+//A comparison of each raw value against a constant. This is deliberately
+//not a closure so that it can be serialized
+type ValueFilter struct {
+	Op    FilterOp
+	Value float64
+}
+
+func (f *ValueFilter) Valid() bool {
+	switch f.Op {
+	case FilterLT, FilterLE, FilterGT, FilterGE, FilterEQ, FilterNE:
+		return true
+	}
+	return false
+}
+
+//A nil filter matches everything
+func (f *ValueFilter) Matches(v float64) bool {
+	if f == nil {
+		return true
+	}
+	switch f.Op {
+	case FilterLT:
+		return v < f.Value
+	case FilterLE:
+		return v <= f.Value
+	case FilterGT:
+		return v > f.Value
+	case FilterGE:
+		return v >= f.Value
+	case FilterEQ:
+		return v == f.Value
+	case FilterNE:
+		return v != f.Value
+	}
+	return false
+}
+
 //start is inclusive, end is exclusive. To query a specific nanosecond, query (n, n+1)
 func (tr *QTree) ReadStandardValuesCI(ctx context.Context, start int64, end int64) (chan Record, chan bte.BTE) {
+	return tr.ReadFilteredValuesCI(ctx, start, end, nil)
+}
+
+//Like ReadStandardValuesCI but only emits points matching the filter, which
+//is evaluated at the leaves
+func (tr *QTree) ReadFilteredValuesCI(ctx context.Context, start int64, end int64, filter *ValueFilter) (chan Record, chan bte.BTE) {
 	rv := make(chan Record, ChanBufferSize)
 	rve := make(chan bte.BTE, 10)
 	if tr.root != nil {
 		go func() {
-			tr.root.ReadStandardValuesCI(ctx, rv, rve, start, end)
+			tr.root.ReadStandardValuesCI(ctx, rv, rve, start, end, filter)
 			close(rv)
 		}()
 	} else {
@@ -826,7 +935,7 @@ type WindowContext struct {
 
 func (tr *QTree) QueryStatisticalValues(ctx context.Context, start int64, end int64, pw uint8) (chan StatRecord, chan bte.BTE) {
 	if ctx.Err() != nil {
-		return nil, bte.Chan(bte.CtxE(ctx))
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
 	}
 	rv := make(chan StatRecord, ChanBufferSize)
 	rve := make(chan bte.BTE, 10)
@@ -875,6 +984,20 @@ type childpromise struct {
 
 func (n *QTreeNode) QueryStatisticalValues(ctx context.Context, rv chan StatRecord, err chan bte.BTE,
 	start int64, end int64, pw uint8) {
+	n.queryStatisticalValues(ctx, err, start, end, pw, 0, unlimitedDepth, func(r StatRecord, _ uint8, _ bool) {
+		rv <- r
+	})
+}
+
+//Passed as maxDepth to descend as far as the pointwidth needs
+const unlimitedDepth = 255
+
+//Emits the records of QueryStatisticalValues, descending at most maxDepth
+//levels below the node it was first called on (at depth 0). A core at the
+//limit whose children are finer than pw emits its children's summaries
+//instead, with their pointwidth and approx set
+func (n *QTreeNode) queryStatisticalValues(ctx context.Context, err chan bte.BTE,
+	start int64, end int64, pw uint8, depth uint8, maxDepth uint8, emit func(r StatRecord, rpw uint8, approx bool)) {
 	if bte.ChkContextError(ctx, err) {
 		return
 	}
@@ -889,12 +1012,12 @@ func (n *QTreeNode) QueryStatisticalValues(ctx context.Context, rv chan StatReco
 			b := n.ClampVBucket(n.vector_block.Time[idx], pw)
 			count, min, mean, max := n.OpReduce(pw, uint64(b))
 			if count != 0 {
-				rv <- StatRecord{Time: n.ArbitraryStartTime(b, pw),
+				emit(StatRecord{Time: n.ArbitraryStartTime(b, pw),
 					Count: count,
 					Min:   min,
 					Mean:  mean,
 					Max:   max,
-				}
+				}, pw, false)
 				//Skip over records in the vector that the PW included
 				idx += int(count - 1)
 			}
@@ -904,7 +1027,7 @@ func (n *QTreeNode) QueryStatisticalValues(ctx context.Context, rv chan StatReco
 
 		sb := n.ClampBucket(start) //TODO check this function handles out of range
 		eb := n.ClampBucket(end)
-		recurse := pw < n.PointWidth()
+		recurse := pw < n.PointWidth() && depth < maxDepth
 		if recurse {
 			//Parallel resolution of children
 			//don't use n.Child() because its not threadsafe
@@ -918,33 +1041,106 @@ func (n *QTreeNode) QueryStatisticalValues(ctx context.Context, rv chan StatReco
 				if bte.ChkContextError(ctx, err) {
 					return
 				}
-				c := n.Child(b)
+				c, cerr := n.Child(b)
+				if cerr != nil {
+					err <- cerr
+					return
+				}
 				if c != nil {
-					c.QueryStatisticalValues(ctx, rv, err, start, end, pw)
+					c.queryStatisticalValues(ctx, err, start, end, pw, depth+1, maxDepth, emit)
 					c.Free()
 					n.child_cache[b] = nil
 				}
 			}
 		} else {
-			//Ok we are at the correct level and we are a core
-			pwdelta := pw - n.PointWidth()
+			//Ok we are at the correct level and we are a core, or we are at
+			//the depth limit and summarize each child
+			approx := pw < n.PointWidth()
+			rpw := pw
+			if approx {
+				rpw = n.PointWidth()
+			}
+			pwdelta := rpw - n.PointWidth()
 			sidx := sb >> pwdelta
 			eidx := eb >> pwdelta
 			for b := sidx; b <= eidx; b++ {
-				count, min, mean, max := n.OpReduce(pw, uint64(b))
+				count, min, mean, max := n.OpReduce(rpw, uint64(b))
 				if count != 0 {
-					rv <- StatRecord{Time: n.ChildStartTime(b << pwdelta),
+					emit(StatRecord{Time: n.ChildStartTime(b << pwdelta),
 						Count: count,
 						Min:   min,
 						Mean:  mean,
 						Max:   max,
-					}
+					}, rpw, approx)
 				}
 			}
 		}
 	}
 }
 
+//QueryCount returns the exact number of points in [start, end). Children that are
+//wholly contained in the range are counted from the parent's summary, so only
+//the nodes straddling the range edges are descended into
+func (tr *QTree) QueryCount(ctx context.Context, start int64, end int64) (uint64, bte.BTE) {
+	if ctx.Err() != nil {
+		return 0, bte.QueryCtxE(ctx)
+	}
+	if tr.root == nil {
+		return 0, nil
+	}
+	return tr.root.QueryCount(ctx, start, end)
+}
+
+func (n *QTreeNode) QueryCount(ctx context.Context, start int64, end int64) (uint64, bte.BTE) {
+	if ctx.Err() != nil {
+		return 0, bte.QueryCtxE(ctx)
+	}
+	if n.isLeaf {
+		cnt := uint64(0)
+		for i := 0; i < int(n.vector_block.Len); i++ {
+			if n.vector_block.Time[i] < start {
+				continue
+			}
+			if n.vector_block.Time[i] >= end {
+				break
+			}
+			cnt++
+		}
+		return cnt, nil
+	}
+	total := uint64(0)
+	for b := uint16(0); b < KFACTOR; b++ {
+		if n.core_block.Count[b] == 0 {
+			continue
+		}
+		cs := n.ChildStartTime(b)
+		ce := n.ChildEndTime(b)
+		if ce <= start || cs >= end {
+			continue
+		}
+		if cs >= start && ce <= end {
+			//Whole child is inside the range, no need to descend
+			total += n.core_block.Count[b]
+			continue
+		}
+		c, err := n.Child(b)
+		if err != nil {
+			return 0, err
+		}
+		if c == nil {
+			continue
+		}
+		cnt, err := c.QueryCount(ctx, start, end)
+		c.Free()
+		n.child_cache[b] = nil
+		if err != nil {
+			return 0, err
+		}
+		total += cnt
+	}
+	return total, nil
+}
+
 //Although we keep caches of datablocks in the bstore, we can't actually free them until
 //they are unreferenced. This dropcache actually just makes sure they are unreferenced
 func (n *QTreeNode) Free() {
@@ -962,11 +1158,14 @@ func (n *QTreeNode) Free() {
 }
 
 func (n *QTreeNode) ReadStandardValuesCI(ctx context.Context, rv chan Record, err chan bte.BTE,
-	start int64, end int64) {
+	start int64, end int64, filter *ValueFilter) {
 	if end <= start {
 		panic("end <= start")
 		//return
 	}
+	if bte.ChkContextError(ctx, err) {
+		return
+	}
 	if n.isLeaf {
 		//lg.Debug("rsvci = leaf len(%v)", n.vector_block.Len)
 		//Currently going under assumption that buckets are sorted
@@ -974,7 +1173,9 @@ func (n *QTreeNode) ReadStandardValuesCI(ctx context.Context, rv chan Record, er
 		for i := 0; i < int(n.vector_block.Len); i++ {
 			if n.vector_block.Time[i] >= start {
 				if n.vector_block.Time[i] < end {
-					rv <- Record{n.vector_block.Time[i], n.vector_block.Value[i]}
+					if filter.Matches(n.vector_block.Value[i]) {
+						rv <- Record{n.vector_block.Time[i], n.vector_block.Value[i]}
+					}
 				} else {
 					//Hitting a value past end means we are done with the query as a whole
 					//we just need to clean up our memory now
@@ -1003,11 +1204,18 @@ func (n *QTreeNode) ReadStandardValuesCI(ctx context.Context, rv chan Record, er
 		//lg.Debug("rsvci s/e %v/%v",sbuck, ebuck)
 		for buck := sbuck; buck < ebuck; buck++ {
 			//lg.Debug("walking over child %v", buck)
-			c := n.Child(buck)
+			if bte.ChkContextError(ctx, err) {
+				return
+			}
+			c, cerr := n.Child(buck)
+			if cerr != nil {
+				err <- cerr
+				return
+			}
 			if c != nil {
 				//lg.Debug("child existed")
 				//lg.Debug("rscvi descending from pw(%v) into [%v]", n.PointWidth(),buck)
-				c.ReadStandardValuesCI(ctx, rv, err, start, end)
+				c.ReadStandardValuesCI(ctx, rv, err, start, end, filter)
 				c.Free()
 				n.child_cache[buck] = nil
 			}
@@ -1087,8 +1295,14 @@ func (n *QTreeNode) QueryWindow(ctx context.Context, end int64, nxtstart *int64,
 				//The bucket went past nxtstart, so we need to fragment
 				if n.HasChild(buckid) {
 					if n.ChildPW() >= depth {
-						n.Child(buckid).QueryWindow(ctx, end, nxtstart, width, depth, rv, rve, wctx)
-						if wctx.Done {
+						c, err := n.Child(buckid)
+						if err != nil {
+							rve <- err
+							wctx.Done = true
+							return
+						}
+						c.QueryWindow(ctx, end, nxtstart, width, depth, rv, rve, wctx)
+						if wctx.Done || ctx.Err() != nil {
 							return
 						}
 					} else {
@@ -7,6 +7,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
 	"github.com/SoftwareDefinedBuildings/btrdb/internal/bstore"
 	"github.com/pborman/uuid"
 )
@@ -31,6 +32,10 @@ type QTree struct {
 	gen      *bstore.Generation
 	root     *QTreeNode
 	commited bool
+	//Limits the read handles used loading nodes, nil is unlimited
+	budget bprovider.ReadBudget
+	//Loading nodes gives up once this is done
+	ctx context.Context
 }
 
 type Record struct {
@@ -68,7 +73,9 @@ func (s RecordSlice) Less(i, j int) bool {
 	return s[i].Time < s[j].Time
 }
 
-func (tr *QTree) Commit() {
+//Writes the tree's generation. On error nothing is committed and the tree is
+//released as though aborted
+func (tr *QTree) Commit() bte.BTE {
 	if tr.commited {
 		log.Panicf("Tree alredy comitted")
 	}
@@ -76,10 +83,22 @@ func (tr *QTree) Commit() {
 		log.Panicf("Commit on non-write-tree")
 	}
 
-	tr.gen.Commit()
-	tr.commited = true
+	_, err := tr.gen.Commit()
 	tr.gen = nil
+	if err != nil {
+		return bte.ErrW(bte.InsertFailure, "could not commit generation", err)
+	}
+	tr.commited = true
+	return nil
+}
 
+//Releases a write tree without writing anything
+func (tr *QTree) Abort() {
+	if tr.gen == nil {
+		log.Panicf("Abort on non-write-tree")
+	}
+	tr.gen.Abort()
+	tr.gen = nil
 }
 
 func (n *QTree) FindNearestValue(ctx context.Context, time int64, backwards bool) (Record, bte.BTE) {
@@ -118,8 +137,12 @@ func (n *QTree) Generation() uint64 {
 // 	return refset
 // }
 
-func (tr *QTree) LoadNode(addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) *QTreeNode {
-	db := tr.bs.ReadDatablock(tr.sb.Uuid(), addr, impl_Generation, impl_Pointwidth, impl_StartTime)
+//Returns BlockCorrupt if the block cannot be read
+func (tr *QTree) LoadNode(addr uint64, impl_Generation uint64, impl_Pointwidth uint8, impl_StartTime int64) (*QTreeNode, bte.BTE) {
+	db, err := tr.bs.ReadDatablockBudgeted(tr.ctx, tr.sb.Uuid(), addr, impl_Generation, impl_Pointwidth, impl_StartTime, tr.budget)
+	if err != nil {
+		return nil, err
+	}
 	n := &QTreeNode{tr: tr}
 	switch db.GetDatablockType() {
 	case bstore.Vector:
@@ -134,7 +157,7 @@ func (tr *QTree) LoadNode(addr uint64, impl_Generation uint64, impl_Pointwidth u
 	if n.ThisAddr() == 0 {
 		log.Panicf("Node has zero address")
 	}
-	return n
+	return n, nil
 }
 
 func (tr *QTree) NewCoreNode(startTime int64, pointWidth uint8) *QTreeNode {
@@ -174,13 +197,25 @@ func (tr *QTree) NewVectorNode(startTime int64, pointWidth uint8) *QTreeNode {
  * Load a quasar tree
  */
 func NewReadQTree(bs *bstore.BlockStore, id uuid.UUID, generation uint64) (*QTree, bte.BTE) {
-	sb := bs.LoadSuperblock(id, generation)
+	return NewReadQTreeBudgeted(context.Background(), bs, id, generation, nil)
+}
+
+//As NewReadQTree, but nodes are read using at most budget read handles, and
+//reads stop with a context error once ctx is done
+func NewReadQTreeBudgeted(ctx context.Context, bs *bstore.BlockStore, id uuid.UUID, generation uint64, budget bprovider.ReadBudget) (*QTree, bte.BTE) {
+	sb, err := bs.LoadSuperblock(id, generation)
+	if err != nil {
+		return nil, err
+	}
 	if sb == nil {
 		return nil, bte.Err(bte.NoSuchStream, "stream not found")
 	}
-	rv := &QTree{sb: sb, bs: bs}
+	rv := &QTree{sb: sb, bs: bs, budget: budget, ctx: ctx}
 	if sb.Root() != 0 {
-		rt := rv.LoadNode(sb.Root(), sb.Gen(), ROOTPW, ROOTSTART)
+		rt, err := rv.LoadNode(sb.Root(), sb.Gen(), ROOTPW, ROOTSTART)
+		if err != nil {
+			return nil, err
+		}
 		//log.Debug("The start time for the root is %v",rt.StartTime())
 		rv.root = rt
 	}
@@ -196,12 +231,17 @@ func NewWriteQTree(bs *bstore.BlockStore, id uuid.UUID) (*QTree, bte.BTE) {
 		sb:  gen.New_SB,
 		gen: gen,
 		bs:  bs,
+		ctx: context.Background(),
 	}
 
 	//If there is an existing root node, we need to load it so that it
 	//has the correct values
 	if rv.sb.Root() != 0 {
-		rt := rv.LoadNode(rv.sb.Root(), rv.sb.Gen(), ROOTPW, ROOTSTART)
+		rt, err := rv.LoadNode(rv.sb.Root(), rv.sb.Gen(), ROOTPW, ROOTSTART)
+		if err != nil {
+			gen.Abort()
+			return nil, err
+		}
 		rv.root = rt
 	} else {
 		rt := rv.NewCoreNode(ROOTSTART, ROOTPW)
@@ -0,0 +1,174 @@
+package qtree
+
+import (
+	"context"
+	"math"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+)
+
+//A StatRecord along with the population variance of the window
+type VarStatRecord struct {
+	StatRecord
+	Variance float64
+}
+
+func (r VarStatRecord) StdDev() float64 {
+	return math.Sqrt(r.Variance)
+}
+
+//Accumulates a window with Chan et al's parallel variance update, keeping
+//the sum of squared differences from the mean
+type varWindow struct {
+	time  int64
+	count uint64
+	mean  float64
+	m2    float64
+	min   float64
+	max   float64
+}
+
+func (w *varWindow) merge(count uint64, mean float64, m2 float64, min float64, max float64) {
+	if w.count == 0 {
+		w.min = min
+		w.max = max
+	}
+	if min < w.min {
+		w.min = min
+	}
+	if max > w.max {
+		w.max = max
+	}
+	n := float64(w.count + count)
+	delta := mean - w.mean
+	w.m2 += m2 + delta*delta*float64(w.count)*float64(count)/n
+	w.mean += delta * float64(count) / n
+	w.count += count
+}
+
+type varContext struct {
+	ctx   context.Context
+	start int64
+	end   int64
+	pw    uint8
+	rv    chan VarStatRecord
+	cur   *varWindow
+}
+
+//Adds to the window containing t. Windows are visited in time order, so a
+//new window means the last one is complete
+func (vc *varContext) add(t int64, count uint64, mean float64, m2 float64, min float64, max float64) bte.BTE {
+	ws := t &^ ((1 << vc.pw) - 1)
+	if vc.cur != nil && vc.cur.time != ws {
+		if err := vc.emit(); err != nil {
+			return err
+		}
+	}
+	if vc.cur == nil {
+		vc.cur = &varWindow{time: ws}
+	}
+	vc.cur.merge(count, mean, m2, min, max)
+	return nil
+}
+
+func (vc *varContext) emit() bte.BTE {
+	if vc.cur == nil {
+		return nil
+	}
+	w := vc.cur
+	r := VarStatRecord{
+		StatRecord: StatRecord{Time: w.time, Count: w.count, Min: w.min, Mean: w.mean, Max: w.max},
+		Variance:   w.m2 / float64(w.count),
+	}
+	select {
+	case vc.rv <- r:
+	case <-vc.ctx.Done():
+		return bte.QueryCtxE(vc.ctx)
+	}
+	vc.cur = nil
+	return nil
+}
+
+//QueryStatisticalValuesVariance is QueryStatisticalValues with the variance
+//of each window. The tree stores no sums of squares, so windows are computed
+//from the points in the leaves, except that a child whose min and max are
+//equal has no variance and is taken from its parent's summary. This costs
+//about as much as reading the raw values, so it is a separate query
+func (tr *QTree) QueryStatisticalValuesVariance(ctx context.Context, start int64, end int64, pw uint8) (chan VarStatRecord, chan bte.BTE) {
+	if ctx.Err() != nil {
+		return nil, bte.Chan(bte.QueryCtxE(ctx))
+	}
+	rv := make(chan VarStatRecord, ChanBufferSize)
+	rve := make(chan bte.BTE, 10)
+	if tr.root == nil {
+		close(rv)
+		return rv, rve
+	}
+	vc := &varContext{ctx: ctx, start: start, end: end, pw: pw, rv: rv}
+	go func() {
+		err := tr.root.queryVariance(vc)
+		if err == nil {
+			err = vc.emit()
+		}
+		if err != nil {
+			rve <- err
+		}
+		close(rv)
+	}()
+	return rv, rve
+}
+
+func (n *QTreeNode) queryVariance(vc *varContext) bte.BTE {
+	if vc.ctx.Err() != nil {
+		return bte.QueryCtxE(vc.ctx)
+	}
+	if n.isLeaf {
+		for i := 0; i < int(n.vector_block.Len); i++ {
+			t := n.vector_block.Time[i]
+			if t < vc.start {
+				continue
+			}
+			if t >= vc.end {
+				break
+			}
+			v := n.vector_block.Value[i]
+			if err := vc.add(t, 1, v, 0, v, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for b := uint16(0); b < KFACTOR; b++ {
+		if n.core_block.Count[b] == 0 {
+			continue
+		}
+		cs := n.ChildStartTime(b)
+		ce := n.ChildEndTime(b)
+		if ce <= vc.start || cs >= vc.end {
+			continue
+		}
+		//The child is within one window and the range, and all of its values
+		//are the same
+		if n.PointWidth() <= vc.pw && cs >= vc.start && ce <= vc.end && n.core_block.Min[b] == n.core_block.Max[b] {
+			v := n.core_block.Min[b]
+			if err := vc.add(cs, n.core_block.Count[b], v, 0, v, v); err != nil {
+				return err
+			}
+			continue
+		}
+		c, err := n.Child(b)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		err = c.queryVariance(vc)
+		c.Free()
+		n.child_cache[b] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
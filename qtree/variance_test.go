@@ -0,0 +1,33 @@
+package qtree
+
+import (
+	"math"
+	"testing"
+)
+
+func TestVarWindowMerge(t *testing.T) {
+	vals := []float64{2, 4, 4, 4, 5, 5, 7, 9}
+	//Point by point
+	var a varWindow
+	for _, v := range vals {
+		a.merge(1, v, 0, v, v)
+	}
+	//Two halves merged, as when children are combined
+	var l, r, b varWindow
+	for _, v := range vals[:3] {
+		l.merge(1, v, 0, v, v)
+	}
+	for _, v := range vals[3:] {
+		r.merge(1, v, 0, v, v)
+	}
+	b.merge(l.count, l.mean, l.m2, l.min, l.max)
+	b.merge(r.count, r.mean, r.m2, r.min, r.max)
+	for _, w := range []varWindow{a, b} {
+		if w.count != 8 || w.mean != 5 || w.min != 2 || w.max != 9 {
+			t.Fatalf("bad summary %+v", w)
+		}
+		if v := w.m2 / float64(w.count); math.Abs(v-4) > 1e-9 {
+			t.Fatalf("expected variance 4, got %v", v)
+		}
+	}
+}
@@ -3,7 +3,9 @@ package btrdb
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"golang.org/x/net/context"
 
@@ -24,12 +26,22 @@ func init() {
 
 type openTree struct {
 	store []qtree.Record
-	id    uuid.UUID
-	sigEC chan bool
+	//Approximate memory used by store
+	bytes int
+	//True if store is known to be in time order, so need not be sorted
+	sorted bool
+	id     uuid.UUID
+	//Stops the coalesce timer of the buffered points
+	cancel context.CancelFunc
+	//Set once the tree is committed on shutdown, no more points are taken
+	closed bool
 }
 
-const MinimumTime = -(16 << 56)
-const MaximumTime = (48 << 56)
+//The in-memory size of a buffered point
+const recordSize = int(unsafe.Sizeof(qtree.Record{}))
+
+const MinimumTime = qtree.MinimumTime
+const MaximumTime = qtree.MaximumTime
 const LatestGeneration = bstore.LatestGeneration
 
 type Quasar struct {
@@ -40,10 +52,35 @@ type Quasar struct {
 	globlock  sync.Mutex
 	treelocks map[[16]byte]*sync.Mutex
 	openTrees map[[16]byte]*openTree
+
+	//Streams known to exist, to skip the storage round trip
+	exists *existCache
+
+	//The bucket bounds of histogram queries
+	histBounds []float64
+
+	//Coalesce timers are derived from this, it is cancelled on shutdown
+	ctx    context.Context
+	cancel context.CancelFunc
+	//Set under globlock when shutdown begins, no more trees are opened
+	shuttingDown bool
 }
 
+//The defaults for the histogram buckets
+const DefaultHistogramMin = 1.0
+const DefaultHistogramFactor = 2.0
+const DefaultHistogramBuckets = 32
+
+//How many streams are committed at once on shutdown, unless configured
+const DefaultShutdownWorkers = 16
+
+//How often shutdown logs how many streams it has committed
+const ShutdownProgressInterval = 5 * time.Second
+
 func (q *Quasar) newOpenTree(id uuid.UUID) (*openTree, bte.BTE) {
-	if q.bs.StreamExists(id) {
+	mk := bstore.UUIDToMapKey(id)
+	if q.exists.contains(mk) || q.bs.StreamExists(id) {
+		q.exists.add(mk)
 		return &openTree{
 			id: id,
 		}, nil
@@ -58,6 +95,32 @@ func (q *Quasar) GetClusterConfiguration() configprovider.ClusterConfiguration {
 	return q.cfg.(configprovider.ClusterConfiguration)
 }
 
+// Queries against a stream whose write lock is held elsewhere would miss the
+// points buffered on the owning node, so they are rejected unless the cluster
+// is configured to accept stale reads. A read replica never holds write locks,
+// so it always reads from storage
+func (q *Quasar) checkReadable(id uuid.UUID) bte.BTE {
+	if !q.cfg.ClusterEnabled() || q.cfg.ClusterAllowStaleReads() || q.cfg.StorageCephReadOnly() {
+		return nil
+	}
+	if !q.GetClusterConfiguration().WeHoldWriteLockFor(id) {
+		return bte.Err(bte.WrongEndpoint, "This is the wrong endpoint for this stream")
+	}
+	return nil
+}
+
+// CheckWritable returns an error if points cannot be written to the stream
+// here, because this is a read replica or another node holds its write lock
+func (q *Quasar) CheckWritable(id uuid.UUID) bte.BTE {
+	if q.cfg.StorageCephReadOnly() {
+		return bte.Err(bte.ReadOnly, "This node is a read replica")
+	}
+	if !q.GetClusterConfiguration().WeHoldWriteLockFor(id) {
+		return bte.Err(bte.WrongEndpoint, "This is the wrong endpoint for this stream")
+	}
+	return nil
+}
+
 // Return true if there are uncommited results to be written to disk
 // Should only be used during shutdown as it hogs the glock
 //XTAG func (q *Quasar) IsPending() bool {
@@ -87,12 +150,38 @@ func NewQuasar(cfg configprovider.Configuration) (*Quasar, error) {
 		openTrees: make(map[[16]byte]*openTree, 128),
 		treelocks: make(map[[16]byte]*sync.Mutex, 128),
 	}
+	ecsize := cfg.StreamExistsCache()
+	if ecsize == 0 {
+		ecsize = DefaultStreamExistsCache
+	}
+	rv.exists = newExistCache(ecsize)
+	hmin := cfg.QueryHistogramMin()
+	if hmin == 0 {
+		hmin = DefaultHistogramMin
+	}
+	hfactor := cfg.QueryHistogramFactor()
+	if hfactor == 0 {
+		hfactor = DefaultHistogramFactor
+	}
+	hbuckets := cfg.QueryHistogramBuckets()
+	if hbuckets == 0 {
+		hbuckets = DefaultHistogramBuckets
+	}
+	if hmin <= 0 || hfactor <= 1 || hbuckets < 0 {
+		return nil, fmt.Errorf("histogram buckets must have a positive min and a factor above 1")
+	}
+	rv.histBounds = qtree.LogBuckets(hmin, hfactor, hbuckets)
+	rv.ctx, rv.cancel = context.WithCancel(context.Background())
 	return rv, nil
 }
 
 func (q *Quasar) getTree(id uuid.UUID) (*openTree, *sync.Mutex, bte.BTE) {
 	mk := bstore.UUIDToMapKey(id)
 	q.globlock.Lock()
+	if q.shuttingDown {
+		q.globlock.Unlock()
+		return nil, nil, bte.Err(bte.ShuttingDown, "The server is shutting down")
+	}
 	ot, ok := q.openTrees[mk]
 	if !ok {
 		ot, err := q.newOpenTree(id)
@@ -114,71 +203,257 @@ func (q *Quasar) getTree(id uuid.UUID) (*openTree, *sync.Mutex, bte.BTE) {
 	return ot, mtx, nil
 }
 
-func (t *openTree) commit(q *Quasar) {
+//On error the buffered points are kept, nothing is written. The context is
+//checked before the tree is opened and before it is committed, the commit
+//itself cannot be interrupted
+func (t *openTree) commit(ctx context.Context, q *Quasar) bte.BTE {
 	if len(t.store) == 0 {
 		//This might happen with a race in the timeout commit
 		fmt.Println("no store in commit")
-		return
+		return nil
+	}
+	if ctx.Err() != nil {
+		return bte.CtxE(ctx)
 	}
 	tr, err := qtree.NewWriteQTree(q.bs, t.id)
 	if err != nil {
-		lg.Panicf("oh dear: %v", err)
+		return err
 	}
-	if err := tr.InsertValues(t.store); err != nil {
-		lg.Panicf("we should not allow this: %v", err)
+	insert := tr.InsertValues
+	if t.sorted {
+		insert = tr.InsertSortedValues
+	}
+	if err := insert(t.store); err != nil {
+		tr.Abort()
+		return err
+	}
+	if ctx.Err() != nil {
+		tr.Abort()
+		return bte.CtxE(ctx)
+	}
+	if err := tr.Commit(); err != nil {
+		return err
 	}
-	tr.Commit()
 	t.store = nil
+	t.bytes = 0
+	return nil
+}
+
+type readBudgetKey struct{}
+
+//WithReadBudget returns a context that limits every query made with it to
+//holding at most the given number of storage read handles at once. Without
+//one, each query gets the configured QueryReadHandles budget
+func WithReadBudget(ctx context.Context, handles int) context.Context {
+	return context.WithValue(ctx, readBudgetKey{}, bprovider.NewReadBudget(handles))
+}
+
+//Opens a tree for a query, reading under the budget in the context if there
+//is one, otherwise under a new budget of the configured size
+func (q *Quasar) newReadTree(ctx context.Context, id uuid.UUID, gen uint64) (*qtree.QTree, bte.BTE) {
+	budget, ok := ctx.Value(readBudgetKey{}).(bprovider.ReadBudget)
+	if !ok {
+		budget = bprovider.NewReadBudget(q.cfg.QueryReadHandles())
+	}
+	return qtree.NewReadQTreeBudgeted(ctx, q.bs, id, gen, budget)
+}
+
+//CreateStream creates a stream in storage and remembers that it exists, so
+//the first insert into it does not need to check
+func (q *Quasar) CreateStream(id uuid.UUID, collection string, tags map[string]string, annotation []byte) bte.BTE {
+	err := q.bs.StorageProvider().CreateStream(id, collection, tags, annotation)
+	if err != nil {
+		return err
+	}
+	q.exists.add(bstore.UUIDToMapKey(id))
+	return nil
 }
+
 func (q *Quasar) StorageProvider() bprovider.StorageProvider {
 	return q.bs.StorageProvider()
 }
 
-func (q *Quasar) InsertValues(id uuid.UUID, r []qtree.Record) bte.BTE {
-	if !q.GetClusterConfiguration().WeHoldWriteLockFor(id) {
-		return bte.Err(bte.WrongEndpoint, "This is the wrong endpoint for this stream")
+//InsertableTime is whether a point at t can be stored. The tree holds times
+//in (MinimumTime, MaximumTime), both ends excluded, although queries may
+//start at MinimumTime
+func InsertableTime(t int64) bool {
+	return t > MinimumTime && t < MaximumTime
+}
+
+//Checks every point has an insertable time, returning the points to insert.
+//In clamp mode out of range times are moved to the nearest storable time
+//instead, in a copy so the caller's points are left alone
+func (q *Quasar) checkInsertTimes(r []qtree.Record) ([]qtree.Record, bte.BTE) {
+	clamp := q.cfg.InsertClampTimes()
+	rv := r
+	copied := false
+	for i := range r {
+		if InsertableTime(r[i].Time) {
+			continue
+		}
+		if !clamp {
+			return nil, bte.ErrF(bte.InvalidTime, "point %d has time %d outside (%d, %d)", i, r[i].Time, MinimumTime, MaximumTime)
+		}
+		if !copied {
+			rv = make([]qtree.Record, len(r))
+			copy(rv, r)
+			copied = true
+		}
+		if r[i].Time <= MinimumTime {
+			rv[i].Time = MinimumTime + 1
+		} else {
+			rv[i].Time = MaximumTime - 1
+		}
+	}
+	return rv, nil
+}
+
+//Takes mtx unless the context is done first, in which case mtx is released
+//as soon as it is acquired
+func lockCtx(ctx context.Context, mtx *sync.Mutex) bte.BTE {
+	if ctx.Done() == nil {
+		mtx.Lock()
+		return nil
+	}
+	if ctx.Err() != nil {
+		return bte.CtxE(ctx)
+	}
+	locked := make(chan struct{})
+	go func() {
+		mtx.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			mtx.Unlock()
+		}()
+		return bte.CtxE(ctx)
+	}
+}
+
+//InsertValuesNoContext is InsertValues without cancellation.
+//Deprecated: use InsertValues
+func (q *Quasar) InsertValuesNoContext(id uuid.UUID, r []qtree.Record) bte.BTE {
+	return q.InsertValues(context.Background(), id, r)
+}
+
+//InsertValues buffers points for the stream, committing them if the buffer
+//is full. If the context is done while waiting for the stream or before the
+//commit starts, a cancellation error is returned and none of the points are
+//kept
+func (q *Quasar) InsertValues(ctx context.Context, id uuid.UUID, r []qtree.Record) bte.BTE {
+	return q.insertValues(ctx, id, r, false)
+}
+
+//InsertValuesSorted is InsertValues for points in time order that are no
+//earlier than any point already buffered for the stream, as is usual for a
+//single sensor. While every insert of a buffer is sorted, the commit skips
+//sorting it. A batch that is out of order is rejected and nothing is kept
+func (q *Quasar) InsertValuesSorted(ctx context.Context, id uuid.UUID, r []qtree.Record) bte.BTE {
+	for i := 1; i < len(r); i++ {
+		if r[i].Time < r[i-1].Time {
+			return bte.ErrF(bte.WrongArgs, "point %d is before the point preceding it", i)
+		}
+	}
+	return q.insertValues(ctx, id, r, true)
+}
+
+func (q *Quasar) insertValues(ctx context.Context, id uuid.UUID, r []qtree.Record, sorted bool) bte.BTE {
+	if err := q.CheckWritable(id); err != nil {
+		return err
+	}
+	r, err := q.checkInsertTimes(r)
+	if err != nil {
+		return err
 	}
 	tr, mtx, err := q.getTree(id)
 	if err != nil {
 		return err
 	}
-	mtx.Lock()
+	if err := lockCtx(ctx, mtx); err != nil {
+		return err
+	}
 	if tr == nil {
 		lg.Panicf("This should not happen")
 	}
+	if tr.closed {
+		mtx.Unlock()
+		return bte.Err(bte.ShuttingDown, "The server is shutting down")
+	}
 	if tr.store == nil {
 		//Empty store
 		tr.store = make([]qtree.Record, 0, len(r)*2)
-		tr.sigEC = make(chan bool, 1)
+		tr.sorted = true
+		var cctx context.Context
+		cctx, tr.cancel = context.WithCancel(q.ctx)
 		//Also spawn the coalesce timeout goroutine
-		go func(abrt chan bool) {
-			tmt := time.After(time.Duration(q.cfg.CoalesceMaxInterval()) * time.Millisecond)
-			select {
-			case <-tmt:
+		go func(ctx context.Context, cancel context.CancelFunc) {
+			interval := time.Duration(q.cfg.CoalesceMaxInterval()) * time.Millisecond
+			for {
+				select {
+				case <-time.After(interval):
+				case <-ctx.Done():
+					return
+				}
 				//do coalesce
 				mtx.Lock()
-				//In case we early tripped between waiting for lock and getting it, commit will return ok
+				//We were stopped by a flush, abort or early trip while waiting for the lock
+				if ctx.Err() != nil {
+					mtx.Unlock()
+					return
+				}
 				//lg.Debug("Coalesce timeout %v", id.String())
-				tr.commit(q)
+				err := tr.commit(context.Background(), q)
+				if err == nil {
+					cancel()
+				}
 				mtx.Unlock()
-			case <-abrt:
-				return
+				if err == nil {
+					return
+				}
+				//The points stay buffered, try again after another interval
+				lg.Errorf("coalesce commit of %s failed: %v", tr.id, err)
 			}
-		}(tr.sigEC)
+		}(cctx, tr.cancel)
+	}
+	before := len(tr.store)
+	wasSorted := tr.sorted
+	if sorted && before > 0 && len(r) > 0 && r[0].Time < tr.store[before-1].Time {
+		mtx.Unlock()
+		return bte.Err(bte.WrongArgs, "sorted insert is before points already buffered for the stream")
 	}
+	tr.sorted = tr.sorted && sorted
 	tr.store = append(tr.store, r...)
-	if len(tr.store) >= q.cfg.CoalesceMaxPoints() {
-		tr.sigEC <- true
+	tr.bytes += len(r) * recordSize
+	maxBytes := q.cfg.CoalesceMaxBytes()
+	if len(tr.store) >= q.cfg.CoalesceMaxPoints() || (maxBytes > 0 && tr.bytes >= maxBytes) {
 		//lg.Debug("Coalesce early trip %v", id.String())
-		tr.commit(q)
+		if err := tr.commit(ctx, q); err != nil {
+			//Drop this insert's points, the timer commits any earlier ones
+			tr.bytes -= len(r) * recordSize
+			tr.sorted = wasSorted
+			if before == 0 {
+				tr.cancel()
+				tr.store = nil
+			} else {
+				tr.store = tr.store[:before]
+			}
+			mtx.Unlock()
+			return err
+		}
+		tr.cancel()
 	}
 	mtx.Unlock()
 	return nil
 }
 
 func (q *Quasar) Flush(id uuid.UUID) bte.BTE {
-	if !q.GetClusterConfiguration().WeHoldWriteLockFor(id) {
-		return bte.Err(bte.WrongEndpoint, "This is the wrong endpoint for this stream")
+	if err := q.CheckWritable(id); err != nil {
+		return err
 	}
 	tr, mtx, err := q.getTree(id)
 	if err != nil {
@@ -186,8 +461,11 @@ func (q *Quasar) Flush(id uuid.UUID) bte.BTE {
 	}
 	mtx.Lock()
 	if len(tr.store) != 0 {
-		tr.sigEC <- true
-		tr.commit(q)
+		if err := tr.commit(context.Background(), q); err != nil {
+			mtx.Unlock()
+			return err
+		}
+		tr.cancel()
 		fmt.Printf("Commit done %+v\n", id)
 	} else {
 		fmt.Printf("no store\n")
@@ -196,29 +474,212 @@ func (q *Quasar) Flush(id uuid.UUID) bte.BTE {
 	return nil
 }
 
+// Abort discards any points buffered for the stream that have not yet been
+// committed. Points that have already been committed are unaffected.
+func (q *Quasar) Abort(id uuid.UUID) bte.BTE {
+	if err := q.CheckWritable(id); err != nil {
+		return err
+	}
+	tr, mtx, err := q.getTree(id)
+	if err != nil {
+		return err
+	}
+	mtx.Lock()
+	if tr.store != nil {
+		//The coalesce timer may already have fired, in which case it is blocked
+		//on mtx and will find it has been cancelled
+		tr.cancel()
+		tr.store = nil
+		tr.bytes = 0
+	}
+	mtx.Unlock()
+	return nil
+}
+
+//InitiateShutdown commits every stream with buffered points and closes the
+//returned channel when done. New streams are refused once it starts, and each
+//stream refuses inserts once committed, so nothing is buffered afterwards.
+//Streams are committed by CoalesceShutdownWorkers workers, each under the
+//stream's own lock
 func (q *Quasar) InitiateShutdown() chan struct{} {
 	rv := make(chan struct{})
 	go func() {
+		type toflush struct {
+			id  [16]byte
+			tr  *openTree
+			mtx *sync.Mutex
+		}
 		lg.Warningf("Attempting to lock core mutex for shutdown")
 		q.globlock.Lock()
-		total := len(q.openTrees)
-		lg.Warningf("Mutex acquired, there are %d trees to flush", total)
-		idx := 0
+		q.shuttingDown = true
+		//Stop the coalesce timers, everything is committed here
+		q.cancel()
+		all := make(chan toflush, len(q.openTrees))
 		for uu, tr := range q.openTrees {
-			idx++
-			if len(tr.store) != 0 {
-				tr.sigEC <- true
-				tr.commit(q)
-				lg.Warningf("Flushed %x (%d/%d)", uu, idx, total)
-			} else {
-				lg.Warningf("Clean %x (%d/%d)", uu, idx, total)
+			all <- toflush{id: uu, tr: tr, mtx: q.treelocks[uu]}
+		}
+		close(all)
+		q.globlock.Unlock()
+		total := len(all)
+		workers := q.cfg.CoalesceShutdownWorkers()
+		if workers <= 0 {
+			workers = DefaultShutdownWorkers
+		}
+		lg.Warningf("There are %d trees to flush with %d workers", total, workers)
+
+		var done, failed int64
+		wg := sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for f := range all {
+					f.mtx.Lock()
+					if len(f.tr.store) != 0 {
+						f.tr.cancel()
+						//Flush as many trees as we can, one bad stream should
+						//not lose the data buffered for all the others
+						if err := f.tr.commit(context.Background(), q); err != nil {
+							lg.Errorf("Failed to flush %x: %v", f.id, err)
+							atomic.AddInt64(&failed, 1)
+						}
+					}
+					f.tr.closed = true
+					f.mtx.Unlock()
+					atomic.AddInt64(&done, 1)
+				}
+			}()
+		}
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		tick := time.NewTicker(ShutdownProgressInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				lg.Warningf("Flushed %d/%d trees", atomic.LoadInt64(&done), total)
+			case <-finished:
+				lg.Warningf("Flushed %d trees, %d failed", total, atomic.LoadInt64(&failed))
+				close(rv)
+				return
 			}
 		}
-		close(rv)
 	}()
 	return rv
 }
 
+//FlushAll commits every stream with buffered points, returning how many were
+//flushed. Unlike InitiateShutdown the server carries on normally afterwards.
+//Each tree is committed under its own lock, as Flush does, so inserts are only
+//held up for the stream being committed. A failed commit does not stop the
+//others, the first error is returned
+func (q *Quasar) FlushAll() (int, bte.BTE) {
+	type toflush struct {
+		id  [16]byte
+		tr  *openTree
+		mtx *sync.Mutex
+	}
+	q.globlock.Lock()
+	all := make([]toflush, 0, len(q.openTrees))
+	for uu, tr := range q.openTrees {
+		all = append(all, toflush{id: uu, tr: tr, mtx: q.treelocks[uu]})
+	}
+	q.globlock.Unlock()
+
+	flushed := 0
+	var rverr bte.BTE
+	for _, f := range all {
+		f.mtx.Lock()
+		if len(f.tr.store) != 0 {
+			if err := f.tr.commit(context.Background(), q); err != nil {
+				//The coalesce timer stays armed to retry the buffered points
+				lg.Errorf("Failed to flush %x: %v", f.id, err)
+				if rverr == nil {
+					rverr = err
+				}
+			} else {
+				//The coalesce timer may already have fired and be waiting on mtx
+				f.tr.cancel()
+				flushed++
+			}
+		}
+		f.mtx.Unlock()
+	}
+	return flushed, rverr
+}
+
+//PendingStats returns the number of buffered, uncommitted points of every
+//stream open on this node. Each tree is read under its own lock, so the
+//counts are not a consistent snapshot across streams
+func (q *Quasar) PendingStats() map[[16]byte]int {
+	q.globlock.Lock()
+	trees := make(map[[16]byte]*openTree, len(q.openTrees))
+	mtxs := make(map[[16]byte]*sync.Mutex, len(q.openTrees))
+	for uu, tr := range q.openTrees {
+		trees[uu] = tr
+		mtxs[uu] = q.treelocks[uu]
+	}
+	q.globlock.Unlock()
+
+	rv := make(map[[16]byte]int, len(trees))
+	for uu, tr := range trees {
+		mtxs[uu].Lock()
+		rv[uu] = len(tr.store)
+		mtxs[uu].Unlock()
+	}
+	return rv
+}
+
+//The number of collections listed per storage call by LocalStreams
+const localStreamsPage = 1000
+
+//LocalStreams returns the streams whose write lock this node holds, or every
+//stream if clustering is disabled. A read replica has none. Ownership is by
+//hash of the UUID, so this pages through every collection and filters each
+//stream listing against the cluster configuration rather than reading each
+//stream's metadata
+func (q *Quasar) LocalStreams() ([]uuid.UUID, bte.BTE) {
+	if q.cfg.StorageCephReadOnly() {
+		//A read replica holds no write locks
+		return []uuid.UUID{}, nil
+	}
+	sp := q.bs.StorageProvider()
+	var cc configprovider.ClusterConfiguration
+	if q.cfg.ClusterEnabled() {
+		cc = q.GetClusterConfiguration()
+	}
+	rv := []uuid.UUID{}
+	from := ""
+	for {
+		cols, err := sp.ListCollections("", from, localStreamsPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range cols {
+			streams, err := sp.ListStreams(col, true, nil, false)
+			if err != nil && err.Code() == bte.NoSuchStream {
+				//The collection is indexed but has no streams left
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range streams {
+				if cc == nil || cc.WeHoldWriteLockFor(s.UUID()) {
+					rv = append(rv, uuid.UUID(s.UUID()))
+				}
+			}
+		}
+		if len(cols) < localStreamsPage {
+			return rv, nil
+		}
+		from = cols[len(cols)-1]
+	}
+}
+
 //These functions are the API. TODO add all the bounds checking on PW, and sanity on start/end
 //NOSYNC func (q *Quasar) QueryValues(ctx context.Context, id uuid.UUID, start int64, end int64, gen uint64) ([]qtree.Record, uint64, error) {
 //NOSYNC 	tr, err := qtree.NewReadQTree(q.bs, id, gen)
@@ -229,8 +690,25 @@ func (q *Quasar) InitiateShutdown() chan struct{} {
 //NOSYNC 	return rv, tr.Generation(), err
 //NOSYNC }
 
+//Streams the raw values in [start, end). If the context was made with
+//WithReadYourWrites and the latest generation is queried, points still
+//buffered for coalescence on this node are merged in
 func (q *Quasar) QueryValuesStream(ctx context.Context, id uuid.UUID, start int64, end int64, gen uint64) (chan qtree.Record, chan bte.BTE, uint64) {
-	tr, err := qtree.NewReadQTree(q.bs, id, gen)
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	//Raw values are read leaf after leaf, so storage may read ahead
+	ctx = bprovider.WithSequentialScan(ctx)
+	if gen == LatestGeneration && readYourWrites(ctx) {
+		tr, buf, err := q.newReadTreeBuffered(ctx, id, start, end)
+		if err != nil {
+			return nil, bte.Chan(err), 0
+		}
+		recordc, errc := tr.ReadStandardValuesCI(ctx, start, end)
+		recordc, errc = mergeBuffered(ctx, recordc, errc, buf)
+		return recordc, errc, tr.Generation()
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
 	if err != nil {
 		return nil, bte.Chan(err), 0
 	}
@@ -238,6 +716,55 @@ func (q *Quasar) QueryValuesStream(ctx context.Context, id uuid.UUID, start int6
 	return recordc, errc, tr.Generation()
 }
 
+//QueryValuesWithBlockGeneration is QueryValuesStream, but each point also
+//carries the generation of the tree block it is stored in, an upper bound on
+//the generation it was committed in. Buffered points are never included
+func (q *Quasar) QueryValuesWithBlockGeneration(ctx context.Context, id uuid.UUID, start int64, end int64, gen uint64) (chan qtree.BlockGenerationRecord, chan bte.BTE, uint64) {
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	recordc, errc := tr.ReadValuesWithBlockGeneration(ctx, start, end)
+	return recordc, errc, tr.Generation()
+}
+
+//QueryLastN returns the last n committed points of the stream in time order,
+//or all of them if it has fewer, without needing a time range
+func (q *Quasar) QueryLastN(ctx context.Context, id uuid.UUID, n int, gen uint64) ([]qtree.Record, bte.BTE) {
+	if n <= 0 {
+		return nil, bte.Err(bte.WrongArgs, "n must be positive")
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, err
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, err
+	}
+	return tr.ReadLastN(ctx, n)
+}
+
+//Like QueryValuesStream, but only points whose value matches pred are returned
+func (q *Quasar) QueryValuesStreamFiltered(ctx context.Context, id uuid.UUID, start int64, end int64, gen uint64, pred *qtree.ValueFilter) (chan qtree.Record, chan bte.BTE, uint64) {
+	if pred != nil && !pred.Valid() {
+		return nil, bte.Chan(bte.Err(bte.WrongArgs, "invalid filter operator")), 0
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	//Raw values are read leaf after leaf, so storage may read ahead
+	ctx = bprovider.WithSequentialScan(ctx)
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	recordc, errc := tr.ReadFilteredValuesCI(ctx, start, end, pred)
+	return recordc, errc, tr.Generation()
+}
+
 //NOSYNC func (q *Quasar) QueryStatisticalValues(ctx context.Context, id uuid.UUID, start int64, end int64,
 //NOSYNC 	gen uint64, pointwidth uint8) ([]qtree.StatRecord, uint64, error) {
 //NOSYNC 	//fmt.Printf("QSV0 s=%v e=%v pw=%v\n", start, end, pointwidth)
@@ -257,9 +784,12 @@ func (q *Quasar) QueryValuesStream(ctx context.Context, id uuid.UUID, start int6
 func (q *Quasar) QueryStatisticalValuesStream(ctx context.Context, id uuid.UUID, start int64, end int64,
 	gen uint64, pointwidth uint8) (chan qtree.StatRecord, chan bte.BTE, uint64) {
 	fmt.Printf("QSV1 s=%v e=%v pw=%v\n", start, end, pointwidth)
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
 	start &^= ((1 << pointwidth) - 1)
 	end &^= ((1 << pointwidth) - 1)
-	tr, err := qtree.NewReadQTree(q.bs, id, gen)
+	tr, err := q.newReadTree(ctx, id, gen)
 	if err != nil {
 		return nil, bte.Chan(err), 0
 	}
@@ -267,9 +797,120 @@ func (q *Quasar) QueryStatisticalValuesStream(ctx context.Context, id uuid.UUID,
 	return rvv, rve, tr.Generation()
 }
 
+//QueryStatisticalValuesApprox is QueryStatisticalValuesStream, but descends
+//at most maxDepth levels into the tree. Where that is too shallow for the
+//pointwidth, coarser records are returned and marked as approximate
+func (q *Quasar) QueryStatisticalValuesApprox(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, pointwidth uint8, maxDepth uint8) (chan qtree.ApproxStatRecord, chan bte.BTE, uint64) {
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	start &^= ((1 << pointwidth) - 1)
+	end &^= ((1 << pointwidth) - 1)
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	rvv, rve := tr.QueryStatisticalValuesApprox(ctx, start, end, pointwidth, maxDepth)
+	return rvv, rve, tr.Generation()
+}
+
+//QueryStatisticalValuesVariance is QueryStatisticalValuesStream with the
+//population variance of each window. It reads most of the leaves in the
+//range, so it is much slower than QueryStatisticalValuesStream
+func (q *Quasar) QueryStatisticalValuesVariance(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, pointwidth uint8) (chan qtree.VarStatRecord, chan bte.BTE, uint64) {
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	start &^= ((1 << pointwidth) - 1)
+	end &^= ((1 << pointwidth) - 1)
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	rvv, rve := tr.QueryStatisticalValuesVariance(ctx, start, end, pointwidth)
+	return rvv, rve, tr.Generation()
+}
+
+//QueryHistogram returns a histogram of the values in each window of
+//2^pointwidth nanoseconds, using the configured buckets. Like
+//QueryStatisticalValuesStream, start and end are rounded down to a window
+func (q *Quasar) QueryHistogram(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, pointwidth uint8) (chan qtree.HistRecord, chan bte.BTE, uint64) {
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	start &^= ((1 << pointwidth) - 1)
+	end &^= ((1 << pointwidth) - 1)
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	rvv, rve := tr.QueryHistogram(ctx, start, end, pointwidth, q.histBounds)
+	return rvv, rve, tr.Generation()
+}
+
+//QueryMultiResolution returns the statistical records of the range at each
+//of the given pointwidths, tagged with their pointwidth, walking the tree only
+//once. Each pointwidth's range is rounded as in QueryStatisticalValuesStream
+func (q *Quasar) QueryMultiResolution(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, pointwidths []uint8) (chan qtree.MultiStatRecord, chan bte.BTE, uint64) {
+	if len(pointwidths) == 0 {
+		return nil, bte.Chan(bte.Err(bte.InvalidPointWidth, "at least one pointwidth is required")), 0
+	}
+	//Sort and remove duplicates
+	var want [64]bool
+	for _, pw := range pointwidths {
+		if pw > 63 {
+			return nil, bte.Chan(bte.Err(bte.InvalidPointWidth, "pointwidths must be at most 63")), 0
+		}
+		want[pw] = true
+	}
+	uniq := make([]uint8, 0, len(pointwidths))
+	for pw := range want {
+		if want[pw] {
+			uniq = append(uniq, uint8(pw))
+		}
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	rvv, rve := tr.QueryMultiResolution(ctx, start, end, uniq)
+	return rvv, rve, tr.Generation()
+}
+
+//HistogramBounds returns the bucket bounds used by QueryHistogram
+func (q *Quasar) HistogramBounds() []float64 {
+	return q.histBounds
+}
+
+//QueryCount returns the exact number of points in [start, end) without
+//transferring any statistical records
+func (q *Quasar) QueryCount(ctx context.Context, id uuid.UUID, start int64, end int64, gen uint64) (uint64, bte.BTE) {
+	if start >= end {
+		return 0, bte.Err(bte.InvalidTimeRange, "start must be before end")
+	}
+	if err := q.checkReadable(id); err != nil {
+		return 0, err
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return 0, err
+	}
+	return tr.QueryCount(ctx, start, end)
+}
+
 func (q *Quasar) QueryWindow(ctx context.Context, id uuid.UUID, start int64, end int64,
 	gen uint64, width uint64, depth uint8) (chan qtree.StatRecord, chan bte.BTE, uint64) {
-	tr, err := qtree.NewReadQTree(q.bs, id, gen)
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
 	if err != nil {
 		return nil, bte.Chan(err), 0
 	}
@@ -277,16 +918,371 @@ func (q *Quasar) QueryWindow(ctx context.Context, id uuid.UUID, start int64, end
 	return rvv, rve, tr.Generation()
 }
 
+//QueryWindowWithGaps is QueryWindow, but every complete window in [start, end)
+//is returned, with a zero count record for the windows that have no data. The
+//windows begin at start + k*width, so consumers get a regular series
+func (q *Quasar) QueryWindowWithGaps(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, width uint64, depth uint8) (chan qtree.StatRecord, chan bte.BTE, uint64) {
+	if width == 0 {
+		return nil, bte.Chan(bte.Err(bte.WrongArgs, "width must be positive")), 0
+	}
+	if start >= end {
+		return nil, bte.Chan(bte.Err(bte.InvalidTimeRange, "start must be before end")), 0
+	}
+	recs, errs, rgen := q.QueryWindow(ctx, id, start, end, gen, width, depth)
+	if recs == nil {
+		return nil, errs, 0
+	}
+	rv := make(chan qtree.StatRecord, qtree.ChanBufferSize)
+	rve := make(chan bte.BTE, 1)
+	go func() {
+		defer close(rv)
+		nxt := start
+		emit := func(r qtree.StatRecord) bool {
+			select {
+			case rv <- r:
+				nxt = r.Time + int64(width)
+				return true
+			case <-ctx.Done():
+				bte.ChkContextError(ctx, rve)
+				return false
+			}
+		}
+		//Fills the gap before t, stopping at the end of the range
+		fill := func(t int64) bool {
+			for nxt < t && nxt+int64(width) <= end {
+				if !emit(qtree.StatRecord{Time: nxt}) {
+					return false
+				}
+			}
+			return true
+		}
+		for r := range recs {
+			if r.Time < nxt {
+				continue
+			}
+			if !fill(r.Time) || !emit(r) {
+				return
+			}
+		}
+		//The tree closes its channel after an error too
+		select {
+		case err := <-errs:
+			rve <- err
+			return
+		default:
+		}
+		fill(end)
+	}()
+	return rv, rve, rgen
+}
+
+//Calendar units for QueryCivilWindow
+const CivilDay = "day"
+const CivilHour = "hour"
+
+//QueryCivilWindow returns one statistical record per calendar day or hour in
+//the given location, so windows begin at local midnight or on the local hour.
+//Across DST transitions a day may be 23 or 25 hours long. The first and last
+//windows are clipped to [start, end)
+func (q *Quasar) QueryCivilWindow(ctx context.Context, id uuid.UUID, start int64, end int64,
+	gen uint64, loc *time.Location, unit string) (chan qtree.StatRecord, chan bte.BTE, uint64) {
+	if start >= end {
+		return nil, bte.Chan(bte.Err(bte.InvalidTimeRange, "start must be before end")), 0
+	}
+	var floor func(t time.Time) time.Time
+	var next func(t time.Time) time.Time
+	switch unit {
+	case CivilDay:
+		floor = func(t time.Time) time.Time {
+			y, m, d := t.Date()
+			return time.Date(y, m, d, 0, 0, 0, 0, loc)
+		}
+		next = func(t time.Time) time.Time {
+			y, m, d := t.Date()
+			return time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		}
+	case CivilHour:
+		//Not Truncate, as that works in absolute time and some zones are
+		//offset by half an hour
+		floor = func(t time.Time) time.Time {
+			return t.Add(-time.Duration(t.Minute())*time.Minute -
+				time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		}
+		next = func(t time.Time) time.Time {
+			return t.Add(time.Hour)
+		}
+	default:
+		return nil, bte.Chan(bte.Err(bte.WrongArgs, "unit must be day or hour")), 0
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	//All the windows are read from the same generation
+	tr, err := q.newReadTree(ctx, id, gen)
+	if err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	rv := make(chan qtree.StatRecord, qtree.ChanBufferSize)
+	rve := make(chan bte.BTE, 1)
+	go func() {
+		defer close(rv)
+		for ws := floor(time.Unix(0, start).In(loc)); ws.UnixNano() < end; ws = next(ws) {
+			s := ws.UnixNano()
+			e := next(ws).UnixNano()
+			if s < start {
+				s = start
+			}
+			if e > end {
+				e = end
+			}
+			recs, errs := tr.QueryWindow(ctx, s, e, uint64(e-s), 0)
+			for r := range recs {
+				select {
+				case rv <- r:
+				case <-ctx.Done():
+					bte.ChkContextError(ctx, rve)
+					return
+				}
+			}
+			select {
+			case err := <-errs:
+				rve <- err
+				return
+			default:
+			}
+		}
+	}()
+	return rv, rve, tr.Generation()
+}
+
+//The largest number of streams QueryCollectionWindow will aggregate
+const MaxAggregateStreams = 256
+
+//QueryCollectionWindow runs an aligned QueryWindow on every stream in the
+//collection matching the given tags and merges the results, so each record
+//holds the total count, the count weighted mean, and the min and max over all
+//the streams for that window. Windows are read at the latest generation
+func (q *Quasar) QueryCollectionWindow(ctx context.Context, collection string, tags map[string]string,
+	start int64, end int64, width uint64, depth uint8) (chan qtree.StatRecord, chan bte.BTE) {
+	strms, err := q.bs.StorageProvider().ListStreams(collection, true, tags, false)
+	if err != nil {
+		return nil, bte.Chan(err)
+	}
+	if len(strms) == 0 {
+		return nil, bte.Chan(bte.Err(bte.NoSuchStream, "no streams match the given collection and tags"))
+	}
+	if len(strms) > MaxAggregateStreams {
+		return nil, bte.Chan(bte.Err(bte.InvalidLimit,
+			fmt.Sprintf("%d streams match, at most %d can be aggregated", len(strms), MaxAggregateStreams)))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	recs := make([]chan qtree.StatRecord, len(strms))
+	errs := make([]chan bte.BTE, len(strms))
+	for i, s := range strms {
+		recs[i], errs[i], _ = q.QueryWindow(ctx, uuid.UUID(s.UUID()), start, end, LatestGeneration, width, depth)
+		if recs[i] == nil {
+			cancel()
+			return nil, errs[i]
+		}
+	}
+	rv := make(chan qtree.StatRecord, qtree.ChanBufferSize)
+	rve := make(chan bte.BTE, 1)
+	go func() {
+		defer cancel()
+		defer close(rv)
+		heads := make([]qtree.StatRecord, len(recs))
+		live := make([]bool, len(recs))
+		//Loads the next window of the given stream. An error may still be
+		//pending once the record channel is closed
+		next := func(i int) bte.BTE {
+			r, ok := <-recs[i]
+			if ok {
+				heads[i] = r
+				return nil
+			}
+			live[i] = false
+			select {
+			case err := <-errs[i]:
+				return err
+			default:
+				return nil
+			}
+		}
+		for i := range recs {
+			live[i] = true
+			if err := next(i); err != nil {
+				rve <- err
+				return
+			}
+		}
+		for {
+			found := false
+			var agg qtree.StatRecord
+			for i := range heads {
+				if live[i] && (!found || heads[i].Time < agg.Time) {
+					agg.Time = heads[i].Time
+					found = true
+				}
+			}
+			if !found {
+				return
+			}
+			var sum float64
+			for i := range heads {
+				if !live[i] || heads[i].Time != agg.Time {
+					continue
+				}
+				h := heads[i]
+				if h.Count > 0 {
+					if agg.Count == 0 || h.Min < agg.Min {
+						agg.Min = h.Min
+					}
+					if agg.Count == 0 || h.Max > agg.Max {
+						agg.Max = h.Max
+					}
+					agg.Count += h.Count
+					sum += h.Mean * float64(h.Count)
+				}
+				if err := next(i); err != nil {
+					rve <- err
+					return
+				}
+			}
+			if agg.Count > 0 {
+				agg.Mean = sum / float64(agg.Count)
+			}
+			select {
+			case rv <- agg:
+			case <-ctx.Done():
+				bte.ChkContextError(ctx, rve)
+				return
+			}
+		}
+	}()
+	return rv, rve
+}
+
+//The number of streams QueryCollectionNearest queries at once
+const CollectionNearestWorkers = 16
+
+//The nearest point in one stream, or why there is none
+type NearestResult struct {
+	Record qtree.Record
+	Err    bte.BTE
+}
+
+//QueryCollectionNearest finds the nearest point to time, as QueryNearestValue
+//does, in every stream in the collection with the given tags. The result is
+//keyed by UUID string. Errors in one stream are recorded in its result rather
+//than stopping the others, and at most CollectionNearestWorkers streams are
+//queried at once
+func (q *Quasar) QueryCollectionNearest(ctx context.Context, collection string, tags map[string]string,
+	time int64, backwards bool) (map[string]NearestResult, bte.BTE) {
+	strms, err := q.bs.StorageProvider().ListStreams(collection, true, tags, false)
+	if err != nil {
+		return nil, err
+	}
+	rv := make(map[string]NearestResult, len(strms))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	work := make(chan uuid.UUID)
+	for i := 0; i < CollectionNearestWorkers && i < len(strms); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				rec, err, _ := q.QueryNearestValue(ctx, id, time, backwards, LatestGeneration)
+				mu.Lock()
+				rv[id.String()] = NearestResult{Record: rec, Err: err}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, s := range strms {
+		work <- uuid.UUID(s.UUID())
+	}
+	close(work)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, bte.CtxE(ctx)
+	}
+	return rv, nil
+}
+
 func (q *Quasar) QueryGeneration(id uuid.UUID) (uint64, bte.BTE) {
-	sb := q.bs.LoadSuperblock(id, bstore.LatestGeneration)
+	if err := q.checkReadable(id); err != nil {
+		return 0, err
+	}
+	sb, err := q.bs.LoadSuperblock(id, bstore.LatestGeneration)
+	if err != nil {
+		return 0, err
+	}
 	if sb == nil {
 		return 0, bte.Err(bte.NoSuchStream, "stream not found")
 	}
 	return sb.Gen(), nil
 }
 
+//GenerationAsOf returns the highest generation of the stream that was
+//committed at or before the given wall clock time. Every superblock records
+//when it was created, and those times increase with the generation, so this
+//is a binary search over superblocks
+func (q *Quasar) GenerationAsOf(id uuid.UUID, wallTime time.Time) (uint64, bte.BTE) {
+	if err := q.checkReadable(id); err != nil {
+		return 0, err
+	}
+	t := wallTime.UnixNano()
+	latest, err := q.bs.LoadSuperblock(id, LatestGeneration)
+	if err != nil {
+		return 0, err
+	}
+	if latest == nil {
+		return 0, bte.Err(bte.NoSuchStream, "stream not found")
+	}
+	if latest.Walltime() <= t {
+		return latest.Gen(), nil
+	}
+	//Invariant: lo is committed at or before t, hi is after it
+	lo := uint64(bprovider.SpecialVersionFirst)
+	hi := latest.Gen()
+	if lo >= hi {
+		return 0, bte.Err(bte.NoSuchPoint, "no generation was committed at or before that time")
+	}
+	//The stream may be deleted while it is searched
+	first, err := q.bs.LoadSuperblock(id, lo)
+	if err != nil {
+		return 0, err
+	}
+	if first == nil {
+		return 0, bte.Err(bte.NoSuchStream, "stream not found")
+	}
+	if first.Walltime() > t {
+		return 0, bte.Err(bte.NoSuchPoint, "no generation was committed at or before that time")
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		sb, err := q.bs.LoadSuperblock(id, mid)
+		if err != nil {
+			return 0, err
+		}
+		if sb == nil {
+			return 0, bte.Err(bte.NoSuchStream, "stream not found")
+		}
+		if sb.Walltime() <= t {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
 func (q *Quasar) QueryNearestValue(ctx context.Context, id uuid.UUID, time int64, backwards bool, gen uint64) (qtree.Record, bte.BTE, uint64) {
-	tr, err := qtree.NewReadQTree(q.bs, id, gen)
+	if err := q.checkReadable(id); err != nil {
+		return qtree.Record{}, err, 0
+	}
+	tr, err := q.newReadTree(ctx, id, gen)
 	if err != nil {
 		return qtree.Record{}, err, 0
 	}
@@ -306,7 +1302,10 @@ func (q *Quasar) QueryChangedRanges(ctx context.Context, id uuid.UUID, startgen
 	if startgen == 0 {
 		startgen = 1
 	}
-	tr, err := qtree.NewReadQTree(q.bs, id, endgen)
+	if err := q.checkReadable(id); err != nil {
+		return nil, bte.Chan(err), 0
+	}
+	tr, err := q.newReadTree(ctx, id, endgen)
 	if err != nil {
 		lg.Debug("Error on QCR open tree")
 		return nil, bte.Chan(err), 0
@@ -317,6 +1316,18 @@ func (q *Quasar) QueryChangedRanges(ctx context.Context, id uuid.UUID, startgen
 	rch, rche := tr.FindChangedSince(nctx, startgen, resolution)
 	var lr *ChangedRange = nil
 	go func() {
+		//The consumer may stop reading, so give up if the context ends while
+		//waiting to send
+		send := func(cr ChangedRange) bool {
+			select {
+			case rv <- cr:
+				return true
+			case <-ctx.Done():
+				cancel()
+				rve <- bte.CtxE(ctx)
+				return false
+			}
+		}
 		for {
 			select {
 			case err, ok := <-rche:
@@ -329,8 +1340,8 @@ func (q *Quasar) QueryChangedRanges(ctx context.Context, id uuid.UUID, startgen
 				if !ok {
 					//This is the end.
 					//Do we have an unsaved LR?
-					if lr != nil {
-						rv <- *lr
+					if lr != nil && !send(*lr) {
+						return
 					}
 					close(rv)
 					cancel()
@@ -343,8 +1354,8 @@ func (q *Quasar) QueryChangedRanges(ctx context.Context, id uuid.UUID, startgen
 				if lr != nil && cr.Start == lr.End {
 					lr.End = cr.End
 				} else {
-					if lr != nil {
-						rv <- *lr
+					if lr != nil && !send(*lr) {
+						return
 					}
 					lr = &ChangedRange{Start: cr.Start, End: cr.End}
 				}
@@ -355,27 +1366,82 @@ func (q *Quasar) QueryChangedRanges(ctx context.Context, id uuid.UUID, startgen
 }
 
 func (q *Quasar) DeleteRange(id uuid.UUID, start int64, end int64) bte.BTE {
-	if !q.GetClusterConfiguration().WeHoldWriteLockFor(id) {
-		return bte.Err(bte.WrongEndpoint, "This is the wrong endpoint for this stream")
+	_, err := q.DeleteRangeGeneration(id, start, end)
+	return err
+}
+
+//DeleteRangeGeneration is DeleteRange, also returning the generation the
+//deletion was committed as. The deleted range is recorded as a tombstone for
+//QueryDeletions before the deletion is committed, under the tree lock, and if
+//that fails nothing is deleted. If the server dies between the two, or the
+//commit fails, the tombstone names a generation that was never committed as
+//a deletion
+func (q *Quasar) DeleteRangeGeneration(id uuid.UUID, start int64, end int64) (uint64, bte.BTE) {
+	if err := q.CheckWritable(id); err != nil {
+		return 0, err
 	}
 	tr, mtx, err := q.getTree(id)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	mtx.Lock()
 	if len(tr.store) != 0 {
-		tr.sigEC <- true
-		tr.commit(q)
+		if err := tr.commit(context.Background(), q); err != nil {
+			mtx.Unlock()
+			return 0, err
+		}
+		tr.cancel()
 	}
 	wtr, err := qtree.NewWriteQTree(q.bs, id)
 	if err != nil {
-		return err
+		mtx.Unlock()
+		return 0, err
 	}
-	err2 := wtr.DeleteRange(start, end)
-	if err2 != nil {
-		lg.Panic(err2)
+	if err := wtr.DeleteRange(start, end); err != nil {
+		wtr.Abort()
+		mtx.Unlock()
+		return 0, err
+	}
+	gen := wtr.Generation()
+	//The tombstone is written first, so a committed deletion always has one
+	if err := q.bs.StorageProvider().AddTombstone(id, gen, start, end); err != nil {
+		wtr.Abort()
+		mtx.Unlock()
+		lg.Errorf("could not record deletion of [%d, %d) from %s in generation %d: %v", start, end, id, gen, err)
+		return 0, err
+	}
+	if err := wtr.Commit(); err != nil {
+		mtx.Unlock()
+		lg.Errorf("could not commit deletion of [%d, %d) from %s in generation %d: %v", start, end, id, gen, err)
+		return 0, err
 	}
-	wtr.Commit()
 	mtx.Unlock()
-	return nil
+	return gen, nil
+}
+
+//A range deleted by DeleteRange, and the generation that deleted it
+type Deletion struct {
+	ChangedRange
+	Generation uint64
+}
+
+//QueryDeletions returns the ranges deleted from the stream in generations
+//after startgen up to endgen, in generation order, so replicas can replay
+//them. Deletions made before tombstones were recorded are not returned
+func (q *Quasar) QueryDeletions(id uuid.UUID, startgen uint64, endgen uint64) ([]Deletion, bte.BTE) {
+	if startgen > endgen {
+		return nil, bte.Err(bte.WrongArgs, "start generation must not be after end generation")
+	}
+	if err := q.checkReadable(id); err != nil {
+		return nil, err
+	}
+	ts, err := q.bs.StorageProvider().ListTombstones(id, startgen, endgen)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]Deletion, len(ts))
+	for i, t := range ts {
+		rv[i] = Deletion{ChangedRange: ChangedRange{Start: t.Start, End: t.End}, Generation: t.Generation}
+	}
+	return rv, nil
 }
@@ -30,8 +30,8 @@ func TestMultInsert(t *testing.T) {
 		log.Panic(err)
 	}
 	vals := []qtree.Record{{10, 10}, {20, 20}}
-	q.InsertValues(testuuid, vals)
-	q.InsertValues(testuuid, vals)
+	q.InsertValuesNoContext(testuuid, vals)
+	q.InsertValuesNoContext(testuuid, vals)
 }
 */
 func init() {
@@ -151,7 +151,7 @@ func TestInsertFlush(t *testing.T) {
 		if end > len(tdat) {
 			end = len(tdat)
 		}
-		q.InsertValues(id, tdat[idx:end])
+		q.InsertValuesNoContext(id, tdat[idx:end])
 		q.Flush(id)
 		idx += ln
 	}
@@ -195,12 +195,12 @@ func TestArbWindow(t *testing.T) {
 		tdat[i].Time = int64(startt) + int64(deltat*i)
 		tdat[i].Val = float64(i)
 	}
-	q.InsertValues(id, tdat)
+	q.InsertValuesNoContext(id, tdat)
 	for i := 0; i < tnum; i++ {
 		tdat[i].Time = int64(startt) + int64(deltat*i) + int64(tnum*2*deltat)
 		tdat[i].Val = float64(i)
 	}
-	q.InsertValues(id, tdat)
+	q.InsertValuesNoContext(id, tdat)
 	q.Flush(id)
 	time.Sleep(2 * time.Second)
 	log.Info("Stream: %+v\n", id)
@@ -258,7 +258,7 @@ func TestUnlinkBlocks(t *testing.T) {
 		if end > len(tdat) {
 			end = len(tdat)
 		}
-		q.InsertValues(id, tdat[idx:end])
+		q.InsertValuesNoContext(id, tdat[idx:end])
 		idx += ln
 	}
 	//Allow for coalescence
@@ -321,7 +321,7 @@ func TestCompleteDelete(t *testing.T) {
 		log.Panic(err)
 	}
 	{
-		q.InsertValues(id, tdat)
+		q.InsertValuesNoContext(id, tdat)
 		q.Flush(id)
 	}
 	{
@@ -343,7 +343,7 @@ func TestCompleteDelete(t *testing.T) {
 		}
 	}
 	{
-		q.InsertValues(id, tdat)
+		q.InsertValuesNoContext(id, tdat)
 		q.Flush(id)
 	}
 	{
@@ -392,7 +392,7 @@ func TestUnlinkBlocks2(t *testing.T) {
 		if end > len(tdat) {
 			end = len(tdat)
 		}
-		q.InsertValues(id, tdat[idx:end])
+		q.InsertValuesNoContext(id, tdat[idx:end])
 		idx += ln
 	}
 	//Allow for coalescence
@@ -413,7 +413,7 @@ func TestUnlinkBlocks2(t *testing.T) {
 		}
 	}
 	{
-		q.InsertValues(id, []qtree.Record{{0, 100}})
+		q.InsertValuesNoContext(id, []qtree.Record{{0, 100}})
 		q.Flush(id)
 	}
 	{
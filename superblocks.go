@@ -0,0 +1,65 @@
+package btrdb
+
+import (
+	"fmt"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+//The most superblocks DumpSuperblocks will read at once
+const MaxSuperblockDump = 1000
+
+//A superblock of a stream as stored, for debugging
+type SuperblockInfo struct {
+	Generation uint64
+	//The address of the root node, zero if the tree is empty
+	Root uint64
+	//When the generation was committed, in nanoseconds
+	Walltime int64
+	//Why the superblock could not be read, nil if it was
+	Err bte.BTE
+}
+
+//DumpSuperblocks reads the superblocks of generations startGen to endGen.
+//The range is clipped to the generations the stream has, so LatestGeneration
+//may be used as endGen, and at most MaxSuperblockDump are read. A superblock
+//that cannot be read is returned with its error rather than failing the dump
+func (q *Quasar) DumpSuperblocks(id uuid.UUID, startGen uint64, endGen uint64) ([]SuperblockInfo, bte.BTE) {
+	if startGen > endGen {
+		return nil, bte.Err(bte.WrongArgs, "start generation must not be after end generation")
+	}
+	latest := q.bs.StorageProvider().GetStreamVersion(id)
+	if latest == 0 {
+		return nil, bte.Err(bte.NoSuchStream, "stream not found")
+	}
+	if startGen < bprovider.SpecialVersionFirst {
+		startGen = bprovider.SpecialVersionFirst
+	}
+	if endGen > latest {
+		endGen = latest
+	}
+	rv := []SuperblockInfo{}
+	if startGen > endGen {
+		return rv, nil
+	}
+	if endGen-startGen >= MaxSuperblockDump {
+		return nil, bte.Err(bte.InvalidLimit,
+			fmt.Sprintf("%d generations requested, at most %d can be dumped", endGen-startGen+1, MaxSuperblockDump))
+	}
+	for g := startGen; g <= endGen; g++ {
+		info := SuperblockInfo{Generation: g}
+		sb, err := q.bs.LoadSuperblock(id, g)
+		if err != nil {
+			info.Err = err
+		} else if sb == nil {
+			info.Err = bte.Err(bte.NoSuchPoint, "superblock not found")
+		} else {
+			info.Root = sb.Root()
+			info.Walltime = sb.Walltime()
+		}
+		rv = append(rv, info)
+	}
+	return rv, nil
+}
@@ -0,0 +1,111 @@
+package btrdb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/internal/bstore"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+	"github.com/pborman/uuid"
+)
+
+type readYourWritesKey struct{}
+
+//WithReadYourWrites returns a context that makes raw value queries of the
+//latest generation also return points that have been inserted on this node
+//but not yet committed by coalescence
+func WithReadYourWrites(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readYourWritesKey{}, true)
+}
+
+func readYourWrites(ctx context.Context) bool {
+	rv, _ := ctx.Value(readYourWritesKey{}).(bool)
+	return rv
+}
+
+//Opens a tree for a query of the latest generation along with a sorted copy
+//of the buffered points in [start, end). Both are taken under the tree lock,
+//so no point is both buffered and in the tree
+func (q *Quasar) newReadTreeBuffered(ctx context.Context, id uuid.UUID, start int64, end int64) (*qtree.QTree, []qtree.Record, bte.BTE) {
+	mk := bstore.UUIDToMapKey(id)
+	q.globlock.Lock()
+	tr, ok := q.openTrees[mk]
+	mtx := q.treelocks[mk]
+	q.globlock.Unlock()
+	if !ok {
+		//Nothing has been inserted on this node
+		rt, err := q.newReadTree(ctx, id, LatestGeneration)
+		return rt, nil, err
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	var buf []qtree.Record
+	for _, r := range tr.store {
+		if r.Time >= start && r.Time < end {
+			buf = append(buf, r)
+		}
+	}
+	rt, err := q.newReadTree(ctx, id, LatestGeneration)
+	if err != nil {
+		return nil, nil, err
+	}
+	//Stable, so points inserted at the same time keep their order
+	sort.Stable(qtree.RecordSlice(buf))
+	return rt, buf, nil
+}
+
+//Merges sorted buffered points into a stream of committed ones. At equal
+//times the committed points come first, as they were inserted earlier
+func mergeBuffered(ctx context.Context, recordc chan qtree.Record, errc chan bte.BTE, buf []qtree.Record) (chan qtree.Record, chan bte.BTE) {
+	if len(buf) == 0 {
+		return recordc, errc
+	}
+	rv := make(chan qtree.Record, qtree.ChanBufferSize)
+	rve := make(chan bte.BTE, 1)
+	go func() {
+		send := func(r qtree.Record) bool {
+			select {
+			case rv <- r:
+				return true
+			case <-ctx.Done():
+				rve <- bte.CtxE(ctx)
+				return false
+			}
+		}
+		i := 0
+		for {
+			select {
+			case err := <-errc:
+				rve <- err
+				return
+			case r, ok := <-recordc:
+				if !ok {
+					//The tree may close its channel after an error
+					select {
+					case err := <-errc:
+						rve <- err
+						return
+					default:
+					}
+					for ; i < len(buf); i++ {
+						if !send(buf[i]) {
+							return
+						}
+					}
+					close(rv)
+					return
+				}
+				for ; i < len(buf) && buf[i].Time < r.Time; i++ {
+					if !send(buf[i]) {
+						return
+					}
+				}
+				if !send(r) {
+					return
+				}
+			}
+		}
+	}()
+	return rv, rve
+}
@@ -0,0 +1,38 @@
+package btrdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/SoftwareDefinedBuildings/btrdb/bte"
+	"github.com/SoftwareDefinedBuildings/btrdb/qtree"
+)
+
+func TestMergeBuffered(t *testing.T) {
+	recordc := make(chan qtree.Record, 10)
+	errc := make(chan bte.BTE, 1)
+	for _, tm := range []int64{10, 20, 30} {
+		recordc <- qtree.Record{Time: tm, Val: 1}
+	}
+	close(recordc)
+	buf := []qtree.Record{{Time: 5, Val: 2}, {Time: 20, Val: 2}, {Time: 40, Val: 2}}
+	rc, ec := mergeBuffered(context.Background(), recordc, errc, buf)
+	expected := []qtree.Record{{5, 2}, {10, 1}, {20, 1}, {20, 2}, {30, 1}, {40, 2}}
+	got := []qtree.Record{}
+	for r := range rc {
+		got = append(got, r)
+	}
+	select {
+	case err := <-ec:
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, got)
+		}
+	}
+}